@@ -0,0 +1,136 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Faults a rule can inject
+const (
+	// FaultThrottle fails the call with ProvisionedThroughputExceededException before it reaches DynamoDB
+	FaultThrottle = "throttle"
+	// FaultLatency delays the call by LatencyMs and then makes it
+	FaultLatency = "latency"
+	// FaultTimeout blocks until the context is done, or LatencyMs has passed, and fails the call with a deadline error
+	FaultTimeout = "timeout"
+	// FaultPartial makes the call but fails part of it: writes are applied and then reported as failed,
+	// and queries return only the first half of their items
+	FaultPartial = "partial"
+)
+
+// defaultTimeout bounds a timeout fault on a context without a deadline when the rule sets no LatencyMs
+const defaultTimeout = 30 * time.Second
+
+// dataOperations are the operations a rule without an operation applies to. Reads of API keys and bins
+// and the health checks are only hit by rules naming them, so a catch-all rule cannot lock every caller
+// out or take the server out of rotation.
+var dataOperations = map[string]bool{
+	"StoreData":           true,
+	"StoreEventData":      true,
+	"StoreOrderEventData": true,
+	"StoreEvent":          true,
+	"QueryEvents":         true,
+	"CreateBin":           true,
+	"DeleteBin":           true,
+}
+
+// otherOperations are the remaining operations faults can be injected into, hit only by rules naming them
+var otherOperations = map[string]bool{
+	"GetBin":           true,
+	"StoreAPIKey":      true,
+	"GetAPIKey":        true,
+	"ListAPIKeys":      true,
+	"DeleteAPIKey":     true,
+	"DescribeTable":    true,
+	"CheckTableHealth": true,
+}
+
+// Rule injects a fault into the matching database operations
+type Rule struct {
+	// Operation is a DatabaseInterface method such as StoreEvent or QueryEvents; empty matches every data
+	// operation, but not the API key, bin lookup and health check operations
+	Operation string `json:"operation,omitempty"`
+	// Table limits the rule to one table; empty matches every table
+	Table string `json:"table,omitempty"`
+	Fault string `json:"fault"`
+	// Probability is the chance, between 0 and 1, that a matching call is hit; zero means every call
+	Probability float64 `json:"probability,omitempty"`
+	LatencyMs   int     `json:"latencyMs,omitempty"`
+	// Count is how many more calls the rule hits before it is removed; zero leaves the rule in place
+	Count int `json:"count,omitempty"`
+}
+
+// Config holds the fault rules. Rules are checked in order: latency rules add up, and the first
+// matching throttle, timeout or partial rule decides how the call fails.
+type Config struct {
+	Enabled bool   `json:"enabled"`
+	Rules   []Rule `json:"rules"`
+}
+
+// matches reports whether the rule applies to an operation on a table
+func (r Rule) matches(operation, table string) bool {
+	if r.Operation == "" {
+		return dataOperations[operation] && (r.Table == "" || r.Table == table)
+	}
+	return r.Operation == operation && (r.Table == "" || r.Table == table)
+}
+
+func (r Rule) latency() time.Duration {
+	return time.Duration(r.LatencyMs) * time.Millisecond
+}
+
+// Validate checks that every rule names a known operation and fault with a usable probability and latency.
+// A misspelt operation would otherwise never match and silently inject nothing.
+func (c Config) Validate() error {
+	for i, rule := range c.Rules {
+		if rule.Operation != "" && !dataOperations[rule.Operation] && !otherOperations[rule.Operation] {
+			return fmt.Errorf("rule %d: unknown operation %q, expected one of %s", i, rule.Operation, strings.Join(operations(), ", "))
+		}
+		switch rule.Fault {
+		case FaultThrottle, FaultTimeout, FaultPartial:
+		case FaultLatency:
+			if rule.LatencyMs <= 0 {
+				return fmt.Errorf("rule %d: a latency fault needs a positive latencyMs", i)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown fault %q, expected throttle, latency, timeout or partial", i, rule.Fault)
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("rule %d: probability %g is not between 0 and 1", i, rule.Probability)
+		}
+		if rule.LatencyMs < 0 || rule.Count < 0 {
+			return fmt.Errorf("rule %d: latencyMs and count cannot be negative", i)
+		}
+	}
+	return nil
+}
+
+// operations returns the names of the operations faults can be injected into, sorted
+func operations() []string {
+	names := make([]string, 0, len(dataOperations)+len(otherOperations))
+	for name := range dataOperations {
+		names = append(names, name)
+	}
+	for name := range otherOperations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadConfig reads a fault config from a JSON file
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read fault config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse fault config %s: %w", path, err)
+	}
+	return config, config.Validate()
+}
@@ -0,0 +1,281 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Database wraps a database and injects the configured faults into its data operations.
+// Connecting, creating tables and closing are passed through untouched.
+type Database struct {
+	persistent.DatabaseInterface
+	mu     sync.Mutex
+	config Config
+	// injected counts the faults injected per operation and fault
+	injected map[string]map[string]int64
+	random   func() float64
+}
+
+// Wrap returns db with fault injection controlled by config
+func Wrap(db persistent.DatabaseInterface, config Config) *Database {
+	return &Database{DatabaseInterface: db, config: config, injected: make(map[string]map[string]int64), random: rand.Float64}
+}
+
+// SetConfig replaces the fault rules; calls already waiting on a fault are not affected
+func (d *Database) SetConfig(config Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = config
+	log.Printf("Fault injection enabled=%t with %d rules", config.Enabled, len(config.Rules))
+}
+
+// Config returns the fault rules in force, with the remaining count of counted rules
+func (d *Database) Config() Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	config := d.config
+	config.Rules = append([]Rule(nil), d.config.Rules...)
+	return config
+}
+
+// Stats returns the number of faults injected per operation and fault since the last reset
+func (d *Database) Stats() map[string]map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make(map[string]map[string]int64, len(d.injected))
+	for operation, faults := range d.injected {
+		stats[operation] = make(map[string]int64, len(faults))
+		for fault, n := range faults {
+			stats[operation][fault] = n
+		}
+	}
+	return stats
+}
+
+// ResetStats clears the injected fault counts
+func (d *Database) ResetStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.injected = make(map[string]map[string]int64)
+}
+
+// pick returns the rules that hit a call: any latency rules, followed by at most one failing rule
+func (d *Database) pick(operation, table string) []Rule {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.config.Enabled {
+		return nil
+	}
+	var hit []Rule
+	rules := make([]Rule, 0, len(d.config.Rules))
+	failing := false
+	for _, rule := range d.config.Rules {
+		fires := !failing && rule.matches(operation, table) && (rule.Probability == 0 || d.random() < rule.Probability)
+		if fires {
+			hit = append(hit, rule)
+			failing = rule.Fault != FaultLatency
+			d.count(operation, rule.Fault)
+			metrics.FaultInjected(operation, rule.Fault)
+			if rule.Count > 0 {
+				if rule.Count--; rule.Count == 0 {
+					continue
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	d.config.Rules = rules
+	return hit
+}
+
+func (d *Database) count(operation, fault string) {
+	if d.injected[operation] == nil {
+		d.injected[operation] = make(map[string]int64)
+	}
+	d.injected[operation][fault]++
+}
+
+// inject applies the faults hitting a call. It returns an error when the call must fail before it is made,
+// and partial when the call must be made and then partially failed.
+func (d *Database) inject(ctx context.Context, operation, table string) (partial bool, err error) {
+	for _, rule := range d.pick(operation, table) {
+		switch rule.Fault {
+		case FaultLatency:
+			if err := sleep(ctx, rule.latency()); err != nil {
+				return false, err
+			}
+		case FaultThrottle:
+			return false, &types.ProvisionedThroughputExceededException{
+				Message: aws.String(fmt.Sprintf("injected fault: throughput exceeded for %s on %s", operation, table)),
+			}
+		case FaultTimeout:
+			wait := rule.latency()
+			if wait == 0 {
+				wait = defaultTimeout
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return false, err
+			}
+			return false, fmt.Errorf("injected fault: %s on %s timed out after %s: %w", operation, table, wait, context.DeadlineExceeded)
+		case FaultPartial:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sleep waits for d or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// partialError reports a call that was applied but answered as failed, as DynamoDB does when a
+// request fails after the write was made
+func partialError(operation, table string) error {
+	return &types.InternalServerError{
+		Message: aws.String(fmt.Sprintf("injected fault: %s on %s failed after it was applied", operation, table)),
+	}
+}
+
+// write injects faults into an operation that changes the table
+func (d *Database) write(ctx context.Context, operation, table string, call func() error) error {
+	partial, err := d.inject(ctx, operation, table)
+	if err != nil {
+		return err
+	}
+	if err := call(); err != nil || !partial {
+		return err
+	}
+	return partialError(operation, table)
+}
+
+func (d *Database) StoreData(ctx context.Context, tableName, pKey string, data interface{}) error {
+	return d.write(ctx, "StoreData", tableName, func() error {
+		return d.DatabaseInterface.StoreData(ctx, tableName, pKey, data)
+	})
+}
+
+func (d *Database) StoreEventData(ctx context.Context, tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	return d.write(ctx, "StoreEventData", tableName, func() error {
+		return d.DatabaseInterface.StoreEventData(ctx, tableName, eventType, eventId, lastUpdated, merchantId, eventData, opts)
+	})
+}
+
+func (d *Database) StoreOrderEventData(ctx context.Context, tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	return d.write(ctx, "StoreOrderEventData", tableName, func() error {
+		return d.DatabaseInterface.StoreOrderEventData(ctx, tableName, eventType, externalOrderId, lastUpdated, merchantId, eventData, opts)
+	})
+}
+
+func (d *Database) StoreEvent(ctx context.Context, tableName string, record persistent.EventRecord, opts model.EventOptions) error {
+	return d.write(ctx, "StoreEvent", tableName, func() error {
+		return d.DatabaseInterface.StoreEvent(ctx, tableName, record, opts)
+	})
+}
+
+func (d *Database) CreateBin(ctx context.Context, tableName string, bin model.Bin) error {
+	return d.write(ctx, "CreateBin", tableName, func() error {
+		return d.DatabaseInterface.CreateBin(ctx, tableName, bin)
+	})
+}
+
+func (d *Database) DeleteBin(ctx context.Context, tableName, id string) error {
+	return d.write(ctx, "DeleteBin", tableName, func() error {
+		return d.DatabaseInterface.DeleteBin(ctx, tableName, id)
+	})
+}
+
+func (d *Database) StoreAPIKey(ctx context.Context, tableName string, key model.APIKey) error {
+	return d.write(ctx, "StoreAPIKey", tableName, func() error {
+		return d.DatabaseInterface.StoreAPIKey(ctx, tableName, key)
+	})
+}
+
+func (d *Database) DeleteAPIKey(ctx context.Context, tableName, id string) error {
+	return d.write(ctx, "DeleteAPIKey", tableName, func() error {
+		return d.DatabaseInterface.DeleteAPIKey(ctx, tableName, id)
+	})
+}
+
+// QueryEvents returns the first half of the page's events under a partial fault
+func (d *Database) QueryEvents(ctx context.Context, tableName string, query model.EventQuery) (model.EventPage, error) {
+	partial, err := d.inject(ctx, "QueryEvents", tableName)
+	if err != nil {
+		return model.EventPage{}, err
+	}
+	page, err := d.DatabaseInterface.QueryEvents(ctx, tableName, query)
+	if err != nil || !partial {
+		return page, err
+	}
+	page.Events = page.Events[:len(page.Events)/2]
+	return page, nil
+}
+
+// Single-item reads have no partial result, so a partial fault fails them after the read is made
+
+func (d *Database) DescribeTable(ctx context.Context, tableName string) error {
+	return d.write(ctx, "DescribeTable", tableName, func() error {
+		return d.DatabaseInterface.DescribeTable(ctx, tableName)
+	})
+}
+
+func (d *Database) CheckTableHealth(ctx context.Context, tableName string) (health persistent.TableHealth, err error) {
+	err = d.write(ctx, "CheckTableHealth", tableName, func() (err error) {
+		health, err = d.DatabaseInterface.CheckTableHealth(ctx, tableName)
+		return err
+	})
+	return health, err
+}
+
+func (d *Database) GetBin(ctx context.Context, tableName, id string) (bin *model.Bin, err error) {
+	err = d.write(ctx, "GetBin", tableName, func() (err error) {
+		bin, err = d.DatabaseInterface.GetBin(ctx, tableName, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bin, nil
+}
+
+func (d *Database) GetAPIKey(ctx context.Context, tableName, id string) (key *model.APIKey, err error) {
+	err = d.write(ctx, "GetAPIKey", tableName, func() (err error) {
+		key, err = d.DatabaseInterface.GetAPIKey(ctx, tableName, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns the first half of the keys under a partial fault
+func (d *Database) ListAPIKeys(ctx context.Context, tableName string) ([]model.APIKey, error) {
+	partial, err := d.inject(ctx, "ListAPIKeys", tableName)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := d.DatabaseInterface.ListAPIKeys(ctx, tableName)
+	if err != nil || !partial {
+		return keys, err
+	}
+	return keys[:len(keys)/2], nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/persistent"
+	"webhook_test_server/ratelimit"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Every setting has a default and can be set, in increasing order of
+// precedence, in the YAML config file named by -config or CONFIG_FILE, in the environment (a .env file
+// fills in variables that are not already set), and with a command-line flag. The flag of a setting is
+// its environment variable in lower case with dashes, so SERVER_PORT is set with -server-port.
+type Config struct {
+	Server     ServerConfig    `yaml:"server"`
+	DynamoDB   DynamoDBConfig  `yaml:"dynamodb"`
+	Events     EventsConfig    `yaml:"events"`
+	Ingest     IngestConfig    `yaml:"ingest"`
+	Auth       AuthConfig      `yaml:"auth"`
+	TLS        TLSSettings     `yaml:"tls"`
+	RateLimits RateLimitConfig `yaml:"rateLimits"`
+	Bins       BinsConfig      `yaml:"bins"`
+	Chaos      ChaosConfig     `yaml:"chaos"`
+	Readiness  ReadinessConfig `yaml:"readiness"`
+	Metrics    MetricsConfig   `yaml:"metrics"`
+}
+
+// ServerConfig configures the HTTP server and its graceful shutdown
+type ServerConfig struct {
+	Port                   string        `yaml:"port" env:"SERVER_PORT"`
+	ReadHeaderTimeout      time.Duration `yaml:"readHeaderTimeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout            time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout           time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout            time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"`
+	MaxHeaderBytes         int           `yaml:"maxHeaderBytes" env:"SERVER_MAX_HEADER_BYTES"`
+	ShutdownReadinessDelay time.Duration `yaml:"shutdownReadinessDelay" env:"SHUTDOWN_READINESS_DELAY"`
+	ShutdownTimeout        time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// DynamoDBConfig configures the DynamoDB connection, the tables and how operations are retried
+type DynamoDBConfig struct {
+	// CredentialsMode is default, local, profile, irsa or static; empty picks local when an endpoint is set
+	CredentialsMode      string `yaml:"credentialsMode" env:"DYNAMODB_CREDENTIALS_MODE"`
+	Region               string `yaml:"region" env:"DYNAMODB_REGION"`
+	Endpoint             string `yaml:"endpoint" env:"DYNAMODB_ENDPOINT"`
+	Profile              string `yaml:"profile" env:"DYNAMODB_PROFILE"`
+	RoleARN              string `yaml:"roleArn" env:"AWS_ROLE_ARN"`
+	WebIdentityTokenFile string `yaml:"webIdentityTokenFile" env:"AWS_WEB_IDENTITY_TOKEN_FILE"`
+	RoleSessionName      string `yaml:"roleSessionName" env:"AWS_ROLE_SESSION_NAME"`
+	AccessKeyID          string `yaml:"accessKeyId" env:"DYNAMODB_ACCESS_KEY_ID" secret:"true"`
+	SecretAccessKey      string `yaml:"secretAccessKey" env:"DYNAMODB_SECRET_ACCESS_KEY" secret:"true"`
+	SessionToken         string `yaml:"sessionToken" env:"DYNAMODB_SESSION_TOKEN" secret:"true"`
+	OrderTable           string `yaml:"orderTable" env:"DYNAMODB_ORDER_TABLE_NAME"`
+	ProductTable         string `yaml:"productTable" env:"DYNAMODB_PRODUCT_TABLE_NAME"`
+	// Tables binds table names to roles, such as orders=Orders; OrderTable and ProductTable take precedence
+	Tables map[string]string `yaml:"tables" env:"DYNAMODB_TABLES"`
+	// TableDefinitions is the table.json describing the key schema and indexes of each table
+	TableDefinitions string            `yaml:"tableDefinitions" env:"TABLE_DEFINITIONS_PATH"`
+	OperationTimeout time.Duration     `yaml:"operationTimeout" env:"DB_OPERATION_TIMEOUT"`
+	Batch            BatchSettings     `yaml:"batch"`
+	Retry            RetrySettings     `yaml:"retry"`
+	Migrations       MigrationSettings `yaml:"migrations"`
+}
+
+// BatchSettings configures coalescing event writes into BatchWriteItem calls
+type BatchSettings struct {
+	Enabled        bool          `yaml:"enabled" env:"DYNAMODB_BATCH_WRITES"`
+	Size           int           `yaml:"size" env:"DYNAMODB_BATCH_SIZE"`
+	Linger         time.Duration `yaml:"linger" env:"DYNAMODB_BATCH_LINGER"`
+	MaxRetries     int           `yaml:"maxRetries" env:"DYNAMODB_BATCH_MAX_RETRIES"`
+	InitialBackoff time.Duration `yaml:"initialBackoff" env:"DYNAMODB_BATCH_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff" env:"DYNAMODB_BATCH_MAX_BACKOFF"`
+}
+
+// RetrySettings configures retries and the circuit breaker around database operations
+type RetrySettings struct {
+	MaxAttempts     int           `yaml:"maxAttempts" env:"DB_RETRY_MAX_ATTEMPTS"`
+	InitialBackoff  time.Duration `yaml:"initialBackoff" env:"DB_RETRY_INITIAL_BACKOFF"`
+	MaxBackoff      time.Duration `yaml:"maxBackoff" env:"DB_RETRY_MAX_BACKOFF"`
+	BreakerFailures int           `yaml:"breakerFailures" env:"DB_BREAKER_FAILURES"`
+	BreakerCooldown time.Duration `yaml:"breakerCooldown" env:"DB_BREAKER_COOLDOWN"`
+}
+
+// MigrationSettings configures how existing tables are brought in line with the table definitions at start.
+// Mode is off, apply, or plan, which logs the changes and exits without serving. Indexes are only deleted
+// with DeleteIndexes.
+type MigrationSettings struct {
+	Mode          string        `yaml:"mode" env:"DYNAMODB_MIGRATIONS"`
+	DeleteIndexes bool          `yaml:"deleteIndexes" env:"DYNAMODB_MIGRATIONS_DELETE_INDEXES"`
+	PollInterval  time.Duration `yaml:"pollInterval" env:"DYNAMODB_MIGRATION_POLL_INTERVAL"`
+	Timeout       time.Duration `yaml:"timeout" env:"DYNAMODB_MIGRATION_TIMEOUT"`
+}
+
+// EventsConfig configures how webhook events are accepted and routed
+type EventsConfig struct {
+	BulkPolicy       string            `yaml:"bulkPolicy" env:"BULK_POLICY"`
+	CloudEventTypes  map[string]string `yaml:"cloudEventTypes" env:"CLOUDEVENTS_TYPE_MAP"`
+	RoutesConfig     string            `yaml:"routesConfig" env:"ROUTES_CONFIG"`
+	DynamicTypesPath string            `yaml:"dynamicTypesPath" env:"DYNAMIC_TYPES_PATH"`
+	MaxBodyBytes     int64             `yaml:"maxBodyBytes" env:"MAX_BODY_BYTES"`
+}
+
+// IngestConfig configures asynchronous ingestion
+type IngestConfig struct {
+	Mode           string        `yaml:"mode" env:"INGEST_MODE"`
+	QueueSize      int           `yaml:"queueSize" env:"INGEST_QUEUE_SIZE"`
+	Workers        int           `yaml:"workers" env:"INGEST_WORKERS"`
+	WALPath        string        `yaml:"walPath" env:"INGEST_WAL_PATH"`
+	DeadLetterPath string        `yaml:"deadLetterPath" env:"INGEST_DEAD_LETTER_PATH"`
+	MaxRetries     int           `yaml:"maxRetries" env:"INGEST_MAX_RETRIES"`
+	InitialBackoff time.Duration `yaml:"initialBackoff" env:"INGEST_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff" env:"INGEST_MAX_BACKOFF"`
+}
+
+// AuthConfig configures API key authentication
+type AuthConfig struct {
+	Enabled      bool   `yaml:"enabled" env:"AUTH_ENABLED"`
+	APIKeysTable string `yaml:"apiKeysTable" env:"API_KEYS_TABLE"`
+	AdminAPIKey  string `yaml:"adminApiKey" env:"ADMIN_API_KEY" secret:"true"`
+	// AuditLogPath is the JSON lines file the audit trail is appended to; empty writes it to stdout
+	AuditLogPath string `yaml:"auditLogPath" env:"AUTH_AUDIT_LOG"`
+}
+
+// TLSSettings configures HTTPS and client certificate verification
+type TLSSettings struct {
+	Enabled      bool   `yaml:"enabled" env:"TLS_ENABLED"`
+	MinVersion   string `yaml:"minVersion" env:"TLS_MIN_VERSION"`
+	CertFile     string `yaml:"certFile" env:"TLS_CERT_FILE"`
+	KeyFile      string `yaml:"keyFile" env:"TLS_KEY_FILE"`
+	DevCertDir   string `yaml:"devCertDir" env:"TLS_DEV_CERT_DIR"`
+	ClientCAFile string `yaml:"clientCAFile" env:"TLS_CLIENT_CA_FILE"`
+	ClientAuth   string `yaml:"clientAuth" env:"TLS_CLIENT_AUTH"`
+}
+
+// RateLimitConfig holds limits written as rate or rate:burst; unset limits leave their scope unlimited
+type RateLimitConfig struct {
+	Global    string            `yaml:"global" env:"RATE_LIMIT_GLOBAL"`
+	Merchant  string            `yaml:"merchant" env:"RATE_LIMIT_MERCHANT"`
+	Merchants map[string]string `yaml:"merchants" env:"RATE_LIMIT_MERCHANTS"`
+	// Known lists merchants with a bucket of their own besides those with an override
+	Known []string `yaml:"known" env:"RATE_LIMIT_KNOWN_MERCHANTS"`
+}
+
+// BinsConfig configures the retention of bins
+type BinsConfig struct {
+	DefaultTTL time.Duration `yaml:"defaultTTL" env:"BIN_DEFAULT_TTL"`
+	MaxTTL     time.Duration `yaml:"maxTTL" env:"BIN_MAX_TTL"`
+}
+
+// ChaosConfig configures fault injection into database operations
+type ChaosConfig struct {
+	Enabled    bool   `yaml:"enabled" env:"CHAOS_ENABLED"`
+	ConfigPath string `yaml:"configPath" env:"CHAOS_CONFIG"`
+}
+
+// ReadinessConfig configures the /ready checks
+type ReadinessConfig struct {
+	StartupGracePeriod time.Duration `yaml:"startupGracePeriod" env:"READY_STARTUP_GRACE_PERIOD"`
+	RefreshInterval    time.Duration `yaml:"refreshInterval" env:"READY_REFRESH_INTERVAL"`
+}
+
+// MetricsConfig configures the Prometheus metrics
+type MetricsConfig struct {
+	// Merchants are labelled by name in the metrics; every other merchant is labelled other
+	Merchants []string `yaml:"merchants" env:"METRICS_MERCHANTS"`
+}
+
+// DefaultConfig returns the configuration used for settings that are not set anywhere
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:              "8080",
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		DynamoDB: DynamoDBConfig{
+			TableDefinitions: "persistent/table.json",
+			OperationTimeout: 5 * time.Second,
+			Batch: BatchSettings{
+				Size:           25,
+				Linger:         10 * time.Millisecond,
+				MaxRetries:     8,
+				InitialBackoff: 50 * time.Millisecond,
+				MaxBackoff:     5 * time.Second,
+			},
+			Retry: RetrySettings{
+				MaxAttempts:     3,
+				InitialBackoff:  50 * time.Millisecond,
+				MaxBackoff:      time.Second,
+				BreakerFailures: 5,
+				BreakerCooldown: 10 * time.Second,
+			},
+			Migrations: MigrationSettings{
+				Mode:         "off",
+				PollInterval: 5 * time.Second,
+				Timeout:      30 * time.Minute,
+			},
+		},
+		Events: EventsConfig{
+			BulkPolicy:       string(handler.BulkPartial),
+			DynamicTypesPath: "data/event-types.json",
+			MaxBodyBytes:     5 << 20,
+		},
+		Ingest: IngestConfig{
+			Mode:           "sync",
+			QueueSize:      1000,
+			Workers:        4,
+			WALPath:        "data/ingest.wal",
+			DeadLetterPath: "data/ingest-dead-letter.jsonl",
+			MaxRetries:     8,
+			InitialBackoff: 100 * time.Millisecond,
+			MaxBackoff:     10 * time.Second,
+		},
+		Auth: AuthConfig{APIKeysTable: "ApiKeys"},
+		TLS:  TLSSettings{MinVersion: "1.2", DevCertDir: "data/tls", ClientAuth: "optional"},
+		Bins: BinsConfig{DefaultTTL: 24 * time.Hour, MaxTTL: 7 * 24 * time.Hour},
+		Readiness: ReadinessConfig{
+			StartupGracePeriod: 30 * time.Second,
+			RefreshInterval:    10 * time.Second,
+		},
+	}
+}
+
+// configField is a setting of the Config struct
+type configField struct {
+	// path is the setting's location in the config file, such as dynamodb.batch.size
+	path   string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+// flagName is the command-line flag setting the field
+func (f configField) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+}
+
+// fields lists the settings of a config struct, walking nested sections
+func fields(v reflect.Value, prefix string) []configField {
+	var result []configField
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			result = append(result, fields(v.Field(i), name)...)
+			continue
+		}
+		result = append(result, configField{path: name, env: field.Tag.Get("env"), secret: field.Tag.Get("secret") == "true", value: v.Field(i)})
+	}
+	return result
+}
+
+// set parses a value from the environment or a flag into the field
+func (f configField) set(value string) error {
+	switch target := f.value.Addr().Interface().(type) {
+	case *string:
+		*target = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*target = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*target = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*target = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, expected a value such as 500ms or 5s", value)
+		}
+		*target = d
+	case *[]string:
+		*target = parseList(value)
+	case *map[string]string:
+		m, err := parseMap(value)
+		if err != nil {
+			return err
+		}
+		*target = m
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+// parseList parses a comma-separated list such as "a,b"
+func parseList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// parseMap parses comma-separated key=value pairs such as "a=b,c=d"
+func parseMap(value string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
+
+// LoadConfig builds the configuration from the defaults, the config file, the environment and the
+// command-line arguments, in that order of precedence, and validates it
+func LoadConfig(args []string) (*Config, error) {
+	config := DefaultConfig()
+	settings := fields(reflect.ValueOf(&config).Elem(), "")
+
+	// Flags are parsed first to find the config file, but applied last
+	flags := flag.NewFlagSet("webhook_test_server", flag.ContinueOnError)
+	configFile := flags.String("config", "", "YAML config file (CONFIG_FILE)")
+	envFile := flags.String("env-file", ".env", "file of environment variables that are not already set")
+	plan := flags.Bool("plan", false, "log the table migrations and exit without applying them (DYNAMODB_MIGRATIONS=plan)")
+	flagValues := make(map[string]string)
+	for _, setting := range settings {
+		env := setting.env
+		flags.Func(setting.flagName(), fmt.Sprintf("%s (%s)", setting.path, env), func(value string) error {
+			flagValues[env] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if *plan {
+		flagValues["DYNAMODB_MIGRATIONS"] = "plan"
+	}
+
+	// A missing .env is expected, for example in the Docker image, where variables come from the environment
+	if err := godotenv.Load(*envFile); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load %s: %w", *envFile, err)
+		}
+		log.Printf("No %s file found, using the environment only", *envFile)
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, setting := range settings {
+		if value := os.Getenv(setting.env); value != "" {
+			if err := setting.set(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", setting.env, err)
+			}
+		}
+	}
+	for _, setting := range settings {
+		if value, ok := flagValues[setting.env]; ok {
+			if err := setting.set(value); err != nil {
+				return nil, fmt.Errorf("-%s: %w", setting.flagName(), err)
+			}
+		}
+	}
+	return &config, config.Validate()
+}
+
+// Validate checks the configuration, reporting every invalid setting by its environment variable
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "SERVER_PORT: %q is not a valid port", c.Server.Port)
+	check(c.Server.MaxHeaderBytes > 0, "SERVER_MAX_HEADER_BYTES: must be positive")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT: must be positive")
+
+	err = c.DynamoDB.Connection().Validate()
+	check(err == nil, "DYNAMODB_CREDENTIALS_MODE: %v", err)
+	tables := c.Tables()
+	check(len(tables.Roles()) > 0, "DYNAMODB_ORDER_TABLE_NAME, DYNAMODB_PRODUCT_TABLE_NAME or DYNAMODB_TABLES: at least one table name is required")
+	// A table is created and migrated from the definition of a single role
+	roleOf := make(map[string]string)
+	for _, role := range tables.Roles() {
+		other, shared := roleOf[tables[role]]
+		check(!shared, "DYNAMODB_TABLES: the %s and %s roles both use table %s, each role needs its own table", other, role, tables[role])
+		roleOf[tables[role]] = role
+	}
+	definitions, err := persistent.LoadTableDefinitions(c.DynamoDB.TableDefinitions)
+	check(err == nil, "TABLE_DEFINITIONS_PATH: %v", err)
+	if err == nil {
+		for _, role := range tables.Roles() {
+			_, ok := definitions.Definition(role)
+			check(ok, "DYNAMODB_TABLES: the %s table has no definition in %s", role, c.DynamoDB.TableDefinitions)
+		}
+	}
+	check(c.DynamoDB.Batch.Size >= 1 && c.DynamoDB.Batch.Size <= 25, "DYNAMODB_BATCH_SIZE: %d is not between 1 and 25", c.DynamoDB.Batch.Size)
+	check(c.DynamoDB.Retry.MaxAttempts >= 1, "DB_RETRY_MAX_ATTEMPTS: must be at least 1")
+	check(c.DynamoDB.Retry.BreakerFailures >= 0, "DB_BREAKER_FAILURES: cannot be negative")
+	switch c.DynamoDB.Migrations.Mode {
+	case "apply", "plan", "off":
+	default:
+		check(false, "DYNAMODB_MIGRATIONS: %q is not off, apply or plan", c.DynamoDB.Migrations.Mode)
+	}
+	check(c.DynamoDB.Migrations.PollInterval > 0 && c.DynamoDB.Migrations.Timeout > 0, "DYNAMODB_MIGRATION_POLL_INTERVAL and DYNAMODB_MIGRATION_TIMEOUT: must be positive")
+
+	_, err = handler.ParseBulkPolicy(c.Events.BulkPolicy)
+	check(err == nil, "BULK_POLICY: %v", err)
+	check(c.Events.MaxBodyBytes > 0, "MAX_BODY_BYTES: must be positive")
+
+	check(c.Ingest.Mode == "sync" || c.Ingest.Mode == "async", "INGEST_MODE: %q is not sync or async", c.Ingest.Mode)
+	check(c.Ingest.QueueSize > 0 && c.Ingest.Workers > 0, "INGEST_QUEUE_SIZE and INGEST_WORKERS: must be positive")
+
+	check(!c.Auth.Enabled || c.Auth.APIKeysTable != "", "API_KEYS_TABLE: required when AUTH_ENABLED is true")
+
+	_, err = parseTLSVersion(c.TLS.MinVersion)
+	check(err == nil, "TLS_MIN_VERSION: %v", err)
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE: must be set together")
+	check(c.TLS.ClientAuth == "optional" || c.TLS.ClientAuth == "require", "TLS_CLIENT_AUTH: %q is not optional or require", c.TLS.ClientAuth)
+	// Client certificates are only verified against TLS_CLIENT_CA_FILE, so require would otherwise be ignored
+	check(c.TLS.ClientAuth != "require" || c.TLS.ClientCAFile != "", "TLS_CLIENT_AUTH: require needs TLS_CLIENT_CA_FILE")
+
+	_, err = c.RateLimits.Limits()
+	check(err == nil, "%v", err)
+
+	check(c.Bins.DefaultTTL > 0 && c.Bins.DefaultTTL <= c.Bins.MaxTTL, "BIN_DEFAULT_TTL: must be positive and not above BIN_MAX_TTL")
+
+	for _, setting := range fields(reflect.ValueOf(c).Elem(), "") {
+		if d, ok := setting.value.Interface().(time.Duration); ok {
+			check(d >= 0, "%s: cannot be negative", setting.env)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Connection returns the DynamoDB connection settings
+func (c DynamoDBConfig) Connection() persistent.ConnectionConfig {
+	return persistent.ConnectionConfig{
+		Mode:                 c.CredentialsMode,
+		Region:               c.Region,
+		Endpoint:             c.Endpoint,
+		Profile:              c.Profile,
+		RoleARN:              c.RoleARN,
+		WebIdentityTokenFile: c.WebIdentityTokenFile,
+		RoleSessionName:      c.RoleSessionName,
+		AccessKeyID:          c.AccessKeyID,
+		SecretAccessKey:      c.SecretAccessKey,
+		SessionToken:         c.SessionToken,
+	}
+}
+
+// Tables returns the configured event tables by role
+func (c *Config) Tables() persistent.Tables {
+	tables := make(persistent.Tables, len(c.DynamoDB.Tables)+2)
+	for role, tableName := range c.DynamoDB.Tables {
+		tables[role] = tableName
+	}
+	if c.DynamoDB.OrderTable != "" {
+		tables[persistent.RoleOrders] = c.DynamoDB.OrderTable
+	}
+	if c.DynamoDB.ProductTable != "" {
+		tables[persistent.RoleProducts] = c.DynamoDB.ProductTable
+	}
+	return tables
+}
+
+// Limits parses the configured rate limits
+func (c RateLimitConfig) Limits() (ratelimit.Config, error) {
+	config := ratelimit.Config{Known: c.Known}
+	var err error
+	if c.Global != "" {
+		if config.Global, err = ratelimit.ParseLimit(c.Global); err != nil {
+			return config, fmt.Errorf("RATE_LIMIT_GLOBAL: %w", err)
+		}
+	}
+	if c.Merchant != "" {
+		if config.Merchant, err = ratelimit.ParseLimit(c.Merchant); err != nil {
+			return config, fmt.Errorf("RATE_LIMIT_MERCHANT: %w", err)
+		}
+	}
+	for merchant, value := range c.Merchants {
+		limit, err := ratelimit.ParseLimit(value)
+		if err != nil {
+			return config, fmt.Errorf("RATE_LIMIT_MERCHANTS: %s: %w", merchant, err)
+		}
+		if config.Merchants == nil {
+			config.Merchants = make(map[string]ratelimit.Limit)
+		}
+		config.Merchants[merchant] = limit
+	}
+	return config, nil
+}
+
+// Redacted returns the configuration as nested maps keyed like the config file, with durations written
+// as strings and secrets replaced, for GET /admin/config
+func (c *Config) Redacted() map[string]interface{} {
+	view := make(map[string]interface{})
+	for _, setting := range fields(reflect.ValueOf(c).Elem(), "") {
+		var value interface{} = setting.value.Interface()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if setting.secret && v != "" {
+				value = "REDACTED"
+			}
+		}
+		section := view
+		keys := strings.Split(setting.path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			if _, ok := section[key]; !ok {
+				section[key] = make(map[string]interface{})
+			}
+			section = section[key].(map[string]interface{})
+		}
+		section[keys[len(keys)-1]] = value
+	}
+	return view
+}
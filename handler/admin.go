@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RoutesHandler lists the installed event routes
+func (h *WebhookHandler) RoutesHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET requests are accepted.")
+	}
+	writeJSON(w, http.StatusOK, RouteConfig{Routes: h.Routes()})
+	return nil
+}
+
+// ReloadRoutesHandler reloads the routing config without a restart
+func (h *WebhookHandler) ReloadRoutesHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only POST requests are accepted.")
+	}
+	if err := h.ReloadRoutes(); err != nil {
+		return NewAPIError(http.StatusUnprocessableEntity, err, "Failed to reload routing config, the current routes are unchanged")
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Routes reloaded", "routes": len(h.Routes())})
+	return nil
+}
+
+// WithConfigView sets the redacted configuration served by GET /admin/config
+func WithConfigView(view interface{}) Option {
+	return func(h *WebhookHandler) {
+		h.configView = view
+	}
+}
+
+// ConfigHandler returns the configuration the server started with, with secrets redacted
+func (h *WebhookHandler) ConfigHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET requests are accepted.")
+	}
+	if h.configView == nil {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("no configuration view"), "The configuration is not available")
+	}
+	writeJSON(w, http.StatusOK, h.configView)
+	return nil
+}
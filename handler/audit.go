@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditAccess    = "access"
+	AuditCreateKey = "create-key"
+	AuditRevokeKey = "revoke-key"
+)
+
+// AuditRecord is one entry of the audit trail: an access decision or a change to the API keys
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Decision is allowed, forbidden or unauthenticated for access records
+	Decision string `json:"decision,omitempty"`
+	KeyID    string `json:"keyId,omitempty"`
+	KeyName  string `json:"keyName,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Merchant string `json:"merchant,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	// Subject is the ID of the API key created or revoked
+	Subject string `json:"subject,omitempty"`
+}
+
+// AuditSink receives the audit trail
+type AuditSink interface {
+	Audit(record AuditRecord)
+}
+
+// JSONAuditSink writes audit records as JSON lines
+type JSONAuditSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewJSONAuditSink writes audit records to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// OpenAuditLog appends audit records to the file at path, or writes them to stdout when path is empty
+func OpenAuditLog(path string) (*JSONAuditSink, error) {
+	if path == "" {
+		return NewJSONAuditSink(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &JSONAuditSink{w: f, closer: f}, nil
+}
+
+// Audit writes a record; a record that cannot be written is reported in the log
+func (s *JSONAuditSink) Audit(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+// Close closes the audit log file, if the sink writes to one
+func (s *JSONAuditSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closer.Close()
+}
+
+// WithAuditSink sends the audit trail of API key authentication to sink instead of stdout
+func WithAuditSink(sink AuditSink) Option {
+	return func(h *WebhookHandler) {
+		h.audit = sink
+	}
+}
@@ -0,0 +1,328 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+)
+
+// APIKeyHeader is an alternative to the Authorization: Bearer header for presenting an API key
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyCacheTTL bounds how long a verified key is trusted without re-reading it, so revocations apply quickly
+const apiKeyCacheTTL = 30 * time.Second
+
+// unknownAPIKeyCacheTTL bounds how long an unknown key ID is remembered, so repeated bad keys do not each
+// read the table while keys created on other replicas are still accepted soon
+const unknownAPIKeyCacheTTL = 5 * time.Second
+
+// maxUnknownAPIKeys bounds the cache against requests presenting many different bad keys
+const maxUnknownAPIKeys = 10000
+
+// apiKeyAuth verifies API keys against the hashed keys stored in a table
+type apiKeyAuth struct {
+	tableName string
+	// bootstrap is an admin key configured at start, used to create the first stored keys
+	bootstrap *model.APIKey
+	mu        sync.Mutex
+	cache     map[string]apiKeyCacheEntry
+}
+
+// apiKeyCacheEntry is a loaded key, or an unknown key ID when key is nil
+type apiKeyCacheEntry struct {
+	key       *model.APIKey
+	fetchedAt time.Time
+}
+
+// fresh reports whether the entry can still be served
+func (e apiKeyCacheEntry) fresh() bool {
+	ttl := apiKeyCacheTTL
+	if e.key == nil {
+		ttl = unknownAPIKeyCacheTTL
+	}
+	return time.Since(e.fetchedAt) <= ttl
+}
+
+type apiKeyContextKey struct{}
+
+// merchantSource returns the merchant a request acts on, or "" when it is not merchant specific
+type merchantSource func(r *http.Request) string
+
+// WithAPIKeys requires an API key on every route except health checks and metrics. Keys are stored hashed in
+// tableName; bootstrapKey, when set, is accepted as an admin key without being stored.
+func WithAPIKeys(tableName, bootstrapKey string) Option {
+	return func(h *WebhookHandler) {
+		h.auth = &apiKeyAuth{tableName: tableName, cache: make(map[string]apiKeyCacheEntry)}
+		if bootstrapKey != "" {
+			h.auth.bootstrap = &model.APIKey{ID: "bootstrap", Name: "bootstrap", KeyHash: hashAPIKey(bootstrapKey), Roles: []string{model.RoleAdmin}}
+		}
+	}
+}
+
+// Authorize wraps a handler so it only runs for API keys holding the role and, when merchant is set,
+// allowed the merchant the request acts on. It is a no-op unless API keys are enabled.
+func (h *WebhookHandler) Authorize(role string, merchant merchantSource, next APIfunc) APIfunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if h.auth == nil {
+			return next(w, r)
+		}
+		var requested string
+		if merchant != nil {
+			requested = merchant(r)
+		}
+
+		key, err := h.authenticate(r)
+		if err != nil {
+			h.auditAccess(r, nil, role, requested, "unauthenticated")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="webhook"`)
+			return err
+		}
+		if !key.HasRole(role) {
+			h.auditAccess(r, key, role, requested, "forbidden")
+			return NewAPIError(http.StatusForbidden, fmt.Errorf("API key %s does not have the %s role", key.ID, role), "API key is not allowed to access this endpoint")
+		}
+		if requested != "" && !key.AllowsMerchant(requested) {
+			h.auditAccess(r, key, role, requested, "forbidden")
+			return NewAPIError(http.StatusForbidden, fmt.Errorf("API key %s is not allowed merchant %s", key.ID, requested), "API key is not allowed to access this merchant")
+		}
+		h.auditAccess(r, key, role, requested, "allowed")
+		return next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// authenticate returns the API key presented with the request, or a 401 APIError
+func (h *WebhookHandler) authenticate(r *http.Request) (*model.APIKey, error) {
+	presented := r.Header.Get(APIKeyHeader)
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		presented = strings.TrimSpace(bearer)
+	}
+	if presented == "" {
+		return nil, NewAPIError(http.StatusUnauthorized, fmt.Errorf("missing API key"), "An API key is required")
+	}
+
+	hash := hashAPIKey(presented)
+	if bootstrap := h.auth.bootstrap; bootstrap != nil && subtle.ConstantTimeCompare([]byte(hash), []byte(bootstrap.KeyHash)) == 1 {
+		return bootstrap, nil
+	}
+	key, err := h.loadAPIKey(r.Context(), hash[:16])
+	if err != nil {
+		return nil, NewAPIError(http.StatusInternalServerError, err, "Failed to verify API key")
+	}
+	if key == nil || subtle.ConstantTimeCompare([]byte(hash), []byte(key.KeyHash)) != 1 {
+		return nil, NewAPIError(http.StatusUnauthorized, fmt.Errorf("invalid API key"), "The API key is not valid")
+	}
+	return key, nil
+}
+
+// loadAPIKey returns a stored key by ID, or nil for an unknown ID. Keys are served from memory for
+// apiKeyCacheTTL and unknown IDs for unknownAPIKeyCacheTTL.
+func (h *WebhookHandler) loadAPIKey(ctx context.Context, id string) (*model.APIKey, error) {
+	h.auth.mu.Lock()
+	entry, ok := h.auth.cache[id]
+	h.auth.mu.Unlock()
+	if ok && entry.fresh() {
+		return entry.key, nil
+	}
+
+	dbCtx, cancel := h.dbContext(ctx)
+	defer cancel()
+	key, err := h.db.GetAPIKey(dbCtx, h.auth.tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	h.auth.mu.Lock()
+	defer h.auth.mu.Unlock()
+	if key == nil && !h.auth.roomForUnknown() {
+		return nil, nil
+	}
+	h.auth.cache[id] = apiKeyCacheEntry{key: key, fetchedAt: time.Now()}
+	return key, nil
+}
+
+// roomForUnknown drops expired entries once the cache holds maxUnknownAPIKeys and reports whether another
+// unknown key ID may be cached. The caller holds mu.
+func (a *apiKeyAuth) roomForUnknown() bool {
+	if len(a.cache) < maxUnknownAPIKeys {
+		return true
+	}
+	for id, entry := range a.cache {
+		if !entry.fresh() {
+			delete(a.cache, id)
+		}
+	}
+	return len(a.cache) < maxUnknownAPIKeys
+}
+
+// requestAPIKey returns the API key a request was authorized with, or nil when API keys are disabled
+func requestAPIKey(ctx context.Context) *model.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*model.APIKey)
+	return key
+}
+
+// auditAccess records an access decision in the audit trail
+func (h *WebhookHandler) auditAccess(r *http.Request, key *model.APIKey, role, merchant, decision string) {
+	record := AuditRecord{
+		Time:     time.Now().UTC(),
+		Action:   AuditAccess,
+		Decision: decision,
+		Role:     role,
+		Merchant: merchant,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Remote:   r.RemoteAddr,
+	}
+	if key != nil {
+		record.KeyID, record.KeyName = key.ID, key.Name
+	}
+	h.audit.Audit(record)
+	metrics.AuthDecision(role, decision)
+}
+
+// auditKeyChange records the creation or revocation of an API key in the audit trail
+func (h *WebhookHandler) auditKeyChange(r *http.Request, action string, subject model.APIKey) {
+	record := AuditRecord{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		KeyName: subject.Name,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Remote:  r.RemoteAddr,
+		Subject: subject.ID,
+	}
+	if key := requestAPIKey(r.Context()); key != nil {
+		record.KeyID = key.ID
+	}
+	h.audit.Audit(record)
+}
+
+// hashAPIKey returns the hex SHA-256 of a key; the first 16 characters are the key ID
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// webhookMerchant is the merchant of a webhook delivered to /{merchantId}
+func webhookMerchant(r *http.Request) string {
+	merchant, _ := extractMerchantId(r.URL.Path)
+	return merchant
+}
+
+// binMerchant is the merchant of a webhook delivered to /b/{binId}/{merchantId}
+func binMerchant(r *http.Request) string {
+	if matches := binPathPattern.FindStringSubmatch(r.URL.Path); matches != nil {
+		return matches[2]
+	}
+	return ""
+}
+
+// queryMerchant is the merchant named by the merchantId query parameter
+func queryMerchant(r *http.Request) string {
+	return r.URL.Query().Get("merchantId")
+}
+
+// apiKeyRequest is the body of POST /admin/api-keys
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+	Merchants []string `json:"merchants"`
+}
+
+// createdAPIKey is returned once when a key is created; the key cannot be retrieved again
+type createdAPIKey struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+// APIKeysHandler manages API keys: GET lists them, POST creates one and DELETE ?id= revokes one
+func (h *WebhookHandler) APIKeysHandler(w http.ResponseWriter, r *http.Request) error {
+	if h.auth == nil {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("API keys are not enabled"), "API keys are not enabled")
+	}
+	ctx, cancel := h.dbContext(r.Context())
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := h.db.ListAPIKeys(ctx, h.auth.tableName)
+		if err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to list API keys")
+		}
+		if keys == nil {
+			keys = []model.APIKey{}
+		}
+		writeJSON(w, http.StatusOK, keys)
+		return nil
+
+	case http.MethodPost:
+		var request apiKeyRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Failed to decode API key definition")
+		}
+		if len(request.Roles) == 0 {
+			return NewAPIError(http.StatusBadRequest, fmt.Errorf("roles are required"), "Invalid API key definition")
+		}
+		for _, role := range request.Roles {
+			if role != model.RoleIngest && role != model.RoleRead && role != model.RoleAdmin {
+				return NewAPIError(http.StatusBadRequest, fmt.Errorf("unknown role %q, expected ingest, read or admin", role), "Invalid API key definition")
+			}
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to generate API key")
+		}
+		plain := "whk_" + binIDEncoding.EncodeToString(secret)
+		hash := hashAPIKey(plain)
+		key := model.APIKey{
+			ID:        hash[:16],
+			Name:      request.Name,
+			KeyHash:   hash,
+			Roles:     request.Roles,
+			Merchants: request.Merchants,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := h.db.StoreAPIKey(ctx, h.auth.tableName, key); err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to store API key")
+		}
+		// Drop a cached miss for the new ID so the key works at once on this replica
+		h.auth.mu.Lock()
+		delete(h.auth.cache, key.ID)
+		h.auth.mu.Unlock()
+		h.auditKeyChange(r, AuditCreateKey, key)
+		writeJSON(w, http.StatusCreated, createdAPIKey{APIKey: key, Key: plain})
+		return nil
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		key, err := h.db.GetAPIKey(ctx, h.auth.tableName, id)
+		if err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to load API key")
+		}
+		if key == nil {
+			return NewAPIError(http.StatusNotFound, fmt.Errorf("API key %q not found", id), "API key not found")
+		}
+		if err := h.db.DeleteAPIKey(ctx, h.auth.tableName, id); err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to revoke API key")
+		}
+		h.auth.mu.Lock()
+		delete(h.auth.cache, id)
+		h.auth.mu.Unlock()
+		h.auditKeyChange(r, AuditRevokeKey, *key)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET, POST and DELETE requests are accepted.")
+}
@@ -0,0 +1,116 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestAPIKeyAuth checks that routes require a key with the right role and merchant
+func TestAPIKeyAuth(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	var stored model.APIKey
+	db.On("StoreAPIKey", "ApiKeys", mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(1).(model.APIKey)
+	}).Return(nil)
+	db.On("GetAPIKey", "ApiKeys", mock.Anything).Return(&stored, nil)
+	db.On("QueryEvents", "EventWebhook", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Limit: 100}).Return(model.EventPage{Events: []model.StoredEvent{
+		{PK: "#PK#BIGW#ORDER-1", SK: "#SK#1"},
+	}}, nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithAPIKeys("ApiKeys", "bootstrap-secret"))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	serve := func(method, target, key string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/live", "", nil).Code)
+	w := serve("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	w = serve("POST", "/admin/api-keys", "bootstrap-secret", bytes.NewBufferString(`{"name":"reader","roles":["read"],"merchants":["BIGW"]}`))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, created.ID, stored.ID)
+	assert.NotContains(t, w.Body.String(), stored.KeyHash)
+	assert.NotEqual(t, created.Key, stored.KeyHash)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/order?merchantId=OTHER&externalOrderId=ORDER-1", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", "/admin/routes", created.Key, nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/BIGW", created.Key, bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "auth-1"))).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1", created.Key+"x", nil).Code)
+}
+
+// auditLog collects the audit trail
+type auditLog struct {
+	mu      sync.Mutex
+	records []handler.AuditRecord
+}
+
+func (a *auditLog) Audit(record handler.AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, record)
+}
+
+// TestAPIKeyAuditAndUnknownKeys checks that decisions and key changes reach the audit sink and that an
+// unknown key is only looked up once in a short while
+func TestAPIKeyAuditAndUnknownKeys(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("GetAPIKey", "ApiKeys", mock.Anything).Return(nil, nil)
+	db.On("StoreAPIKey", "ApiKeys", mock.Anything).Return(nil)
+	audit := new(auditLog)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"},
+		handler.WithAPIKeys("ApiKeys", "bootstrap-secret"), handler.WithAuditSink(audit))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	serve := func(method, target, key string, body io.Reader) int {
+		req := httptest.NewRequest(method, target, body)
+		req.Header.Set(handler.APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1", "unknown", nil))
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1", "unknown", nil))
+	db.AssertNumberOfCalls(t, "GetAPIKey", 1)
+
+	assert.Equal(t, http.StatusCreated, serve("POST", "/admin/api-keys", "bootstrap-secret", bytes.NewBufferString(`{"name":"ci","roles":["ingest"]}`)))
+	if assert.Len(t, audit.records, 4) {
+		assert.Equal(t, handler.AuditAccess, audit.records[0].Action)
+		assert.Equal(t, "unauthenticated", audit.records[0].Decision)
+		assert.Equal(t, "BIGW", audit.records[0].Merchant)
+		assert.Equal(t, "allowed", audit.records[2].Decision)
+		assert.Equal(t, "bootstrap", audit.records[2].KeyID)
+		assert.Equal(t, handler.AuditCreateKey, audit.records[3].Action)
+		assert.Equal(t, "ci", audit.records[3].KeyName)
+		assert.NotEmpty(t, audit.records[3].Subject)
+	}
+}
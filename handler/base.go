@@ -1,30 +1,171 @@
 package handler
 
-import "webhook_test_server/persistent"
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"webhook_test_server/chaos"
+	"webhook_test_server/ingest"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/ratelimit"
+	"webhook_test_server/resilience"
+	"webhook_test_server/tracing"
+)
+
+// eventHandler decodes and validates an event body and returns the write that persists it.
+// opts carries metadata stored with the event, such as its CloudEvents context.
+type eventHandler func(ctx context.Context, marketplace string, body []byte, opts model.EventOptions) (storeFunc, error)
+
+// storeFunc persists a validated event
+type storeFunc func(ctx context.Context) error
 
 type WebhookHandler struct {
-	db            persistent.DatabaseInterface
-	tableNames    []string
-	eventHandlers map[string]func(string, []byte) error
+	db         persistent.DatabaseInterface
+	tables     persistent.Tables
+	routesPath string
+	routes     atomic.Pointer[routeTable]
+	dynamic    dynamicTypes
+	dbTimeout  time.Duration
+	queue      *ingest.Queue
+	bulkPolicy BulkPolicy
+	// cloudEventTypes maps CloudEvents types onto routed event types
+	cloudEventTypes map[string]string
+	draining        atomic.Bool
+	readiness       readiness
+	bins            binCache
+	binTTL          time.Duration
+	binMaxTTL       time.Duration
+	// auth verifies API keys; nil leaves every route open
+	auth *apiKeyAuth
+	// audit receives the access decisions and API key changes made while auth is enabled
+	audit   AuditSink
+	limiter *ratelimit.Limiter
+	// maxBodyBytes limits webhook bodies as received and once decoded
+	maxBodyBytes int64
+	// faults controls the faults injected into db, when it is wrapped for fault injection
+	faults *chaos.Database
+	// breaker guards db and is reported by /dbhealth
+	breaker *resilience.Breaker
+	// configView is the redacted configuration served by /admin/config
+	configView interface{}
+}
+
+// Option configures optional WebhookHandler behaviour
+type Option func(*WebhookHandler)
+
+// WithDBTimeout sets the deadline applied to each database operation made while handling a request.
+// A zero or negative timeout leaves operations bounded only by the request context.
+func WithDBTimeout(timeout time.Duration) Option {
+	return func(h *WebhookHandler) {
+		h.dbTimeout = timeout
+	}
+}
+
+// WithCircuitBreaker reports the breaker guarding the handler's database on /dbhealth
+func WithCircuitBreaker(breaker *resilience.Breaker) Option {
+	return func(h *WebhookHandler) {
+		h.breaker = breaker
+	}
 }
 
-func NewWebhookHandler(db persistent.DatabaseInterface, tableNames []string) *WebhookHandler {
+// WithQueue enables asynchronous ingestion: validated events are queued and acknowledged
+// with 202, and the queue's workers persist them through ProcessJob.
+func WithQueue(queue *ingest.Queue) Option {
+	return func(h *WebhookHandler) {
+		h.queue = queue
+	}
+}
+
+func NewWebhookHandler(db persistent.DatabaseInterface, tables persistent.Tables, opts ...Option) *WebhookHandler {
 	handler := &WebhookHandler{
-		db:            db,
-		tableNames:    tableNames,
-		eventHandlers: make(map[string]func(string, []byte) error),
+		db:         db,
+		tables:     tables,
+		bulkPolicy: BulkPartial,
+		binTTL:     24 * time.Hour,
+		binMaxTTL:  7 * 24 * time.Hour,
+		readiness: readiness{
+			startedAt:       time.Now(),
+			refreshInterval: 10 * time.Second,
+		},
+	}
+	for _, opt := range opts {
+		opt(handler)
+	}
+	if handler.audit == nil {
+		handler.audit = NewJSONAuditSink(os.Stdout)
 	}
 	handler.registerEventHandlers()
+	handler.loadDynamicTypes()
 	return handler
 }
 
-// registerEventHandlers registers all event handlers
+// StartDraining marks the server as shutting down so /ready stops reporting ready
+func (h *WebhookHandler) StartDraining() {
+	h.draining.Store(true)
+}
+
+// ProcessJob persists an event accepted in async mode; it is run by the ingest workers
+func (h *WebhookHandler) ProcessJob(ctx context.Context, job ingest.Job) (err error) {
+	ctx, span := tracer.Start(ctx, "process "+job.Type)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	handler, found := h.eventHandler(job.Type)
+	if !found {
+		return fmt.Errorf("unhandled event type: %s", job.Type)
+	}
+	if job.Bin != nil {
+		ctx = persistent.WithBin(ctx, *job.Bin)
+	}
+	store, err := handler(ctx, job.Merchant, job.Body, model.EventOptions{CloudEvent: job.CloudEvent, Delivery: job.Delivery})
+	if err != nil {
+		return err
+	}
+
+	dbCtx, cancel := h.dbContext(ctx)
+	defer cancel()
+	return store(dbCtx)
+}
+
+// Drain waits for queued events to be persisted; it is a no-op unless async ingestion is enabled
+func (h *WebhookHandler) Drain(ctx context.Context) error {
+	if h.queue == nil {
+		return nil
+	}
+	return h.queue.Shutdown(ctx)
+}
+
+// table returns the table of a role, or a 404 APIError for a route that is disabled because the role has no table
+func (h *WebhookHandler) table(role string) (string, error) {
+	tableName, ok := h.tables.Name(role)
+	if !ok {
+		return "", NewAPIError(http.StatusNotFound, fmt.Errorf("no %s table is configured", role), fmt.Sprintf("Not available: no %s table is configured", role))
+	}
+	return tableName, nil
+}
+
+// dbContext derives the context for a single database operation from the request context
+func (h *WebhookHandler) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.dbTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, h.dbTimeout)
+}
+
+// registerEventHandlers installs the routes from the routing config file, or the built-in routes when none is set
 func (h *WebhookHandler) registerEventHandlers() {
-	h.eventHandlers["order/created"] = h.OrderCreatedEventHandle
-	h.eventHandlers["order/creation-failed"] = h.OrderCreationFailedEventHandle
-	h.eventHandlers["order-line/cancelled"] = h.OrderLineCancelledEventHandle
-	h.eventHandlers["order-line/refunded"] = h.OrderLineRefundedEventHandle
-	h.eventHandlers["order-line/shipped"] = h.OrderLineShippedEventHandle
-	h.eventHandlers["order-line/shipping-deleted"] = h.OrderLineShippingDeletedEventHandle
-	h.eventHandlers["variant/stock-updated"] = h.HandleVariantStockUpdated
-}
\ No newline at end of file
+	if err := h.ReloadRoutes(); err != nil {
+		log.Printf("Failed to load routing config %s, using the built-in routes: %v", h.routesPath, err)
+		config, err := LoadRoutes("")
+		if err != nil {
+			// The built-in routes are embedded at build time, so this is a programming error
+			panic(fmt.Sprintf("invalid built-in routes: %v", err))
+		}
+		h.installRoutes(config)
+	}
+}
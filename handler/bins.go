@@ -0,0 +1,436 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a delivery to a bin with a secret, as sha256=<hex>
+const SignatureHeader = "X-Webhook-Signature"
+
+// binCacheTTL bounds how long a bin definition is served from memory, so deletions on other replicas apply quickly
+const binCacheTTL = 30 * time.Second
+
+// maxResponseDelay caps the delay of a response rule
+const maxResponseDelay = 30 * time.Second
+
+var (
+	binPathPattern = regexp.MustCompile(`^/b/([a-z0-9]+)/([A-Za-z0-9_]+)$`)
+	binIDPattern   = regexp.MustCompile(`^/bins/([a-z0-9]+)$`)
+	binIDEncoding  = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// binCache holds recently loaded bin definitions so deliveries do not read the bin on every request
+type binCache struct {
+	mu      sync.Mutex
+	entries map[string]binCacheEntry
+}
+
+type binCacheEntry struct {
+	bin       *model.Bin
+	fetchedAt time.Time
+}
+
+func (c *binCache) get(id string) (*model.Bin, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || time.Since(entry.fetchedAt) > binCacheTTL {
+		return nil, false
+	}
+	return entry.bin, true
+}
+
+func (c *binCache) put(bin *model.Bin) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]binCacheEntry)
+	}
+	c.entries[bin.ID] = binCacheEntry{bin: bin, fetchedAt: time.Now()}
+}
+
+func (c *binCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// WithBinTTL sets the lifetime of bins created without a ttl and the longest lifetime a bin may request
+func WithBinTTL(defaultTTL, maxTTL time.Duration) Option {
+	return func(h *WebhookHandler) {
+		h.binTTL = defaultTTL
+		h.binMaxTTL = maxTTL
+	}
+}
+
+// binRequest is the body of POST /bins; every field is optional
+type binRequest struct {
+	Name string `json:"name"`
+	// TTL is how long the bin accepts deliveries, as a Go duration such as "24h"
+	TTL string `json:"ttl"`
+	// Retention is how long received events are kept, defaulting to the TTL
+	Retention     string               `json:"retention"`
+	Secret        string               `json:"secret"`
+	ResponseRules []model.ResponseRule `json:"responseRules"`
+}
+
+// binResponse describes a bin without its secret, along with the URL deliveries are sent to
+type binResponse struct {
+	model.Bin
+	HasSecret bool   `json:"hasSecret"`
+	URL       string `json:"url"`
+}
+
+func newBinResponse(bin model.Bin) binResponse {
+	response := binResponse{Bin: bin, HasSecret: bin.Secret != "", URL: "/b/" + bin.ID + "/{merchantId}"}
+	response.Secret = ""
+	return response
+}
+
+// CreateBinHandler creates a bin and returns the URL its deliveries are sent to
+func (h *WebhookHandler) CreateBinHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only POST requests are accepted.")
+	}
+
+	var request binRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return NewAPIError(http.StatusBadRequest, err, "Failed to decode bin definition")
+	}
+	bin, err := h.newBin(request)
+	if err != nil {
+		return NewAPIError(http.StatusBadRequest, err, "Invalid bin definition")
+	}
+	// The bin belongs to the creating key and is limited to the merchants the key may reach
+	if key := requestAPIKey(r.Context()); key != nil {
+		bin.Owner = key.ID
+		bin.Merchants = key.Merchants
+	}
+	// Bins are stored with the order events
+	tableName, err := h.table(persistent.RoleOrders)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := h.dbContext(r.Context())
+	defer cancel()
+	if err := h.db.CreateBin(ctx, tableName, *bin); err != nil {
+		if errors.Is(err, persistent.ErrBinExists) {
+			return NewAPIError(http.StatusConflict, err, "Bin ID collision, retry the request")
+		}
+		return NewAPIError(http.StatusInternalServerError, err, "Failed to create bin")
+	}
+	h.bins.put(bin)
+	log.Printf("Created bin %s expiring at %s", bin.ID, bin.ExpiresAt.Format(time.RFC3339))
+
+	writeJSON(w, http.StatusCreated, newBinResponse(*bin))
+	return nil
+}
+
+// newBin validates a bin request and fills in its defaults
+func (h *WebhookHandler) newBin(request binRequest) (*model.Bin, error) {
+	ttl := h.binTTL
+	if request.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.TTL); err != nil {
+			return nil, fmt.Errorf("invalid ttl: %w", err)
+		}
+	}
+	if ttl <= 0 || ttl > h.binMaxTTL {
+		return nil, fmt.Errorf("ttl must be positive and at most %s", h.binMaxTTL)
+	}
+	retention := ttl
+	if request.Retention != "" {
+		var err error
+		if retention, err = time.ParseDuration(request.Retention); err != nil {
+			return nil, fmt.Errorf("invalid retention: %w", err)
+		}
+	}
+	if retention < time.Second || retention > h.binMaxTTL {
+		return nil, fmt.Errorf("retention must be at least 1s and at most %s", h.binMaxTTL)
+	}
+	for i, rule := range request.ResponseRules {
+		if rule.Status < 100 || rule.Status > 599 {
+			return nil, fmt.Errorf("response rule %d has invalid status %d", i, rule.Status)
+		}
+		if rule.DelayMs < 0 || time.Duration(rule.DelayMs)*time.Millisecond > maxResponseDelay {
+			return nil, fmt.Errorf("response rule %d delay must be between 0 and %s", i, maxResponseDelay)
+		}
+	}
+
+	id := make([]byte, 10)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &model.Bin{
+		ID:               binIDEncoding.EncodeToString(id),
+		Name:             request.Name,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(ttl),
+		RetentionSeconds: int64(retention / time.Second),
+		Secret:           request.Secret,
+		ResponseRules:    request.ResponseRules,
+	}, nil
+}
+
+// BinHandler returns a bin with GET /bins/{binId} and expires it with DELETE. Only the key that created
+// the bin and admin keys may do either.
+func (h *WebhookHandler) BinHandler(w http.ResponseWriter, r *http.Request) error {
+	matches := binIDPattern.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("invalid bin path: %s", r.URL.Path), "Bin not found")
+	}
+	id := matches[1]
+
+	switch r.Method {
+	case http.MethodGet:
+		bin, err := h.ownedBin(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if err := checkBinLive(bin); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, newBinResponse(*bin))
+		return nil
+
+	case http.MethodDelete:
+		// An expired bin can still be deleted, which also removes its definition from the table
+		if _, err := h.ownedBin(r.Context(), id); err != nil {
+			return err
+		}
+		tableName, err := h.table(persistent.RoleOrders)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := h.dbContext(r.Context())
+		defer cancel()
+		if err := h.db.DeleteBin(ctx, tableName, id); err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to delete bin")
+		}
+		h.bins.remove(id)
+		log.Printf("Expired bin %s", id)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET and DELETE requests are accepted.")
+}
+
+// BinWebhookHandler receives a delivery at /b/{binId}/{merchantId} and processes it like a regular
+// webhook, scoped to the bin. A matching response rule replaces the regular response.
+func (h *WebhookHandler) BinWebhookHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only POST requests are accepted.")
+	}
+	matches := binPathPattern.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		return NewAPIError(http.StatusBadRequest, fmt.Errorf("invalid bin URL path: %s", r.URL.Path), "Invalid bin or merchant ID format.")
+	}
+	binID, merchant := matches[1], matches[2]
+
+	bin, err := h.lookupBin(r.Context(), binID)
+	if err != nil {
+		return err
+	}
+	if !bin.AllowsMerchant(merchant) {
+		return NewAPIError(http.StatusForbidden, fmt.Errorf("bin %s does not accept merchant %s", bin.ID, merchant), "Bin does not accept this merchant")
+	}
+
+	if err := checkContentType(r); err != nil {
+		return err
+	}
+	raw, body, err := h.readBody(w, r)
+	if err != nil {
+		return err
+	}
+	// The signature covers the body as sent, before any Content-Encoding is decoded
+	if bin.Secret != "" && !validSignature(bin.Secret, raw, r.Header.Get(SignatureHeader)) {
+		return NewAPIError(http.StatusUnauthorized, fmt.Errorf("missing or invalid %s header", SignatureHeader), "Invalid webhook signature")
+	}
+
+	// The delivery is handed to the regular webhook handler as if it were sent to /{merchantId}
+	scoped := r.Clone(persistent.WithBin(r.Context(), bin.Scope()))
+	scoped.URL.Path = "/" + merchant
+	scoped.Body = io.NopCloser(bytes.NewReader(raw))
+
+	rule := matchResponseRule(bin.ResponseRules, deliveryEventType(r.Header, body))
+	if rule == nil {
+		return h.WebhookEvents(w, scoped)
+	}
+
+	// The event is still processed, but the sender sees the rule's response
+	if err := h.WebhookEvents(&discardWriter{header: make(http.Header)}, scoped); err != nil {
+		log.Printf("Bin %s delivery answered by a response rule failed: %v", bin.ID, err)
+	}
+	if rule.DelayMs > 0 {
+		select {
+		case <-time.After(time.Duration(rule.DelayMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+	for name, value := range rule.Headers {
+		w.Header().Set(name, value)
+	}
+	if len(rule.Body) > 0 && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(rule.Status)
+	w.Write(rule.Body)
+	return nil
+}
+
+// lookupBin returns a live bin, or a 404 or 410 APIError
+func (h *WebhookHandler) lookupBin(ctx context.Context, id string) (*model.Bin, error) {
+	bin, err := h.loadBin(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBinLive(bin); err != nil {
+		return nil, err
+	}
+	return bin, nil
+}
+
+// ownedBin returns a bin the request's API key owns, live or expired. Bins of other keys are reported
+// as not found, so their IDs cannot be probed.
+func (h *WebhookHandler) ownedBin(ctx context.Context, id string) (*model.Bin, error) {
+	bin, err := h.loadBin(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if key := requestAPIKey(ctx); !bin.OwnedBy(key) {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Errorf("bin %s is not owned by API key %s", id, key.ID), "Bin not found")
+	}
+	return bin, nil
+}
+
+// loadBin returns a bin, live or expired, or a 404 APIError
+func (h *WebhookHandler) loadBin(ctx context.Context, id string) (*model.Bin, error) {
+	if bin, cached := h.bins.get(id); cached {
+		return bin, nil
+	}
+	tableName, err := h.table(persistent.RoleOrders)
+	if err != nil {
+		return nil, err
+	}
+	dbCtx, cancel := h.dbContext(ctx)
+	defer cancel()
+	bin, err := h.db.GetBin(dbCtx, tableName, id)
+	if err != nil {
+		return nil, NewAPIError(http.StatusInternalServerError, err, "Failed to load bin")
+	}
+	if bin == nil {
+		return nil, NewAPIError(http.StatusNotFound, fmt.Errorf("bin %s not found", id), "Bin not found")
+	}
+	h.bins.put(bin)
+	return bin, nil
+}
+
+// checkBinLive returns a 410 APIError once a bin has expired
+func checkBinLive(bin *model.Bin) error {
+	if bin.Expired(time.Now()) {
+		return NewAPIError(http.StatusGone, fmt.Errorf("bin %s expired at %s", bin.ID, bin.ExpiresAt.Format(time.RFC3339)), "Bin has expired")
+	}
+	return nil
+}
+
+// queryContext scopes a query to the bin named by the bin parameter, if any. The bin must be live and
+// owned by the request's API key.
+func (h *WebhookHandler) queryContext(r *http.Request) (context.Context, error) {
+	id := r.URL.Query().Get("bin")
+	if id == "" {
+		return r.Context(), nil
+	}
+	bin, err := h.ownedBin(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBinLive(bin); err != nil {
+		return nil, err
+	}
+	return persistent.WithBin(r.Context(), bin.Scope()), nil
+}
+
+// checkKeyParams rejects query parameters naming bin keys, which would otherwise let an unscoped query
+// read a bin's events by their prefixed keys
+func checkKeyParams(r *http.Request, names ...string) error {
+	for _, name := range names {
+		if value := r.URL.Query().Get(name); persistent.IsBinKey(value) {
+			return NewAPIError(http.StatusBadRequest, fmt.Errorf("%s %q uses the reserved %s prefix", name, value, persistent.BinKeyPrefix), fmt.Sprintf("Invalid %s parameter", name))
+		}
+	}
+	return nil
+}
+
+// jobBin returns the bin an accepted event belongs to, for persistence by the ingest workers
+func jobBin(ctx context.Context) *model.BinScope {
+	if scope, ok := persistent.BinFromContext(ctx); ok {
+		return &scope
+	}
+	return nil
+}
+
+// validSignature checks a sha256=<hex> HMAC of the body
+func validSignature(secret string, body []byte, signature string) bool {
+	digest, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(digest, mac.Sum(nil))
+}
+
+// deliveryEventType returns the $type of a single event body, or the ce-type of a binary CloudEvent
+func deliveryEventType(header http.Header, body []byte) string {
+	if ceType := header.Get("Ce-Type"); ceType != "" {
+		return ceType
+	}
+	var event model.EventTypeHolder
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ""
+	}
+	return event.Type
+}
+
+// matchResponseRule returns the first rule matching the event type
+func matchResponseRule(rules []model.ResponseRule, eventType string) *model.ResponseRule {
+	for i, rule := range rules {
+		if rule.EventType == "" || rule.EventType == eventType {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// discardWriter swallows the regular response of a delivery answered by a response rule
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
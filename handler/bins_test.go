@@ -0,0 +1,148 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// binDB records the bin each event is stored in
+type binDB struct {
+	persistenttest.MockDB
+	mu     sync.Mutex
+	scopes []model.BinScope
+}
+
+func (b *binDB) StoreEvent(ctx context.Context, tableName string, record persistent.EventRecord, opts model.EventOptions) error {
+	scope, _ := persistent.BinFromContext(ctx)
+	b.mu.Lock()
+	b.scopes = append(b.scopes, scope)
+	b.mu.Unlock()
+	return b.MockDB.StoreEvent(ctx, tableName, record, opts)
+}
+
+// TestBins checks that a bin verifies signatures, applies its response rules and scopes storage and queries
+func TestBins(t *testing.T) {
+	db := new(binDB)
+	db.On("CreateBin", "EventWebhook", mock.Anything).Return(nil)
+	db.On("StoreEvent", "EventWebhook", persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "bin-order-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{}).Return(nil)
+	db.On("GetBin", "EventWebhook", "missing").Return(nil, nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	req := httptest.NewRequest("POST", "/bins", bytes.NewBufferString(`{"name":"test","ttl":"1h","secret":"s3cret","responseRules":[{"eventType":"order-line/shipping-deleted","status":503,"body":{"retry":true},"headers":{"Retry-After":"7"}}]}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID        string `json:"id"`
+		Secret    string `json:"secret"`
+		HasSecret bool   `json:"hasSecret"`
+		URL       string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, created.HasSecret)
+	assert.Empty(t, created.Secret)
+	assert.Equal(t, "/b/"+created.ID+"/{merchantId}", created.URL)
+
+	body := persistenttest.ShippingDeletedEvent(t, "bin-order-1")
+	binURL := "/b/" + created.ID + "/BIGW"
+
+	// Unsigned deliveries are rejected
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", binURL, bytes.NewReader(body)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	req = httptest.NewRequest("POST", binURL, bytes.NewReader(body))
+	req.Header.Set(handler.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "7", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"retry":true}`, w.Body.String())
+	db.AssertNumberOfCalls(t, "StoreEvent", 1)
+	if assert.Len(t, db.scopes, 1) {
+		assert.Equal(t, created.ID, db.scopes[0].ID)
+		assert.Equal(t, time.Hour, db.scopes[0].Retention)
+	}
+
+	// Queries naming an unknown bin are not served from the unscoped events
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/externalOrderId?externalOrderId=bin-order-1&bin=missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	db.AssertNotCalled(t, "QueryEvents", mock.Anything, mock.Anything)
+}
+
+// TestBinOwnership checks that only the key that created a bin may read, query or delete it, that the bin
+// only takes deliveries for the key's merchants, that expired
+// bins can still be deleted and that unscoped queries cannot name bin keys
+func TestBinOwnership(t *testing.T) {
+	apiKey := func(secret string) *model.APIKey {
+		sum := sha256.Sum256([]byte(secret))
+		hash := hex.EncodeToString(sum[:])
+		return &model.APIKey{ID: hash[:16], KeyHash: hash, Roles: []string{model.RoleIngest, model.RoleRead}}
+	}
+	owner, other := apiKey("owner-secret"), apiKey("other-secret")
+	owner.Merchants = []string{"BIGW"}
+	expired := &model.Bin{ID: "expired", ExpiresAt: time.Now().Add(-time.Minute), Owner: owner.ID}
+
+	db := new(persistenttest.MockDB)
+	db.On("GetAPIKey", "ApiKeys", owner.ID).Return(owner, nil)
+	db.On("GetAPIKey", "ApiKeys", other.ID).Return(other, nil)
+	db.On("CreateBin", "EventWebhook", mock.Anything).Return(nil)
+	db.On("GetBin", "EventWebhook", "expired").Return(expired, nil)
+	db.On("DeleteBin", "EventWebhook", "expired").Return(nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithAPIKeys("ApiKeys", ""))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	serve := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(handler.APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("POST", "/bins", "owner-secret")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created model.Bin
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, owner.ID, created.Owner)
+	assert.Equal(t, []string{"BIGW"}, created.Merchants)
+
+	// The bin only takes deliveries for the merchants of the key that created it
+	assert.Equal(t, http.StatusForbidden, serve("POST", "/b/"+created.ID+"/OTHER", "other-secret").Code)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/bins/"+created.ID, "owner-secret").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/bins/"+created.ID, "other-secret").Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", "/bins/"+created.ID, "other-secret").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/externalOrderId?externalOrderId=ORDER-1&bin="+created.ID, "other-secret").Code)
+
+	assert.Equal(t, http.StatusGone, serve("GET", "/bins/expired", "owner-secret").Code)
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", "/bins/expired", "owner-secret").Code)
+
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "/externalOrderId?externalOrderId=BIN%23"+created.ID+"%23ORDER-1", "owner-secret").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "/order?merchantId=BIN%23"+created.ID+"%23BIGW&externalOrderId=ORDER-1", "other-secret").Code)
+	db.AssertNotCalled(t, "DeleteBin", "EventWebhook", created.ID)
+	db.AssertNotCalled(t, "QueryEvents", mock.Anything, mock.Anything)
+}
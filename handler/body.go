@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultMaxBodyBytes limits webhook bodies when WithMaxBodyBytes is not set
+const defaultMaxBodyBytes = 5 << 20
+
+// errBodyTooLarge is returned when a decoded body exceeds the size limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// WithMaxBodyBytes limits webhook bodies, both as received and once decoded; larger bodies are rejected with 413
+func WithMaxBodyBytes(limit int64) Option {
+	return func(h *WebhookHandler) {
+		h.maxBodyBytes = limit
+	}
+}
+
+// checkContentType rejects webhook bodies that are not JSON with 415. A missing Content-Type is taken as JSON.
+func checkContentType(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && isJSONMediaType(mediaType) {
+		return nil
+	}
+	return NewAPIError(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Type %q", contentType),
+		"Only JSON bodies are accepted: application/json, application/*+json or NDJSON.")
+}
+
+// isJSONMediaType reports whether a media type holds JSON, NDJSON or a JSON-based format such as CloudEvents
+func isJSONMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// readBody reads a webhook body within the size limit and decodes its Content-Encoding.
+// It returns the body as received and the decoded body, or an APIError with 413 or 415.
+func (h *WebhookHandler) readBody(w http.ResponseWriter, r *http.Request) (raw, body []byte, err error) {
+	limit := h.maxBodyBytes
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	defer r.Body.Close()
+
+	raw, err = io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, nil, NewAPIError(http.StatusRequestEntityTooLarge, err, fmt.Sprintf("The request body exceeds %d bytes.", limit))
+	}
+	if err != nil {
+		return nil, nil, NewAPIError(http.StatusInternalServerError, err, "Error reading request body")
+	}
+
+	body, err = decodeContentEncoding(raw, r.Header.Get("Content-Encoding"), limit)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return nil, nil, NewAPIError(http.StatusRequestEntityTooLarge, err, fmt.Sprintf("The decoded request body exceeds %d bytes.", limit))
+	case err != nil:
+		return nil, nil, NewAPIError(http.StatusUnsupportedMediaType, err, "Unsupported or invalid Content-Encoding")
+	}
+	return raw, body, nil
+}
+
+// decodeContentEncoding undoes the codings listed in a Content-Encoding header, in reverse order of
+// application. The decoded body may not exceed limit bytes, which guards against compression bombs.
+func decodeContentEncoding(raw []byte, contentEncoding string, limit int64) ([]byte, error) {
+	codings := strings.Split(contentEncoding, ",")
+	body := raw
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		var reader io.Reader
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("invalid gzip body: %w", err)
+			}
+			reader = gz
+		case "deflate":
+			// HTTP deflate is zlib-wrapped, but some senders send raw DEFLATE
+			buffered := bufio.NewReader(bytes.NewReader(body))
+			if header, err := buffered.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+				zr, err := zlib.NewReader(buffered)
+				if err != nil {
+					return nil, fmt.Errorf("invalid deflate body: %w", err)
+				}
+				reader = zr
+			} else {
+				reader = flate.NewReader(buffered)
+			}
+		case "br":
+			reader = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q, expected gzip, deflate or br", coding)
+		}
+
+		decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s body: %w", coding, err)
+		}
+		if int64(len(decoded)) > limit {
+			return nil, errBodyTooLarge
+		}
+		body = decoded
+	}
+	return body, nil
+}
@@ -0,0 +1,66 @@
+package handler_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestCompressedBodies checks that gzip and brotli bodies are decoded and their sizes recorded, and that
+// oversized and non-JSON bodies are rejected
+func TestCompressedBodies(t *testing.T) {
+	event := persistenttest.ShippingDeletedEvent(t, "compressed-1")
+	var gzipped, brotlied bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(event)
+	gz.Close()
+	br := brotli.NewWriter(&brotlied)
+	br.Write(event)
+	br.Close()
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		limit      int64
+		wantStatus int
+	}{
+		{name: "gzip", encoding: "gzip", body: gzipped.Bytes(), wantStatus: http.StatusOK},
+		{name: "brotli", encoding: "br", body: brotlied.Bytes(), wantStatus: http.StatusOK},
+		{name: "unknown encoding", encoding: "zstd", body: gzipped.Bytes(), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "decoded body over the limit", encoding: "gzip", body: gzipped.Bytes(), limit: int64(gzipped.Len()) + 1, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "body over the limit", body: event, limit: 16, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := new(persistenttest.MockDB)
+			delivery := &model.Delivery{ContentEncoding: tt.encoding, CompressedBytes: int64(len(tt.body)), BodyBytes: int64(len(event))}
+			db.On("StoreEvent", "EventWebhook", persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "compressed-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{Delivery: delivery}).Return(nil)
+			h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithMaxBodyBytes(tt.limit))
+
+			w := deliver(h, tt.body, "Content-Type", "application/json", "Content-Encoding", tt.encoding)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusOK {
+				db.AssertExpectations(t)
+			} else {
+				db.AssertNotCalled(t, "StoreEvent", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+
+	t.Run("non-JSON content type", func(t *testing.T) {
+		db := new(persistenttest.MockDB)
+		h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+		assert.Equal(t, http.StatusUnsupportedMediaType, deliver(h, event, "Content-Type", "text/plain").Code)
+	})
+}
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"webhook_test_server/ingest"
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+	"webhook_test_server/resilience"
+	"webhook_test_server/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BulkPolicy decides what happens to a bulk request when some of its events are rejected
+type BulkPolicy string
+
+const (
+	// BulkPartial stores every valid event and reports the rejected ones
+	BulkPartial BulkPolicy = "partial"
+	// BulkAllOrNothing stores nothing unless every event in the request is valid. It is not a transaction:
+	// events are validated up front, but a write that fails does not undo the events already stored.
+	BulkAllOrNothing BulkPolicy = "all-or-nothing"
+)
+
+// maxBulkConcurrency bounds the number of events of one bulk request stored at the same time
+const maxBulkConcurrency = 25
+
+// WithBulkPolicy sets the policy applied to JSON array and NDJSON requests
+func WithBulkPolicy(policy BulkPolicy) Option {
+	return func(h *WebhookHandler) {
+		h.bulkPolicy = policy
+	}
+}
+
+// ParseBulkPolicy parses a policy name such as "partial" or "all-or-nothing"
+func ParseBulkPolicy(name string) (BulkPolicy, error) {
+	switch policy := BulkPolicy(name); policy {
+	case BulkPartial, BulkAllOrNothing:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown bulk policy %q, expected %q or %q", name, BulkPartial, BulkAllOrNothing)
+}
+
+// bulkItemResult is the outcome of a single event in a bulk request
+type bulkItemResult struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bulkResponse is the JSON body returned for a bulk request
+type bulkResponse struct {
+	Message string           `json:"message"`
+	Policy  BulkPolicy       `json:"policy"`
+	Results []bulkItemResult `json:"results"`
+}
+
+// bulkItem is one event of a bulk request
+type bulkItem struct {
+	body json.RawMessage
+	// cloudEvent is the context of an event from a CloudEvents batch
+	cloudEvent *model.CloudEventAttributes
+	// err rejects the event before it is decoded, such as an invalid CloudEvent in a batch
+	err error
+}
+
+// bulkItems wraps the events split from a bulk body
+func bulkItems(bodies []json.RawMessage) []bulkItem {
+	items := make([]bulkItem, len(bodies))
+	for i, body := range bodies {
+		items[i] = bulkItem{body: body}
+	}
+	return items
+}
+
+// splitBulkBody splits a JSON array or a stream of JSON values, such as NDJSON, into its events.
+// bulk is false for a body holding a single JSON value, which is handled as a single event.
+func splitBulkBody(body []byte, contentType string) (items []json.RawMessage, bulk bool, err error) {
+	trimmed := bytes.TrimSpace(body)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "application/x-ndjson" || mediaType == "application/ndjson" || mediaType == "application/jsonl":
+		return splitJSONStream(trimmed), true, nil
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, true, err
+		}
+		return items, true, nil
+	}
+
+	// A stream sent without an NDJSON content type holds more than one top-level value
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	var first json.RawMessage
+	if err := decoder.Decode(&first); err != nil || !decoder.More() {
+		return nil, false, nil
+	}
+	return splitJSONStream(trimmed), true, nil
+}
+
+// splitJSONStream returns the top-level JSON values of a body, whether they are one per line, pretty-printed
+// over several lines or concatenated. A malformed value is returned up to the end of its line, so it only
+// rejects that event and decoding resumes on the next line.
+func splitJSONStream(body []byte) []json.RawMessage {
+	var items []json.RawMessage
+	for rest := bytes.TrimSpace(body); len(rest) > 0; rest = bytes.TrimSpace(rest) {
+		stream := rest
+		decoder := json.NewDecoder(bytes.NewReader(stream))
+		for decoder.More() {
+			var item json.RawMessage
+			if err := decoder.Decode(&item); err != nil {
+				break
+			}
+			items = append(items, item)
+			rest = stream[decoder.InputOffset():]
+		}
+		// Whatever the decoder stopped at is malformed
+		if rest = bytes.TrimSpace(rest); len(rest) > 0 {
+			line, next, _ := bytes.Cut(rest, []byte("\n"))
+			items = append(items, json.RawMessage(bytes.TrimSpace(line)))
+			rest = next
+		}
+	}
+	return items
+}
+
+// bulkEvents dispatches every event of a bulk request through its route and writes a per-event result list.
+// opts holds the delivery details shared by every event of the request.
+// Events are validated before any of them is stored, so under BulkAllOrNothing a single invalid
+// event rejects the request without writing anything.
+func (h *WebhookHandler) bulkEvents(ctx context.Context, w http.ResponseWriter, marketplace string, items []bulkItem, opts model.EventOptions) (err error) {
+	ctx, span := tracer.Start(ctx, "bulk")
+	defer func() { tracing.EndSpan(span, err) }()
+	span.SetAttributes(
+		attribute.String("webhook.merchant", marketplace),
+		attribute.Int("webhook.bulk_size", len(items)),
+		attribute.String("webhook.bulk_policy", string(h.bulkPolicy)),
+	)
+
+	if len(items) == 0 {
+		return NewAPIError(http.StatusBadRequest, errors.New("empty bulk request"), "The request contains no events.")
+	}
+
+	// Decode and validate every event
+	results := make([]bulkItemResult, len(items))
+	stores := make([]storeFunc, len(items))
+	rejected := 0
+	for i, item := range items {
+		results[i] = bulkItemResult{Index: i}
+		store, eventType, status, err := h.prepareBulkItem(ctx, marketplace, item, item.options(opts))
+		results[i].Type = eventType
+		if err != nil {
+			results[i].Status = status
+			results[i].Error = err.Error()
+			rejected++
+			continue
+		}
+		stores[i] = store
+	}
+
+	if rejected > 0 && h.bulkPolicy == BulkAllOrNothing {
+		for i, store := range stores {
+			if store != nil {
+				metrics.EventProcessed(marketplace, results[i].Type, metrics.OutcomeRejected)
+				results[i].Status = http.StatusFailedDependency
+				results[i].Error = "not stored because another event in the request was rejected"
+			}
+		}
+		writeJSON(w, http.StatusBadRequest, bulkResponse{
+			Message: fmt.Sprintf("Rejected: %d of %d events are invalid", rejected, len(items)),
+			Policy:  h.bulkPolicy,
+			Results: results,
+		})
+		return nil
+	}
+
+	// Persist the valid events; concurrent writes share batches when batch writes are enabled
+	okStatus := http.StatusOK
+	if h.queue != nil {
+		okStatus = http.StatusAccepted
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxBulkConcurrency)
+	for i, store := range stores {
+		if store == nil {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, store storeFunc) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i].Status, results[i].Error = h.persistBulkItem(ctx, marketplace, results[i].Type, items[i].body, items[i].options(opts), store)
+			outcome := metrics.OutcomeAccepted
+			if results[i].Status != okStatus {
+				outcome = metrics.OutcomeRejected
+			}
+			metrics.EventProcessed(marketplace, results[i].Type, outcome)
+		}(i, store)
+	}
+	wg.Wait()
+
+	failed, retryable := 0, 0
+	for _, result := range results {
+		if result.Status != okStatus {
+			failed++
+		}
+		if result.Status == http.StatusServiceUnavailable {
+			retryable++
+			w.Header().Set("Retry-After", "1")
+		}
+	}
+	status, message := okStatus, "Success"
+	if okStatus == http.StatusAccepted {
+		message = "Accepted"
+	}
+	switch {
+	case failed == len(items) && retryable == failed:
+		// Every event can be sent again later, so the whole request can be retried
+		status, message = http.StatusServiceUnavailable, fmt.Sprintf("Failed: all %d events failed and can be retried", failed)
+	case failed == len(items):
+		status, message = http.StatusInternalServerError, fmt.Sprintf("Failed: all %d events failed", failed)
+	case failed > 0:
+		status, message = http.StatusMultiStatus, fmt.Sprintf("Partial success: %d of %d events failed", failed, len(items))
+	}
+	writeJSON(w, status, bulkResponse{Message: message, Policy: h.bulkPolicy, Results: results})
+	return nil
+}
+
+// prepareBulkItem decodes and validates one event of a bulk request, returning the status to report when it is rejected
+func (h *WebhookHandler) prepareBulkItem(ctx context.Context, marketplace string, item bulkItem, opts model.EventOptions) (storeFunc, string, int, error) {
+	var event model.EventTypeHolder
+	if item.err != nil {
+		metrics.EventReceived(marketplace, "")
+		metrics.EventProcessed(marketplace, "", metrics.OutcomeRejected)
+		return nil, "", http.StatusBadRequest, item.err
+	}
+	if err := decodeEvent(ctx, item.body, &event); err != nil {
+		metrics.EventReceived(marketplace, "")
+		metrics.EventProcessed(marketplace, "", metrics.OutcomeRejected)
+		return nil, "", http.StatusBadRequest, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	handler, found := h.eventHandler(event.Type)
+	if !found {
+		metrics.EventReceived(marketplace, metrics.UnknownEventType)
+		metrics.EventProcessed(marketplace, metrics.UnknownEventType, metrics.OutcomeUnknown)
+		return nil, event.Type, http.StatusBadRequest, fmt.Errorf("unhandled event type: %s", event.Type)
+	}
+	metrics.EventReceived(marketplace, event.Type)
+	store, err := handler(ctx, marketplace, item.body, opts)
+	if err != nil {
+		metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeRejected)
+		return nil, event.Type, http.StatusBadRequest, err
+	}
+	return store, event.Type, 0, nil
+}
+
+// options returns the options of the request with the CloudEvents context of the event
+func (item bulkItem) options(opts model.EventOptions) model.EventOptions {
+	if item.cloudEvent != nil {
+		opts.CloudEvent = item.cloudEvent
+	}
+	return opts
+}
+
+// persistBulkItem stores or, in async mode, queues one validated event
+func (h *WebhookHandler) persistBulkItem(ctx context.Context, marketplace, eventType string, item json.RawMessage, opts model.EventOptions, store storeFunc) (int, string) {
+	if h.queue != nil {
+		err := h.queue.Enqueue(ingest.Job{Merchant: marketplace, Type: eventType, Body: item, ReceivedAt: time.Now(), CloudEvent: opts.CloudEvent, Bin: jobBin(ctx), Delivery: opts.Delivery})
+		switch {
+		case err == nil:
+			return http.StatusAccepted, ""
+		case errors.Is(err, ingest.ErrQueueFull) || errors.Is(err, ingest.ErrQueueClosed):
+			return http.StatusServiceUnavailable, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+
+	storeCtx, cancel := h.dbContext(ctx)
+	defer cancel()
+	if err := store(storeCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return http.StatusGatewayTimeout, err.Error()
+		}
+		if resilience.Retryable(err) {
+			return http.StatusServiceUnavailable, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+	return http.StatusOK, ""
+}
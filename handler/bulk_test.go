@@ -0,0 +1,124 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+	"webhook_test_server/resilience"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// bulkResult mirrors a per-event entry of a bulk webhook response
+type bulkResult struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// bulkResults decodes the per-event results of a bulk webhook response
+func bulkResults(t *testing.T, w *httptest.ResponseRecorder) []bulkResult {
+	t.Helper()
+	var response struct {
+		Results []bulkResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Results
+}
+
+// TestWebhookEventsBulkPartial checks that a JSON array is stored per event and reports the rejected ones
+func TestWebhookEventsBulkPartial(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("StoreEvent", tables[persistent.RoleOrders], mock.AnythingOfType("persistent.EventRecord"), model.EventOptions{}).Return(nil).Twice()
+	h := handler.NewWebhookHandler(db, tables)
+
+	body := fmt.Sprintf(`[%s, {"$type": "order/unknown"}, %s]`, persistenttest.ShippingDeletedEvent(t, "bulk-1"), persistenttest.ShippingDeletedEvent(t, "bulk-2"))
+	w := deliver(h, []byte(body))
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	if results := bulkResults(t, w); assert.Len(t, results, 3) {
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, bulkResult{Index: 1, Type: "order/unknown", Status: http.StatusBadRequest, Error: "unhandled event type: order/unknown"}, results[1])
+		assert.Equal(t, http.StatusOK, results[2].Status)
+	}
+	db.AssertExpectations(t)
+}
+
+// TestWebhookEventsBulkAllFailed checks that a bulk request whose events all failed is retryable only when
+// every failure is
+func TestWebhookEventsBulkAllFailed(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("StoreEvent", tables[persistent.RoleOrders], mock.AnythingOfType("persistent.EventRecord"), model.EventOptions{}).Return(resilience.ErrCircuitOpen)
+	h := handler.NewWebhookHandler(db, tables)
+
+	body := fmt.Sprintf(`[%s, %s]`, persistenttest.ShippingDeletedEvent(t, "bulk-1"), persistenttest.ShippingDeletedEvent(t, "bulk-2"))
+	w := deliver(h, []byte(body))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	if results := bulkResults(t, w); assert.Len(t, results, 2) {
+		assert.Equal(t, http.StatusServiceUnavailable, results[0].Status)
+		assert.Equal(t, http.StatusServiceUnavailable, results[1].Status)
+	}
+
+	// An invalid event cannot be retried, so the request fails outright
+	body = fmt.Sprintf(`[%s, {"$type": "order/unknown"}]`, persistenttest.ShippingDeletedEvent(t, "bulk-3"))
+	w = deliver(h, []byte(body))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	if results := bulkResults(t, w); assert.Len(t, results, 2) {
+		assert.Equal(t, http.StatusServiceUnavailable, results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+	}
+}
+
+// TestWebhookEventsBulkAllOrNothing checks that one invalid NDJSON line rejects the whole request before anything is stored
+func TestWebhookEventsBulkAllOrNothing(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithBulkPolicy(handler.BulkAllOrNothing))
+
+	body := fmt.Sprintf("%s\n{not json}\n%s\n", persistenttest.ShippingDeletedEvent(t, "bulk-1"), persistenttest.ShippingDeletedEvent(t, "bulk-2"))
+	w := deliver(h, []byte(body), "Content-Type", "application/x-ndjson")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	if results := bulkResults(t, w); assert.Len(t, results, 3) {
+		assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+		assert.Equal(t, http.StatusFailedDependency, results[2].Status)
+	}
+	db.AssertNotCalled(t, "StoreEvent")
+}
+
+// TestWebhookEventsBulkStream checks that pretty-printed and concatenated NDJSON values are split into events,
+// and that a malformed line only rejects itself
+func TestWebhookEventsBulkStream(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("StoreEvent", tables[persistent.RoleOrders], mock.AnythingOfType("persistent.EventRecord"), model.EventOptions{}).Return(nil).Times(3)
+	h := handler.NewWebhookHandler(db, tables)
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, persistenttest.ShippingDeletedEvent(t, "bulk-1"), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf("%s\n{not json}\n%s%s\n", pretty.String(), persistenttest.ShippingDeletedEvent(t, "bulk-2"), persistenttest.ShippingDeletedEvent(t, "bulk-3"))
+	w := deliver(h, []byte(body), "Content-Type", "application/x-ndjson")
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	if results := bulkResults(t, w); assert.Len(t, results, 4) {
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+		assert.Equal(t, http.StatusOK, results[2].Status)
+		assert.Equal(t, http.StatusOK, results[3].Status)
+	}
+	db.AssertExpectations(t)
+}
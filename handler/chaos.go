@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"webhook_test_server/chaos"
+)
+
+// WithFaultInjection exposes the faults of a chaos-wrapped database on /admin/chaos.
+// The handler's database should be the same wrapper so the faults apply to its operations.
+func WithFaultInjection(db *chaos.Database) Option {
+	return func(h *WebhookHandler) {
+		h.faults = db
+	}
+}
+
+// chaosResponse is the body of GET /admin/chaos
+type chaosResponse struct {
+	Config chaos.Config                `json:"config"`
+	Stats  map[string]map[string]int64 `json:"stats"`
+}
+
+// ChaosHandler manages fault injection: GET returns the rules and injected fault counts, PUT replaces
+// the rules and DELETE disables fault injection and resets the counts
+func (h *WebhookHandler) ChaosHandler(w http.ResponseWriter, r *http.Request) error {
+	if h.faults == nil {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("fault injection is not enabled"), "Fault injection is not enabled")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, chaosResponse{Config: h.faults.Config(), Stats: h.faults.Stats()})
+		return nil
+
+	case http.MethodPut:
+		var config chaos.Config
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Failed to decode fault config")
+		}
+		if err := config.Validate(); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Invalid fault config")
+		}
+		h.faults.SetConfig(config)
+		writeJSON(w, http.StatusOK, config)
+		return nil
+
+	case http.MethodDelete:
+		h.faults.SetConfig(chaos.Config{})
+		h.faults.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET, PUT and DELETE requests are accepted.")
+}
@@ -0,0 +1,84 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"webhook_test_server/chaos"
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestFaultInjection checks that faults set on /admin/chaos are injected into database operations and counted
+func TestFaultInjection(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("StoreEvent", "EventWebhook", mock.Anything, model.EventOptions{}).Return(nil)
+	faults := chaos.Wrap(db, chaos.Config{})
+	h := handler.NewWebhookHandler(faults, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithFaultInjection(faults))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	configure := func(body string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/chaos", strings.NewReader(body)))
+		return w.Code
+	}
+	deliver := func() int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/BIGW", bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "chaos-1"))))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, configure(`{"enabled": true, "rules": [{"fault": "meteor"}]}`))
+	// A misspelt operation is rejected instead of never matching
+	assert.Equal(t, http.StatusBadRequest, configure(`{"enabled": true, "rules": [{"operation": "FetchByGSI", "fault": "throttle"}]}`))
+
+	// A throttle fault with a count only fails that many calls
+	assert.Equal(t, http.StatusOK, configure(`{"enabled": true, "rules": [{"operation": "StoreEvent", "fault": "throttle", "count": 1}]}`))
+	assert.Equal(t, http.StatusServiceUnavailable, deliver())
+	assert.Equal(t, http.StatusOK, deliver())
+	db.AssertNumberOfCalls(t, "StoreEvent", 1)
+
+	assert.Equal(t, http.StatusOK, configure(`{"enabled": true, "rules": [{"fault": "timeout", "latencyMs": 10}]}`))
+	assert.Equal(t, http.StatusGatewayTimeout, deliver())
+	db.AssertNumberOfCalls(t, "StoreEvent", 1)
+
+	// A partial fault applies the write and then reports it as failed
+	assert.Equal(t, http.StatusOK, configure(`{"enabled": true, "rules": [{"operation": "StoreEvent", "fault": "partial"}]}`))
+	assert.Equal(t, http.StatusServiceUnavailable, deliver())
+	db.AssertNumberOfCalls(t, "StoreEvent", 2)
+
+	// A catch-all rule leaves bin lookups and the health checks alone
+	db.On("GetBin", "EventWebhook", "missing").Return(nil, nil)
+	db.On("DescribeTable", "EventWebhook").Return(nil)
+	assert.Equal(t, http.StatusOK, configure(`{"enabled": true, "rules": [{"fault": "throttle"}]}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/bins/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/dbhealth", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, deliver())
+	db.AssertNumberOfCalls(t, "StoreEvent", 2)
+
+	// Disabling keeps the rules but stops injecting them
+	assert.Equal(t, http.StatusOK, configure(`{"enabled": false, "rules": [{"fault": "throttle"}]}`))
+	assert.Equal(t, http.StatusOK, deliver())
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/chaos", nil))
+	var state struct {
+		Stats map[string]map[string]int64 `json:"stats"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, map[string]int64{chaos.FaultThrottle: 2, chaos.FaultTimeout: 1, chaos.FaultPartial: 1}, state.Stats["StoreEvent"])
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"webhook_test_server/model"
+)
+
+// CloudEvents media types
+const (
+	cloudEventsJSON      = "application/cloudevents+json"
+	cloudEventsBatchJSON = "application/cloudevents-batch+json"
+	cloudEventsVersion   = "1.0"
+)
+
+// WithCloudEventTypes maps CloudEvents types such as "com.example.order.created" onto event
+// types such as "order/created". CloudEvents types without a mapping are dispatched unchanged.
+func WithCloudEventTypes(types map[string]string) Option {
+	return func(h *WebhookHandler) {
+		h.cloudEventTypes = types
+	}
+}
+
+// structuredCloudEvent is a CloudEvent sent in structured content mode
+type structuredCloudEvent struct {
+	model.CloudEventAttributes
+	Data       json.RawMessage `json:"data,omitempty"`
+	DataBase64 string          `json:"data_base64,omitempty"`
+}
+
+// cloudEvent is a stored event re-serialized as a CloudEvent by the query APIs
+type cloudEvent struct {
+	model.CloudEventAttributes
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// parseCloudEvent extracts the CloudEvents context and data from a structured or binary mode request.
+// It returns nil attributes when the request is not a CloudEvent.
+func parseCloudEvent(header http.Header, body []byte) (*model.CloudEventAttributes, []byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	// Structured mode: the context attributes and the data share a JSON envelope
+	if mediaType == cloudEventsJSON {
+		var event structuredCloudEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, nil, fmt.Errorf("invalid structured CloudEvent: %w", err)
+		}
+		data := []byte(event.Data)
+		if event.DataBase64 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(event.DataBase64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid CloudEvent data_base64: %w", err)
+			}
+			data = decoded
+		}
+		return &event.CloudEventAttributes, data, validateCloudEvent(&event.CloudEventAttributes)
+	}
+
+	// Binary mode: the context attributes are ce-* headers and the body is the data
+	if header.Get("ce-specversion") != "" {
+		ce := &model.CloudEventAttributes{
+			SpecVersion:     cloudEventHeader(header, "ce-specversion"),
+			ID:              cloudEventHeader(header, "ce-id"),
+			Source:          cloudEventHeader(header, "ce-source"),
+			Type:            cloudEventHeader(header, "ce-type"),
+			Time:            cloudEventHeader(header, "ce-time"),
+			Subject:         cloudEventHeader(header, "ce-subject"),
+			DataContentType: header.Get("Content-Type"),
+		}
+		return ce, body, validateCloudEvent(ce)
+	}
+
+	return nil, body, nil
+}
+
+// cloudEventBatch converts a CloudEvents batch, a JSON array of structured mode events, into bulk items.
+// An invalid event only rejects itself.
+func (h *WebhookHandler) cloudEventBatch(body []byte) ([]bulkItem, error) {
+	var envelopes []json.RawMessage
+	if err := json.Unmarshal(body, &envelopes); err != nil {
+		return nil, fmt.Errorf("invalid CloudEvents batch: %w", err)
+	}
+	items := make([]bulkItem, len(envelopes))
+	for i, envelope := range envelopes {
+		header := http.Header{"Content-Type": []string{cloudEventsJSON}}
+		ce, data, err := parseCloudEvent(header, envelope)
+		if err == nil {
+			items[i].body, err = h.cloudEventBody(ce, data)
+		}
+		items[i].cloudEvent = ce
+		items[i].err = err
+	}
+	return items, nil
+}
+
+// cloudEventHeader reads a ce-* header, whose value the HTTP binding allows to be percent-encoded
+func cloudEventHeader(header http.Header, name string) string {
+	value := header.Get(name)
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// validateCloudEvent checks the required context attributes and that the data is JSON
+func validateCloudEvent(ce *model.CloudEventAttributes) error {
+	if ce.SpecVersion != cloudEventsVersion {
+		return fmt.Errorf("unsupported CloudEvents specversion %q", ce.SpecVersion)
+	}
+	var missing []string
+	for _, attr := range []struct{ name, value string }{{"id", ce.ID}, {"source", ce.Source}, {"type", ce.Type}} {
+		if attr.value == "" {
+			missing = append(missing, attr.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("CloudEvent is missing required attributes: %s", strings.Join(missing, ", "))
+	}
+	if ce.Time != "" {
+		if _, err := time.Parse(time.RFC3339Nano, ce.Time); err != nil {
+			return fmt.Errorf("invalid CloudEvent time %q: %w", ce.Time, err)
+		}
+	}
+	if ce.DataContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(ce.DataContentType)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return fmt.Errorf("unsupported CloudEvent datacontenttype %q, expected JSON", ce.DataContentType)
+		}
+	}
+	return nil
+}
+
+// cloudEventType maps a CloudEvents type onto a routed event type
+func (h *WebhookHandler) cloudEventType(ceType string) string {
+	if eventType, ok := h.cloudEventTypes[ceType]; ok {
+		return eventType
+	}
+	return ceType
+}
+
+// cloudEventBody converts CloudEvent data into the $type envelope the event handlers decode.
+// The id and time fill in eventId and lastUpdated when the data does not carry them, with the time
+// normalized to UTC like other stored times.
+func (h *WebhookHandler) cloudEventBody(ce *model.CloudEventAttributes, data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, errors.New("CloudEvent data must be a JSON object")
+	}
+
+	set := func(name, value string, overwrite bool) {
+		if _, exists := fields[name]; exists && !overwrite {
+			return
+		}
+		encoded, _ := json.Marshal(value)
+		fields[name] = encoded
+	}
+	set("$type", h.cloudEventType(ce.Type), true)
+	set("eventId", ce.ID, false)
+	if ce.Time != "" {
+		// validateCloudEvent has already parsed the time; stored times are UTC in eventTimeLayout
+		t, _ := time.Parse(time.RFC3339Nano, ce.Time)
+		set("lastUpdated", t.UTC().Format(eventTimeLayout), false)
+	}
+	return json.Marshal(fields)
+}
+
+// wantsCloudEvents reports whether a query asked for events re-serialized as CloudEvents,
+// either with ?format=cloudevents or by accepting application/cloudevents-batch+json
+func wantsCloudEvents(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "cloudevents" || strings.Contains(r.Header.Get("Accept"), cloudEventsBatchJSON)
+}
+
+// writeOrderEvents writes the result of an order event query as JSON or as a CloudEvents batch
+func writeOrderEvents(w http.ResponseWriter, r *http.Request, events []model.StoredEvent) error {
+	if !wantsCloudEvents(r) {
+		writeJSON(w, http.StatusOK, events)
+		return nil
+	}
+
+	batch := make([]cloudEvent, 0, len(events))
+	for _, event := range events {
+		ce, err := orderEventToCloudEvent(event)
+		if err != nil {
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to convert events to CloudEvents")
+		}
+		batch = append(batch, ce)
+	}
+	w.Header().Set("Content-Type", cloudEventsBatchJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(batch); err != nil {
+		log.Printf("Failed to write CloudEvents response: %v", err)
+	}
+	return nil
+}
+
+// orderEventToCloudEvent re-serializes a stored event as a CloudEvent. Events received as CloudEvents
+// keep their original context; others take their id from the payload and their source from the merchant.
+func orderEventToCloudEvent(event model.StoredEvent) (cloudEvent, error) {
+	ce := cloudEvent{Data: json.RawMessage(event.EventData)}
+	if !json.Valid(ce.Data) {
+		ce.Data, _ = json.Marshal(event.EventData)
+	}
+
+	if event.CloudEvent != nil {
+		ce.CloudEventAttributes = *event.CloudEvent
+	} else {
+		var payload model.BaseEvent
+		if err := json.Unmarshal(ce.Data, &payload); err != nil {
+			return cloudEvent{}, fmt.Errorf("stored event %s %s is not a JSON object: %w", event.PK, event.SK, err)
+		}
+		ce.ID = payload.EventId
+		if ce.ID == "" {
+			ce.ID = event.PK + event.SK
+		}
+		if merchant := orderEventMerchant(event); merchant != "" {
+			ce.Source = "/" + merchant
+		}
+		ce.Type = event.EventType
+		ce.Time = event.LastUpdated
+	}
+	ce.SpecVersion = cloudEventsVersion
+	if ce.DataContentType == "" {
+		ce.DataContentType = "application/json"
+	}
+	return ce, nil
+}
+
+// orderEventMerchant returns the merchant of an order event from its key, which has the form #PK#<merchant>#<externalOrderId>
+func orderEventMerchant(event model.StoredEvent) string {
+	if parts := strings.SplitN(event.PK, "#", 4); len(parts) == 4 {
+		return parts[2]
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWebhookEventsCloudEvents checks that structured and binary mode CloudEvents are mapped onto
+// event handlers and stored with their id, source and time
+func TestWebhookEventsCloudEvents(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	h := handler.NewWebhookHandler(db, tables, handler.WithCloudEventTypes(map[string]string{
+		"com.example.order-line.shipping-deleted": "order-line/shipping-deleted",
+	}))
+	data := `{"externalOrderId": "ce-order-1", "externalOrderGroupId": "ce-group-1", "externalOrderLineId": "ce-line-1"}`
+
+	structured := &model.CloudEventAttributes{
+		SpecVersion: "1.0",
+		ID:          "ce-event-1",
+		Source:      "/orders-service",
+		Type:        "com.example.order-line.shipping-deleted",
+		Time:        "2024-05-03T03:48:13.506Z",
+	}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "ce-order-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{CloudEvent: structured}).Return(nil).Once()
+
+	body := fmt.Sprintf(`{"specversion": "1.0", "id": "ce-event-1", "source": "/orders-service", "type": "com.example.order-line.shipping-deleted", "time": "2024-05-03T03:48:13.506Z", "data": %s}`, data)
+	assert.Equal(t, http.StatusOK, deliver(h, []byte(body), "Content-Type", "application/cloudevents+json").Code)
+
+	binary := &model.CloudEventAttributes{
+		SpecVersion:     "1.0",
+		ID:              "ce-event-2",
+		Source:          "/orders-service",
+		Type:            "order-line/shipping-deleted",
+		Time:            "2024-05-04T03:48:13.506Z",
+		DataContentType: "application/json",
+	}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "ce-order-1", "2024-05-04T03:48:13.506Z"), model.EventOptions{CloudEvent: binary}).Return(nil).Once()
+
+	w := deliver(h, []byte(data),
+		"Content-Type", "application/json",
+		"ce-specversion", "1.0",
+		"ce-id", "ce-event-2",
+		"ce-source", "%2Forders-service",
+		"ce-type", "order-line/shipping-deleted",
+		"ce-time", "2024-05-04T03:48:13.506Z")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The time is stored in UTC with millisecond precision, like other stored times
+	offset := &model.CloudEventAttributes{
+		SpecVersion: "1.0",
+		ID:          "ce-event-4",
+		Source:      "/orders-service",
+		Type:        "order-line/shipping-deleted",
+		Time:        "2024-05-04T13:48:13.5+10:00",
+	}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "ce-order-1", "2024-05-04T03:48:13.500Z"), model.EventOptions{CloudEvent: offset}).Return(nil).Once()
+
+	w = deliver(h, []byte(data),
+		"ce-specversion", "1.0",
+		"ce-id", "ce-event-4",
+		"ce-source", "%2Forders-service",
+		"ce-type", "order-line/shipping-deleted",
+		"ce-time", "2024-05-04T13:48:13.5%2B10:00")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// A CloudEvent without a source is rejected
+	w = deliver(h, []byte(data), "ce-specversion", "1.0", "ce-id", "ce-event-3", "ce-type", "order-line/shipping-deleted")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	db.AssertExpectations(t)
+}
+
+// TestWebhookEventsCloudEventsBatch checks that each event of a CloudEvents batch is stored with its own
+// context and that an invalid event only rejects itself
+func TestWebhookEventsCloudEventsBatch(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	h := handler.NewWebhookHandler(db, tables)
+	ce := &model.CloudEventAttributes{
+		SpecVersion: "1.0",
+		ID:          "ce-batch-1",
+		Source:      "/orders-service",
+		Type:        "order-line/shipping-deleted",
+		Time:        "2024-05-03T03:48:13.506Z",
+	}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "ce-order-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{CloudEvent: ce}).Return(nil).Once()
+
+	body := `[
+		{"specversion": "1.0", "id": "ce-batch-1", "source": "/orders-service", "type": "order-line/shipping-deleted", "time": "2024-05-03T03:48:13.506Z",
+		 "data": {"externalOrderId": "ce-order-1", "externalOrderGroupId": "ce-group-1", "externalOrderLineId": "ce-line-1"}},
+		{"specversion": "1.0", "id": "ce-batch-2", "type": "order-line/shipping-deleted", "data": {}}
+	]`
+	w := deliver(h, []byte(body), "Content-Type", "application/cloudevents-batch+json")
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	if results := bulkResults(t, w); assert.Len(t, results, 2) {
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, bulkResult{Index: 1, Status: http.StatusBadRequest, Error: "CloudEvent is missing required attributes: source"}, results[1])
+	}
+
+	w = deliver(h, []byte(`{"specversion": "1.0"}`), "Content-Type", "application/cloudevents-batch+json")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	db.AssertExpectations(t)
+}
+
+// TestGetOrderEventsAsCloudEvents checks that stored events are re-serialized as a CloudEvents batch
+func TestGetOrderEventsAsCloudEvents(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	pk := "#PK#BIGW#ce-order-1"
+	db.On("QueryEvents", tables[persistent.RoleOrders], model.EventQuery{PK: pk, Limit: 100}).Return(model.EventPage{Events: []model.StoredEvent{
+		{
+			PK:          pk,
+			SK:          "#SK#2024-05-03T03:48:13.506Z#order-line/shipping-deleted",
+			EventType:   "order-line/shipping-deleted",
+			LastUpdated: "2024-05-03T03:48:13.506Z",
+			EventData:   `{"$type":"order-line/shipping-deleted","eventId":"ce-event-1"}`,
+			CloudEvent: &model.CloudEventAttributes{
+				SpecVersion: "1.0",
+				ID:          "ce-event-1",
+				Source:      "/orders-service",
+				Type:        "com.example.order-line.shipping-deleted",
+			},
+		},
+		{
+			PK:          pk,
+			SK:          "#SK#2024-05-04T03:48:13.506Z#order/created",
+			EventType:   "order/created",
+			LastUpdated: "2024-05-04T03:48:13.506Z",
+			EventData:   `{"$type":"order/created","eventId":"native-event-1"}`,
+		},
+	}}, nil)
+	h := handler.NewWebhookHandler(db, tables)
+
+	w := httptest.NewRecorder()
+	handler.Make(h.GetOrderEventsByPK)(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ce-order-1&format=cloudevents", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "application/cloudevents-batch+json", w.Result().Header.Get("Content-Type"))
+
+	var events []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "ce-event-1", events[0]["id"])
+		assert.Equal(t, "/orders-service", events[0]["source"])
+		assert.Equal(t, "com.example.order-line.shipping-deleted", events[0]["type"])
+		assert.Equal(t, "native-event-1", events[1]["id"])
+		assert.Equal(t, "/BIGW", events[1]["source"])
+		assert.Equal(t, "order/created", events[1]["type"])
+		assert.Equal(t, "2024-05-04T03:48:13.506Z", events[1]["time"])
+		assert.Equal(t, "1.0", events[1]["specversion"])
+	}
+	db.AssertExpectations(t)
+}
+
+// TestGetOrderEventsAsCloudEventsInvalidData checks that a stored event whose data is not a JSON object fails the
+// conversion instead of being returned without an id
+func TestGetOrderEventsAsCloudEventsInvalidData(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	pk := "#PK#BIGW#ce-order-2"
+	db.On("QueryEvents", tables[persistent.RoleOrders], model.EventQuery{PK: pk, Limit: 100}).Return(model.EventPage{Events: []model.StoredEvent{
+		{PK: pk, SK: "#SK#2024-05-04T03:48:13.506Z#order/created", EventType: "order/created", EventData: "not json"},
+	}}, nil)
+	h := handler.NewWebhookHandler(db, tables)
+
+	w := httptest.NewRecorder()
+	handler.Make(h.GetOrderEventsByPK)(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ce-order-2&format=cloudevents", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	db.AssertExpectations(t)
+}
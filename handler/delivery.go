@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"webhook_test_server/model"
+)
+
+// deliveryInfo returns the delivery details recorded with the events of a request, or nil when there are none.
+// raw and body are the request body as received and once its Content-Encoding was decoded.
+func deliveryInfo(r *http.Request, raw, body []byte) *model.Delivery {
+	var delivery model.Delivery
+	// Only certificates verified against the client CA bundle are recorded
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		delivery.ClientCertSubject = r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	if encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		delivery.ContentEncoding = encoding
+		delivery.CompressedBytes = int64(len(raw))
+		delivery.BodyBytes = int64(len(body))
+	}
+	if delivery == (model.Delivery{}) {
+		return nil
+	}
+	return &delivery
+}
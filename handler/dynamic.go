@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+)
+
+// DynamicEventType is an event type registered at runtime through the admin API.
+// Its ID, timestamp and grouping keys are extracted with JSONPath and it is stored through StoreEventData.
+type DynamicEventType struct {
+	Name string `json:"name"`
+	// Table is the role of the target table, such as orders, the default, or products
+	Table         TableRole `json:"table"`
+	IDPath        string    `json:"idPath"`
+	TimestampPath string    `json:"timestampPath"`
+	// GroupingKeys maps attribute names onto JSONPath expressions; externalOrderId and dealId
+	// fill the matching event options, other names are stored as attributes of the same name
+	GroupingKeys map[string]string `json:"groupingKeys,omitempty"`
+	// Schema is an optional JSON Schema the payload must satisfy
+	Schema       json.RawMessage `json:"schema,omitempty"`
+	RegisteredAt time.Time       `json:"registeredAt"`
+}
+
+// dynamicType is a registered type with its paths and schema compiled
+type dynamicType struct {
+	definition   DynamicEventType
+	id           *jsonPath
+	timestamp    *jsonPath
+	groupingKeys map[string]*jsonPath
+	schema       *jsonSchema
+}
+
+// dynamicTypes holds the registered dynamic event types, optionally persisted to a file
+type dynamicTypes struct {
+	path  string
+	mu    sync.RWMutex
+	types map[string]*dynamicType
+}
+
+// WithDynamicTypesFile persists dynamic event types to a JSON file so they survive restarts
+func WithDynamicTypesFile(path string) Option {
+	return func(h *WebhookHandler) {
+		h.dynamic.path = path
+	}
+}
+
+// LoadDynamicTypes reads the dynamic event types persisted to a file; a missing file holds no types
+func LoadDynamicTypes(path string) ([]DynamicEventType, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var definitions []DynamicEventType
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, fmt.Errorf("failed to parse dynamic event types %s: %w", path, err)
+	}
+	return definitions, nil
+}
+
+// loadDynamicTypes registers the persisted dynamic event types
+func (h *WebhookHandler) loadDynamicTypes() {
+	h.dynamic.types = make(map[string]*dynamicType)
+	if h.dynamic.path == "" {
+		return
+	}
+	definitions, err := LoadDynamicTypes(h.dynamic.path)
+	if err != nil {
+		log.Printf("Failed to load dynamic event types: %v", err)
+		return
+	}
+	for _, definition := range definitions {
+		compiled, err := h.compileDynamicType(definition)
+		if err != nil {
+			log.Printf("Skipping dynamic event type %s: %v", definition.Name, err)
+			continue
+		}
+		h.dynamic.types[definition.Name] = compiled
+	}
+	log.Printf("Loaded %d dynamic event types from %s", len(h.dynamic.types), h.dynamic.path)
+}
+
+// compileDynamicType validates a definition and compiles its paths and schema
+func (h *WebhookHandler) compileDynamicType(definition DynamicEventType) (*dynamicType, error) {
+	if definition.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if _, ok := h.tables.Name(definition.Table.role()); !ok {
+		return nil, fmt.Errorf("no %s table is configured", definition.Table.role())
+	}
+	if definition.IDPath == "" || definition.TimestampPath == "" {
+		return nil, errors.New("idPath and timestampPath are required")
+	}
+
+	compiled := &dynamicType{definition: definition, groupingKeys: make(map[string]*jsonPath)}
+	var err error
+	if compiled.id, err = compileJSONPath(definition.IDPath); err != nil {
+		return nil, err
+	}
+	if compiled.timestamp, err = compileJSONPath(definition.TimestampPath); err != nil {
+		return nil, err
+	}
+	for name, expr := range definition.GroupingKeys {
+		// StoreEventData writes the event ID to EventID itself
+		if persistent.IsReservedAttribute(name) || name == "EventID" {
+			return nil, fmt.Errorf("grouping key %s is a reserved attribute name", name)
+		}
+		if compiled.groupingKeys[name], err = compileJSONPath(expr); err != nil {
+			return nil, err
+		}
+	}
+	if len(definition.Schema) > 0 {
+		if compiled.schema, err = compileJSONSchema(definition.Schema); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// dynamicHandler returns the event handler of a registered dynamic event type
+func (h *WebhookHandler) dynamicHandler(eventType string) (eventHandler, bool) {
+	h.dynamic.mu.RLock()
+	defined, found := h.dynamic.types[eventType]
+	h.dynamic.mu.RUnlock()
+	if !found {
+		return nil, false
+	}
+	return defined.handle(h), true
+}
+
+// handle validates the payload against the type's schema and extracts its keys with JSONPath
+func (t *dynamicType) handle(h *WebhookHandler) eventHandler {
+	name := t.definition.Name
+	tableName, _ := h.tables.Name(t.definition.Table.role())
+	return func(ctx context.Context, marketplace string, body []byte, opts model.EventOptions) (storeFunc, error) {
+		log.Printf("Processing dynamic %s event", name)
+
+		var payload interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return nil, fmt.Errorf("failed to decode %s event: %w", name, err)
+		}
+		if t.schema != nil {
+			_, span := tracer.Start(ctx, "validate")
+			err := t.schema.validate(payload, "$")
+			span.End()
+			if err != nil {
+				return nil, fmt.Errorf("validation error for %s event: %w", name, err)
+			}
+		}
+
+		eventID, err := t.id.lookupString(payload)
+		if err != nil || eventID == "" {
+			return nil, fmt.Errorf("validation error for %s event: event ID at %s is required", name, t.definition.IDPath)
+		}
+		timestamp, err := t.timestamp.lookupString(payload)
+		if err != nil || timestamp == "" {
+			return nil, fmt.Errorf("validation error for %s event: timestamp at %s is required", name, t.definition.TimestampPath)
+		}
+
+		// Grouping keys populate the event options so the event can be queried by them
+		opts.Attributes = make(map[string]string, len(t.groupingKeys))
+		for key, path := range t.groupingKeys {
+			value, err := path.lookupString(payload)
+			if err != nil {
+				return nil, fmt.Errorf("validation error for %s event: grouping key %s: %w", name, key, err)
+			}
+			switch key {
+			case "externalOrderId":
+				opts.ExternalOrderId = &value
+			case "dealId":
+				opts.DealId = &value
+			default:
+				opts.Attributes[key] = value
+			}
+		}
+
+		return func(ctx context.Context) error {
+			log.Printf("Storing dynamic %s event for marketplace: %s, Event ID: %s", name, marketplace, eventID)
+			return h.db.StoreEventData(ctx, tableName, name, eventID, timestamp, marketplace, payload, opts)
+		}, nil
+	}
+}
+
+// DynamicTypes returns the registered dynamic event types sorted by name
+func (h *WebhookHandler) DynamicTypes() []DynamicEventType {
+	h.dynamic.mu.RLock()
+	defer h.dynamic.mu.RUnlock()
+	definitions := make([]DynamicEventType, 0, len(h.dynamic.types))
+	for _, defined := range h.dynamic.types {
+		definitions = append(definitions, defined.definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// saveDynamicTypes persists the registered types; it must be called with the lock held
+func (h *WebhookHandler) saveDynamicTypes() error {
+	if h.dynamic.path == "" {
+		return nil
+	}
+	definitions := make([]DynamicEventType, 0, len(h.dynamic.types))
+	for _, defined := range h.dynamic.types {
+		definitions = append(definitions, defined.definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	data, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.dynamic.path), 0o755); err != nil {
+		return err
+	}
+	tmp := h.dynamic.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.dynamic.path)
+}
+
+// EventTypesHandler manages dynamic event types: GET lists them, POST registers or replaces one,
+// and DELETE ?name= removes one
+func (h *WebhookHandler) EventTypesHandler(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.DynamicTypes())
+		return nil
+
+	case http.MethodPost:
+		var definition DynamicEventType
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&definition); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Failed to decode event type definition")
+		}
+		if _, routed := h.eventHandler(definition.Name); routed {
+			return NewAPIError(http.StatusConflict, fmt.Errorf("event type %s is defined by the routing config", definition.Name), "Event type is already routed")
+		}
+		definition.RegisteredAt = time.Now().UTC()
+		compiled, err := h.compileDynamicType(definition)
+		if err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Invalid event type definition")
+		}
+
+		h.dynamic.mu.Lock()
+		defer h.dynamic.mu.Unlock()
+		previous, replaced := h.dynamic.types[definition.Name]
+		h.dynamic.types[definition.Name] = compiled
+		if err := h.saveDynamicTypes(); err != nil {
+			if replaced {
+				h.dynamic.types[definition.Name] = previous
+			} else {
+				delete(h.dynamic.types, definition.Name)
+			}
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to persist event type")
+		}
+		log.Printf("Registered dynamic event type %s", definition.Name)
+		status := http.StatusCreated
+		if replaced {
+			status = http.StatusOK
+		}
+		writeJSON(w, status, definition)
+		return nil
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		h.dynamic.mu.Lock()
+		defer h.dynamic.mu.Unlock()
+		previous, found := h.dynamic.types[name]
+		if !found {
+			return NewAPIError(http.StatusNotFound, fmt.Errorf("dynamic event type %q not found", name), "Event type not found")
+		}
+		delete(h.dynamic.types, name)
+		if err := h.saveDynamicTypes(); err != nil {
+			h.dynamic.types[name] = previous
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to persist event type")
+		}
+		log.Printf("Removed dynamic event type %s", name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET, POST and DELETE requests are accepted.")
+}
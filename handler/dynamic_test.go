@@ -0,0 +1,78 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestDynamicEventTypes checks that an event type registered through the admin API is validated
+// against its schema, stored with its extracted keys and persisted across restarts
+func TestDynamicEventTypes(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	typesPath := filepath.Join(t.TempDir(), "event-types.json")
+	h := handler.NewWebhookHandler(db, tables, handler.WithDynamicTypesFile(typesPath))
+
+	definition := `{
+		"name": "partner/parcel-scanned",
+		"idPath": "$.scan.id",
+		"timestampPath": "$.scan['scanned-at']",
+		"groupingKeys": {"externalOrderId": "$.order.ref", "Depot": "$.scan.depots[0]"},
+		"schema": {"type": "object", "required": ["scan", "order"], "properties": {"scan": {"type": "object", "properties": {"id": {"type": "string", "minLength": 3}}}}}
+	}`
+	w := httptest.NewRecorder()
+	handler.Make(h.EventTypesHandler)(w, httptest.NewRequest("POST", "/admin/event-types", bytes.NewReader([]byte(definition))))
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// Routed types cannot be redefined
+	w = httptest.NewRecorder()
+	handler.Make(h.EventTypesHandler)(w, httptest.NewRequest("POST", "/admin/event-types", bytes.NewReader([]byte(`{"name": "order/created", "idPath": "$.eventId", "timestampPath": "$.lastUpdated"}`))))
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	externalOrderID := "PARTNER-1"
+	db.On("StoreEventData", tables[persistent.RoleOrders], "partner/parcel-scanned", "scan-123", "2024-07-01T10:00:00Z", "BIGW", mock.Anything, model.EventOptions{
+		ExternalOrderId: &externalOrderID,
+		Attributes:      map[string]string{"Depot": "SYD"},
+	}).Return(nil).Once()
+
+	event := `{"$type": "partner/parcel-scanned", "scan": {"id": "scan-123", "scanned-at": "2024-07-01T10:00:00Z", "depots": ["SYD", "MEL"]}, "order": {"ref": "PARTNER-1"}}`
+	assert.Equal(t, http.StatusOK, deliver(h, []byte(event)).Code)
+
+	// The schema rejects a scan ID that is too short
+	invalid := `{"$type": "partner/parcel-scanned", "scan": {"id": "s1", "scanned-at": "2024-07-01T10:00:00Z", "depots": ["SYD"]}, "order": {"ref": "PARTNER-1"}}`
+	assert.Equal(t, http.StatusBadRequest, deliver(h, []byte(invalid)).Code)
+
+	// A restarted handler loads the persisted type
+	restarted := handler.NewWebhookHandler(db, tables, handler.WithDynamicTypesFile(typesPath))
+	if types := restarted.DynamicTypes(); assert.Len(t, types, 1) {
+		assert.Equal(t, "partner/parcel-scanned", types[0].Name)
+	}
+	db.AssertExpectations(t)
+}
+
+// TestDynamicEventTypesRejected checks that definitions setting reserved attributes or using JSON Schema
+// keywords that are not enforced are refused
+func TestDynamicEventTypesRejected(t *testing.T) {
+	h := handler.NewWebhookHandler(new(persistenttest.MockDB), persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+	for name, definition := range map[string]string{
+		"reserved attribute":  `{"name": "partner/a", "idPath": "$.id", "timestampPath": "$.at", "groupingKeys": {"PK": "$.id"}}`,
+		"unsupported keyword": `{"name": "partner/b", "idPath": "$.id", "timestampPath": "$.at", "schema": {"type": "object", "oneOf": [{"required": ["id"]}]}}`,
+		"nested keyword":      `{"name": "partner/c", "idPath": "$.id", "timestampPath": "$.at", "schema": {"properties": {"at": {"type": "string", "format": "date-time"}}}}`,
+	} {
+		w := httptest.NewRecorder()
+		handler.Make(h.EventTypesHandler)(w, httptest.NewRequest("POST", "/admin/event-types", bytes.NewReader([]byte(definition))))
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, name)
+	}
+	assert.Empty(t, h.DynamicTypes())
+}
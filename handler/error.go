@@ -1,28 +1,47 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log" 
+	"math"
 	"net/http"
 	"reflect"
+	"strconv"
+
+	"webhook_test_server/resilience"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type APIError struct {
 	StatusCode int    `json:"status_code"`
 	Cause      string `json:"error"`
 	Message    string `json:"message"`
+	err        error
 }
 
 func (e APIError) Error() string {
 	return fmt.Sprintf("api error: %d - %s", e.StatusCode, e.Cause)
 }
 
+// Unwrap returns the underlying error so callers can inspect it with errors.Is
+func (e APIError) Unwrap() error {
+	return e.err
+}
+
 func NewAPIError(statusCode int, err error, message string) APIError {
 	return APIError{
 		StatusCode: statusCode,
 		Cause:      err.Error(),
 		Message:    message,
+		err:        err,
 	}
 }
 
@@ -43,8 +62,42 @@ type APIfunc func(w http.ResponseWriter, r *http.Request) error
 
 func Make(h APIfunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Continue the sender's trace when a W3C traceparent header is present
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+		defer span.End()
+		r = r.WithContext(ctx)
+
 		if err := h(w, r); err != nil {
 			log.Printf("HTTP API Error: %v, Path: %s", err, r.URL.Path)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			// The client went away, so there is nobody left to respond to
+			if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+				log.Printf("Client disconnected before the request completed, Path: %s", r.URL.Path)
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeJSON(w, http.StatusGatewayTimeout, APIError{StatusCode: http.StatusGatewayTimeout, Cause: err.Error(), Message: "The database did not respond in time."})
+				return
+			}
+
+			// The database is failing transiently or the circuit breaker is open, so the sender should retry
+			if resilience.Retryable(err) {
+				retryAfter := 1.0
+				var open *resilience.CircuitOpenError
+				if errors.As(err, &open) {
+					retryAfter = math.Ceil(open.RetryAfter.Seconds())
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+				writeJSON(w, http.StatusServiceUnavailable, APIError{StatusCode: http.StatusServiceUnavailable, Cause: err.Error(), Message: "The database is unavailable, retry later."})
+				return
+			}
+
 			switch err := err.(type) {
 			case APIError:
 				writeJSON(w, err.StatusCode, err)
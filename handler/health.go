@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+
+	"webhook_test_server/resilience"
 )
 
 // Health Check : ReadyHandler, LiveHandler, HealthHandler
-func ReadyHandler(w http.ResponseWriter, r *http.Request) error {
+func (h *WebhookHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) error {
 	handlerName := "ReadyHandler"
 	startTime, method, url := logRequestStart(r, handlerName)
 	log.Println("ReadyHandler:")
@@ -16,8 +18,14 @@ func ReadyHandler(w http.ResponseWriter, r *http.Request) error {
 		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method Not Allowed"), "Only GET requests are accepted.")
 	}
 
-	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
-	writeJSON(w, http.StatusOK, map[string]string{"message": "Server is Ready"})
+	report := h.readinessReport(r.Context())
+	status := http.StatusOK
+	if report.Status != readinessReady {
+		status = http.StatusServiceUnavailable
+	}
+
+	logRequestEnd(startTime, method, url, handlerName, status)
+	writeJSON(w, status, report)
 	return nil
 }
 
@@ -34,7 +42,7 @@ func LiveHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func HealthHandler(w http.ResponseWriter, r *http.Request) error {
+func (h *WebhookHandler) HealthHandler(w http.ResponseWriter, r *http.Request) error {
 	handlerName := "HealthHandler"
 	startTime, method, url := logRequestStart(r, handlerName)
 
@@ -42,8 +50,13 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) error {
 		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method Not Allowed"), "Only GET requests are accepted.")
 	}
 
+	response := map[string]interface{}{"message": "Server is Healthy"}
+	if h.queue != nil {
+		response["queue"] = h.queue.Stats()
+	}
+
 	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
-	writeJSON(w, http.StatusOK, map[string]string{"message": "Server is Healthy"})
+	writeJSON(w, http.StatusOK, response)
 	return nil
 }
 
@@ -55,14 +68,29 @@ func (h *WebhookHandler) DBHealthHandler(w http.ResponseWriter, r *http.Request)
 		return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET allowed, using wrong method TYPE")
 	}
 
-	tableName := h.tableNames[0]
-	err := h.db.DescribeTable(tableName)
-	if err != nil {
-		logRequestEnd(startTime, method, url, handlerName, http.StatusInternalServerError)
-		return NewAPIError(http.StatusInternalServerError, err, "Database is unhealthy")
+	for _, tableName := range h.tables.Names() {
+		ctx, cancel := h.dbContext(r.Context())
+		err := h.db.DescribeTable(ctx, tableName)
+		cancel()
+		if err != nil {
+			logRequestEnd(startTime, method, url, handlerName, http.StatusInternalServerError)
+			return NewAPIError(http.StatusInternalServerError, err, fmt.Sprintf("Database is unhealthy: table %s", tableName))
+		}
 	}
 
-	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
-	writeJSON(w, http.StatusOK, map[string]string{"message": "Database is healthy"})
+	// The tables respond, but the breaker may still be rejecting calls until its cooldown ends
+	response := map[string]interface{}{"message": "Database is healthy"}
+	status := http.StatusOK
+	if h.breaker != nil {
+		state := h.breaker.State()
+		response["breaker"] = state
+		if state.State == resilience.StateOpen {
+			response["message"] = "Database circuit breaker is open"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	logRequestEnd(startTime, method, url, handlerName, status)
+	writeJSON(w, status, response)
 	return nil
-}
\ No newline at end of file
+}
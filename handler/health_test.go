@@ -0,0 +1,136 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+	"webhook_test_server/resilience"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestReadyHandlerDraining checks that /ready reports not-ready once shutdown starts
+func TestReadyHandlerDraining(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("CheckTableHealth", "EventWebhook").Return(persistent.TableHealth{TableName: "EventWebhook", Status: "ACTIVE"}, nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+	ready := handler.Make(h.ReadyHandler)
+
+	w := httptest.NewRecorder()
+	ready(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	h.StartDraining()
+	w = httptest.NewRecorder()
+	ready(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
+// TestReadyHandlerDependencies checks that /ready reports every table and its missing indexes
+func TestReadyHandlerDependencies(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("CheckTableHealth", "OrderEvents").Return(persistent.TableHealth{TableName: "OrderEvents", Status: "ACTIVE"}, nil).Once()
+	db.On("CheckTableHealth", "ProductEvents").Return(persistent.TableHealth{TableName: "ProductEvents", Status: "ACTIVE", MissingIndexes: []string{"DealIdIndex"}}, nil).Once()
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "OrderEvents", persistent.RoleProducts: "ProductEvents"}, handler.WithReadiness(0, time.Minute))
+	ready := handler.Make(h.ReadyHandler)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ready(w, httptest.NewRequest("GET", "/ready", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+
+		var report struct {
+			Status       string `json:"status"`
+			Dependencies []struct {
+				Name  string `json:"name"`
+				Ready bool   `json:"ready"`
+			} `json:"dependencies"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "not_ready", report.Status)
+		if assert.Len(t, report.Dependencies, 2) {
+			assert.True(t, report.Dependencies[0].Ready)
+			assert.False(t, report.Dependencies[1].Ready)
+		}
+	}
+
+	// The second probe is served from the cache
+	db.AssertExpectations(t)
+}
+
+// TestReadyHandlerDeadline checks that a check cut short by its deadline is not cached
+func TestReadyHandlerDeadline(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("CheckTableHealth", "OrderEvents").Return(persistent.TableHealth{}, context.DeadlineExceeded).Once()
+	db.On("CheckTableHealth", "OrderEvents").Return(persistent.TableHealth{TableName: "OrderEvents", Status: "ACTIVE"}, nil).Once()
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "OrderEvents"}, handler.WithReadiness(0, time.Minute))
+	ready := handler.Make(h.ReadyHandler)
+
+	w := httptest.NewRecorder()
+	ready(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	ready(w, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	db.AssertExpectations(t)
+}
+
+// TestResilience checks that throttled writes are retried and that repeated failures open the circuit breaker
+func TestResilience(t *testing.T) {
+	throttled := &types.ProvisionedThroughputExceededException{Message: aws.String("slow down")}
+	db := new(persistenttest.MockDB)
+	db.On("StoreEvent", "EventWebhook", mock.Anything, model.EventOptions{}).Return(throttled).Once()
+	db.On("StoreEvent", "EventWebhook", mock.Anything, model.EventOptions{}).Return(nil).Once()
+	db.On("StoreEvent", "EventWebhook", mock.Anything, model.EventOptions{}).Return(throttled)
+	db.On("DescribeTable", "EventWebhook").Return(nil)
+	resilient := resilience.Wrap(db, resilience.Config{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, BreakerFailures: 2, BreakerCooldown: time.Minute})
+	h := handler.NewWebhookHandler(resilient, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithCircuitBreaker(resilient.Breaker()))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	deliver := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/BIGW", bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "resilient-1"))))
+		return w
+	}
+
+	// The throttled write succeeds on its retry
+	assert.Equal(t, http.StatusOK, deliver().Code)
+	db.AssertNumberOfCalls(t, "StoreEvent", 2)
+
+	// Two deliveries that fail every attempt open the breaker
+	assert.Equal(t, http.StatusServiceUnavailable, deliver().Code)
+	assert.Equal(t, http.StatusServiceUnavailable, deliver().Code)
+	db.AssertNumberOfCalls(t, "StoreEvent", 6)
+
+	// Once open, deliveries fail fast without reaching the database
+	w := deliver()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	db.AssertNumberOfCalls(t, "StoreEvent", 6)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/dbhealth", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var health struct {
+		Breaker resilience.BreakerState `json:"breaker"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, resilience.StateOpen, health.Breaker.State)
+	assert.Equal(t, 2, health.Breaker.ConsecutiveFailures)
+}
@@ -0,0 +1,19 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+
+	"webhook_test_server/handler"
+)
+
+// deliver posts a webhook body for the BIGW merchant to the handler, with headers given as name and value pairs
+func deliver(h *handler.WebhookHandler, body []byte, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.Make(h.WebhookEvents)(w, req)
+	return w
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression limited to child and index selectors,
+// such as $.order.id, $['event-id'] or $.lines[0].sku
+type jsonPath struct {
+	expr  string
+	steps []jsonPathStep
+}
+
+// jsonPathStep selects an object member by key or an array element by index
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// compileJSONPath parses a JSONPath expression
+func compileJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", expr)
+	}
+	path := &jsonPath{expr: expr}
+	for rest := expr[1:]; rest != ""; {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" || key == "*" {
+				return nil, fmt.Errorf("JSONPath %q: only named members are supported after '.'", expr)
+			}
+			path.steps = append(path.steps, jsonPathStep{key: key})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: unterminated '['", expr)
+			}
+			selector := rest[1:end]
+			if len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+				path.steps = append(path.steps, jsonPathStep{key: selector[1 : len(selector)-1]})
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				path.steps = append(path.steps, jsonPathStep{index: index, isIndex: true})
+			} else {
+				return nil, fmt.Errorf("JSONPath %q: unsupported selector [%s], expected a quoted key or an index", expr, selector)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", expr, rest[0])
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value the path selects from a decoded JSON document
+func (p *jsonPath) lookup(document interface{}) (interface{}, bool) {
+	value := document
+	for _, step := range p.steps {
+		if step.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			value = array[step.index]
+			continue
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[step.key]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// lookupString returns the scalar the path selects as a string
+func (p *jsonPath) lookupString(document interface{}) (string, error) {
+	value, ok := p.lookup(document)
+	if !ok {
+		return "", fmt.Errorf("%s not found", p.expr)
+	}
+	return scalarString(p.expr, value)
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"webhook_test_server/model"
+)
+
+// defaultQueryLimit is the page size of a query that doesn't set a limit, and maxQueryLimit bounds the
+// limit a query may ask for
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// eventTimeLayout is the layout of stored LastUpdated times, which since and until are compared with
+const eventTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// nextCursorHeader carries the cursor of the next page of a limited query
+const nextCursorHeader = "X-Next-Cursor"
+
+// eventQuery adds the filters and paging of a query request, eventType, since, until, limit and cursor,
+// to the events it selects
+func eventQuery(r *http.Request, query model.EventQuery) (model.EventQuery, error) {
+	params := r.URL.Query()
+	query.EventType = params.Get("eventType")
+	var err error
+	if query.Since, err = eventTime(params, "since"); err != nil {
+		return query, err
+	}
+	if query.Until, err = eventTime(params, "until"); err != nil {
+		return query, err
+	}
+	query.Cursor = params.Get("cursor")
+	query.Limit = defaultQueryLimit
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxQueryLimit {
+			return query, NewAPIError(http.StatusBadRequest, fmt.Errorf("invalid limit %q", limit), fmt.Sprintf("limit must be between 1 and %d", maxQueryLimit))
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+// eventTime reads an RFC 3339 time parameter and normalizes it to UTC, so it compares with stored times
+// as strings do
+func eventTime(params url.Values, name string) (string, error) {
+	value := params.Get(name)
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return "", NewAPIError(http.StatusBadRequest, err, fmt.Sprintf("%s must be an RFC 3339 time", name))
+	}
+	return t.UTC().Format(eventTimeLayout), nil
+}
+
+// writeEventPage writes a page of events, with the cursor of the next page in X-Next-Cursor
+func writeEventPage(w http.ResponseWriter, r *http.Request, events []model.StoredEvent, nextCursor string) error {
+	if nextCursor != "" {
+		w.Header().Set(nextCursorHeader, nextCursor)
+	}
+	return writeOrderEvents(w, r, events)
+}
@@ -0,0 +1,49 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEventQueryPaging checks that the handler passes the paging parameters through, returns the next
+// cursor in a header and rejects a limit over the maximum and times that aren't RFC 3339
+func TestEventQueryPaging(t *testing.T) {
+	mockDB := new(persistenttest.MockDB)
+	mockDB.On("QueryEvents", "EventWebhook", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Limit: 1}).Return(model.EventPage{
+		Events:     []model.StoredEvent{{PK: "#PK#BIGW#ORDER-1", SK: "#SK#1"}},
+		NextCursor: "next",
+	}, nil)
+	// Times are compared in UTC with milliseconds, like stored times, and a query without a limit gets the default
+	mockDB.On("QueryEvents", "EventWebhook", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Since: "2024-05-02T23:30:00.000Z", Limit: 100}).Return(model.EventPage{
+		Events: []model.StoredEvent{{PK: "#PK#BIGW#ORDER-1", SK: "#SK#2"}},
+	}, nil)
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, handler.NewWebhookHandler(mockDB, persistent.Tables{persistent.RoleOrders: "EventWebhook"}))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1&limit=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "next", w.Header().Get("X-Next-Cursor"))
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1&limit=5000", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1&since=2024-05-03T09:30:00%2B10:00", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for _, params := range []string{"since=yesterday", "until=2024-05-03", "since=2024-05-03T09:30:00"} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/order?merchantId=BIGW&externalOrderId=ORDER-1&"+params, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, params)
+	}
+	mockDB.AssertNumberOfCalls(t, "QueryEvents", 2)
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/ratelimit"
+)
+
+// WithRateLimiter enforces the limiter's token buckets on webhook deliveries
+func WithRateLimiter(limiter *ratelimit.Limiter) Option {
+	return func(h *WebhookHandler) {
+		h.limiter = limiter
+	}
+}
+
+// RateLimit wraps a handler so requests beyond the merchant or global limit are rejected with 429.
+// Limited responses carry X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset.
+func (h *WebhookHandler) RateLimit(merchant merchantSource, next APIfunc) APIfunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if h.limiter == nil {
+			return next(w, r)
+		}
+		var requested string
+		if merchant != nil {
+			requested = merchant(r)
+		}
+
+		// Only merchants the API key is limited to count as authenticated; other unknown merchants share a bucket
+		key := requestAPIKey(r.Context())
+		authenticated := key != nil && len(key.Merchants) > 0 && key.AllowsMerchant(requested)
+		decision := h.limiter.Allow(requested, authenticated)
+		if decision.Limited {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(ratelimit.RetryAfterSeconds(decision.Reset).Seconds())))
+			w.Header().Set("X-RateLimit-Scope", decision.Scope)
+		}
+		if !decision.Allowed {
+			metrics.RateLimited(requested, decision.Scope)
+			w.Header().Set("Retry-After", strconv.Itoa(int(ratelimit.RetryAfterSeconds(decision.RetryAfter).Seconds())))
+			return NewAPIError(http.StatusTooManyRequests, fmt.Errorf("%s rate limit exceeded for merchant %q", decision.Scope, requested), "Rate limit exceeded, retry later")
+		}
+		return next(w, r)
+	}
+}
+
+// rateLimitsResponse is the body of GET /admin/rate-limits
+type rateLimitsResponse struct {
+	Config ratelimit.Config           `json:"config"`
+	Stats  map[string]ratelimit.Stats `json:"stats"`
+}
+
+// RateLimitsHandler manages rate limits: GET returns the limits and per-merchant decision counts,
+// PUT replaces the limits and DELETE resets the counts
+func (h *WebhookHandler) RateLimitsHandler(w http.ResponseWriter, r *http.Request) error {
+	if h.limiter == nil {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("rate limiting is not enabled"), "Rate limiting is not enabled")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rateLimitsResponse{Config: h.limiter.Config(), Stats: h.limiter.Stats()})
+		return nil
+
+	case http.MethodPut:
+		var config ratelimit.Config
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Failed to decode rate limits")
+		}
+		if err := config.Validate(); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Invalid rate limits")
+		}
+		h.limiter.SetConfig(config)
+		writeJSON(w, http.StatusOK, config)
+		return nil
+
+	case http.MethodDelete:
+		h.limiter.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return NewAPIError(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), "Only GET, PUT and DELETE requests are accepted.")
+}
@@ -0,0 +1,63 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+	"webhook_test_server/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestRateLimit checks that a merchant over its limit gets 429 with rate limit headers and that early retries are counted
+func TestRateLimit(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("StoreEvent", "EventWebhook", mock.Anything, model.EventOptions{}).Return(nil)
+	limiter := ratelimit.New(ratelimit.Config{Merchant: ratelimit.Limit{Rate: 0.5, Burst: 2}, Known: []string{"BIGW"}})
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithRateLimiter(limiter))
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, h)
+
+	deliver := func(merchant string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/"+merchant, bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "limited-1"))))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, deliver("BIGW").Code)
+	w := deliver("BIGW")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+
+	w = deliver("BIGW")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "merchant", w.Header().Get("X-RateLimit-Scope"))
+	assert.Equal(t, http.StatusTooManyRequests, deliver("BIGW").Code)
+	// Unknown merchants share a bucket of their own
+	assert.Equal(t, http.StatusOK, deliver("OTHER").Code)
+	assert.Equal(t, http.StatusOK, deliver("UNKNOWN").Code)
+	assert.Equal(t, http.StatusTooManyRequests, deliver("OTHER").Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/rate-limits", nil))
+	var limits struct {
+		Stats map[string]ratelimit.Stats `json:"stats"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &limits))
+	assert.Equal(t, int64(2), limits.Stats["BIGW"].Allowed)
+	assert.Equal(t, int64(2), limits.Stats["BIGW"].Rejected)
+	assert.Equal(t, int64(1), limits.Stats["BIGW"].EarlyRetries)
+	assert.Equal(t, int64(2), limits.Stats[ratelimit.OtherMerchants].Allowed)
+	assert.NotContains(t, limits.Stats, "UNKNOWN")
+	db.AssertNumberOfCalls(t, "StoreEvent", 4)
+}
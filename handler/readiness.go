@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"webhook_test_server/persistent"
+)
+
+// Readiness states reported by /ready
+const (
+	readinessReady    = "ready"
+	readinessStarting = "starting"
+	readinessNotReady = "not_ready"
+	readinessDraining = "draining"
+)
+
+// dependencyStatus is the readiness of a single dependency
+type dependencyStatus struct {
+	Name  string                  `json:"name"`
+	Ready bool                    `json:"ready"`
+	Table *persistent.TableHealth `json:"table,omitempty"`
+	Error string                  `json:"error,omitempty"`
+}
+
+// readinessReport is the JSON body returned by /ready
+type readinessReport struct {
+	Status                string             `json:"status"`
+	Draining              bool               `json:"draining"`
+	StartupGracePeriod    string             `json:"startupGracePeriod"`
+	StartupGraceRemaining string             `json:"startupGraceRemaining"`
+	CheckedAt             time.Time          `json:"checkedAt"`
+	Dependencies          []dependencyStatus `json:"dependencies"`
+}
+
+// readiness caches dependency checks so frequent probes do not hammer DynamoDB
+type readiness struct {
+	startedAt       time.Time
+	gracePeriod     time.Duration
+	refreshInterval time.Duration
+
+	mu           sync.Mutex
+	checkedAt    time.Time
+	dependencies []dependencyStatus
+	// refreshing is the check in flight, shared by every probe that arrives while it runs
+	refreshing *dependencyCheck
+}
+
+// dependencyCheck is a run of the dependency checks; done is closed once the results are set
+type dependencyCheck struct {
+	done         chan struct{}
+	checkedAt    time.Time
+	dependencies []dependencyStatus
+}
+
+// WithReadiness configures /ready: failures during the startup grace period are reported as
+// "starting", and dependency checks are cached for refreshInterval.
+func WithReadiness(gracePeriod, refreshInterval time.Duration) Option {
+	return func(h *WebhookHandler) {
+		h.readiness.gracePeriod = gracePeriod
+		h.readiness.refreshInterval = refreshInterval
+	}
+}
+
+// dependencies returns the cached dependency checks, refreshing them when they are stale. The refresh runs
+// outside the lock and is shared by concurrent probes; a probe that goes away stops waiting for it.
+func (h *WebhookHandler) dependencies(ctx context.Context) ([]dependencyStatus, time.Time) {
+	h.readiness.mu.Lock()
+	if h.readiness.dependencies != nil && time.Since(h.readiness.checkedAt) < h.readiness.refreshInterval {
+		defer h.readiness.mu.Unlock()
+		return h.readiness.dependencies, h.readiness.checkedAt
+	}
+	check := h.readiness.refreshing
+	if check == nil {
+		check = &dependencyCheck{done: make(chan struct{})}
+		h.readiness.refreshing = check
+		go h.refreshDependencies(context.WithoutCancel(ctx), check)
+	}
+	h.readiness.mu.Unlock()
+
+	select {
+	case <-check.done:
+		return check.dependencies, check.checkedAt
+	case <-ctx.Done():
+		dependencies := make([]dependencyStatus, 0, len(h.tables))
+		for _, tableName := range h.tables.Names() {
+			dependencies = append(dependencies, dependencyStatus{Name: "dynamodb:" + tableName, Error: ctx.Err().Error()})
+		}
+		return dependencies, time.Now()
+	}
+}
+
+// refreshDependencies checks every table and caches the results, unless a check was cut short by its
+// deadline, which says nothing about the table and is retried on the next probe
+func (h *WebhookHandler) refreshDependencies(ctx context.Context, check *dependencyCheck) {
+	cacheable := true
+	dependencies := make([]dependencyStatus, 0, len(h.tables))
+	for _, tableName := range h.tables.Names() {
+		dependency := dependencyStatus{Name: "dynamodb:" + tableName}
+		dbCtx, cancel := h.dbContext(ctx)
+		health, err := h.db.CheckTableHealth(dbCtx, tableName)
+		cancel()
+		if err != nil {
+			dependency.Error = err.Error()
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				cacheable = false
+			}
+		} else {
+			dependency.Table = &health
+			dependency.Ready = health.Ready()
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	check.dependencies = dependencies
+	check.checkedAt = time.Now()
+
+	h.readiness.mu.Lock()
+	defer h.readiness.mu.Unlock()
+	if cacheable {
+		h.readiness.dependencies = check.dependencies
+		h.readiness.checkedAt = check.checkedAt
+	}
+	h.readiness.refreshing = nil
+	close(check.done)
+}
+
+// readinessReport evaluates the draining state, the startup grace period and every dependency
+func (h *WebhookHandler) readinessReport(ctx context.Context) readinessReport {
+	graceRemaining := h.readiness.gracePeriod - time.Since(h.readiness.startedAt)
+	if graceRemaining < 0 {
+		graceRemaining = 0
+	}
+	report := readinessReport{
+		Status:                readinessReady,
+		Draining:              h.draining.Load(),
+		StartupGracePeriod:    h.readiness.gracePeriod.String(),
+		StartupGraceRemaining: graceRemaining.Round(time.Second).String(),
+	}
+	report.Dependencies, report.CheckedAt = h.dependencies(ctx)
+
+	for _, dependency := range report.Dependencies {
+		if !dependency.Ready {
+			report.Status = readinessNotReady
+			if graceRemaining > 0 {
+				report.Status = readinessStarting
+			}
+			break
+		}
+	}
+	if report.Draining {
+		report.Status = readinessDraining
+	}
+	return report
+}
@@ -0,0 +1,359 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRoutes is the routing config used when no ROUTES_CONFIG file is set
+//
+//go:embed routes.json
+var defaultRoutes []byte
+
+// RouteConfig is the declarative routing table mapping event types onto storage
+type RouteConfig struct {
+	Routes []Route `json:"routes" yaml:"routes"`
+}
+
+// Route maps one $type onto a model, a target table and the templates of its keys and attributes.
+// Templates reference payload fields as {field} or {nested.field}; {merchant} is the merchant from the URL.
+type Route struct {
+	Type string `json:"type" yaml:"type"`
+	// Model names the event struct to decode and validate into; empty stores the payload as is
+	Model string `json:"model,omitempty" yaml:"model,omitempty"`
+	// Table is the role of the target table, such as orders, the default, or products
+	Table TableRole `json:"table" yaml:"table"`
+	PK    string    `json:"pk" yaml:"pk"`
+	SK    string    `json:"sk" yaml:"sk"`
+	// Attributes are stored alongside the keys, typically as GSI keys; empty values are omitted
+	Attributes map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+	// Required lists payload fields that must be present, for routes without a model
+	Required []string `json:"required,omitempty" yaml:"required,omitempty"`
+}
+
+// TableRole names the role of the table an event is stored in. The table indexes of earlier configs
+// are read as the roles of those positions, 0 as orders and 1 as products.
+type TableRole string
+
+func (r *TableRole) UnmarshalJSON(data []byte) error {
+	var position int
+	if err := json.Unmarshal(data, &position); err == nil {
+		return r.setPosition(position)
+	}
+	var role string
+	if err := json.Unmarshal(data, &role); err != nil {
+		return fmt.Errorf("table must be a role or a table index: %w", err)
+	}
+	*r = TableRole(role)
+	return nil
+}
+
+func (r *TableRole) UnmarshalYAML(node *yaml.Node) error {
+	var position int
+	if node.Tag == "!!int" && node.Decode(&position) == nil {
+		return r.setPosition(position)
+	}
+	var role string
+	if err := node.Decode(&role); err != nil {
+		return fmt.Errorf("table must be a role or a table index: %w", err)
+	}
+	*r = TableRole(role)
+	return nil
+}
+
+// role returns the role, orders when none is set, as the first table was the default before roles
+func (r TableRole) role() string {
+	if r == "" {
+		return persistent.RoleOrders
+	}
+	return string(r)
+}
+
+func (r *TableRole) setPosition(position int) error {
+	role := persistent.PositionalRole(position)
+	if role == "" {
+		return fmt.Errorf("table index %d has no role, name the table's role instead", position)
+	}
+	*r = TableRole(role)
+	return nil
+}
+
+// routeTable is a loaded routing config with a handler per event type
+type routeTable struct {
+	routes   []Route
+	handlers map[string]eventHandler
+}
+
+// WithRoutesFile loads the routing config from a JSON or YAML file instead of the built-in routes
+func WithRoutesFile(path string) Option {
+	return func(h *WebhookHandler) {
+		h.routesPath = path
+	}
+}
+
+// LoadRoutes reads a routing config from a JSON or YAML file, or the built-in routes when path is empty
+func LoadRoutes(path string) (*RouteConfig, error) {
+	data, format := defaultRoutes, ".json"
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		format = strings.ToLower(filepath.Ext(path))
+	}
+
+	var config RouteConfig
+	switch format {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse routing config %s: %w", path, err)
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse routing config %s: %w", path, err)
+		}
+	}
+	return &config, config.Validate()
+}
+
+// Validate checks that every route names a known model and has well-formed key templates
+func (c *RouteConfig) Validate() error {
+	seen := make(map[string]bool)
+	for i, route := range c.Routes {
+		if route.Type == "" {
+			return fmt.Errorf("route %d has no type", i)
+		}
+		if seen[route.Type] {
+			return fmt.Errorf("route %q is defined more than once", route.Type)
+		}
+		seen[route.Type] = true
+
+		if route.Model != "" {
+			if _, ok := model.New(route.Model); !ok {
+				return fmt.Errorf("route %q uses unknown model %q, expected one of %s", route.Type, route.Model, strings.Join(model.Names(), ", "))
+			}
+		}
+		if route.PK == "" || route.SK == "" {
+			return fmt.Errorf("route %q needs both a pk and an sk template", route.Type)
+		}
+		templates := map[string]string{"pk": route.PK, "sk": route.SK}
+		for name, tmpl := range route.Attributes {
+			if persistent.IsReservedAttribute(name) {
+				return fmt.Errorf("route %q sets the reserved attribute %s", route.Type, name)
+			}
+			templates["attribute "+name] = tmpl
+		}
+		for name, tmpl := range templates {
+			if _, err := parseTemplate(tmpl); err != nil {
+				return fmt.Errorf("route %q has an invalid %s template: %w", route.Type, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReloadRoutes reloads the routing config and swaps it in atomically.
+// A config that fails to load or validate leaves the current routes in place.
+func (h *WebhookHandler) ReloadRoutes() error {
+	config, err := LoadRoutes(h.routesPath)
+	if err != nil {
+		return err
+	}
+	h.installRoutes(config)
+	return nil
+}
+
+// installRoutes builds a handler per route. Routes whose table role is not configured are skipped.
+func (h *WebhookHandler) installRoutes(config *RouteConfig) {
+	table := &routeTable{handlers: make(map[string]eventHandler, len(config.Routes))}
+	for _, route := range config.Routes {
+		if _, ok := h.tables.Name(route.Table.role()); !ok {
+			log.Printf("Skipping route %s: no %s table is configured", route.Type, route.Table.role())
+			continue
+		}
+		table.routes = append(table.routes, route)
+		table.handlers[route.Type] = h.routeHandler(route)
+	}
+	h.routes.Store(table)
+	log.Printf("Installed %d event routes", len(table.routes))
+}
+
+// eventHandler returns the handler for an event type; routed types take precedence over dynamic ones
+func (h *WebhookHandler) eventHandler(eventType string) (eventHandler, bool) {
+	if handler, found := h.routes.Load().handlers[eventType]; found {
+		return handler, true
+	}
+	return h.dynamicHandler(eventType)
+}
+
+// Routes returns the installed routes sorted by event type
+func (h *WebhookHandler) Routes() []Route {
+	routes := append([]Route(nil), h.routes.Load().routes...)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Type < routes[j].Type })
+	return routes
+}
+
+// routeHandler decodes and validates an event against its route and resolves the keys it is stored under
+func (h *WebhookHandler) routeHandler(route Route) eventHandler {
+	tableName, _ := h.tables.Name(route.Table.role())
+	return func(ctx context.Context, marketplace string, body []byte, opts model.EventOptions) (storeFunc, error) {
+		log.Printf("Processing %s event", route.Type)
+
+		// The payload fields feed the key templates
+		var fields map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, fmt.Errorf("failed to decode %s event: %w", route.Type, err)
+		}
+
+		var event interface{} = fields
+		if route.Model != "" {
+			event, _ = model.New(route.Model)
+			if err := decodeEvent(ctx, body, event); err != nil {
+				return nil, fmt.Errorf("failed to decode %s event: %w", route.Type, err)
+			}
+			// Validate the struct to make sure all required fields are present and correct
+			if err := validateEvent(ctx, event); err != nil {
+				log.Printf("Validation error for %s event: %v", route.Type, err)
+				return nil, fmt.Errorf("validation error for %s event: %w", route.Type, err)
+			}
+		}
+
+		lookup := func(name string) (string, error) {
+			if name == "merchant" {
+				return marketplace, nil
+			}
+			return fieldValue(fields, name)
+		}
+		for _, name := range route.Required {
+			if value, err := lookup(name); err != nil || value == "" {
+				return nil, fmt.Errorf("validation error for %s event: field %s is required", route.Type, name)
+			}
+		}
+
+		record := persistent.EventRecord{EventType: route.Type, EventData: event, Attributes: make(map[string]string)}
+		var err error
+		if record.PK, err = expandTemplate(route.PK, lookup); err != nil {
+			return nil, fmt.Errorf("cannot build partition key for %s event: %w", route.Type, err)
+		}
+		if record.SK, err = expandTemplate(route.SK, lookup); err != nil {
+			return nil, fmt.Errorf("cannot build sort key for %s event: %w", route.Type, err)
+		}
+		for name, tmpl := range route.Attributes {
+			// Attributes whose fields are missing or empty are left out of the item
+			if value, err := expandTemplate(tmpl, lookup); err == nil && value != "" {
+				record.Attributes[name] = value
+			}
+		}
+
+		return func(ctx context.Context) error {
+			log.Printf("Storing %s event for marketplace: %s, PK: %s", route.Type, marketplace, record.PK)
+			return h.db.StoreEvent(ctx, tableName, record, opts)
+		}, nil
+	}
+}
+
+// templateSegment is either literal text or a field reference of a key template
+type templateSegment struct {
+	literal string
+	field   string
+}
+
+// parseTemplate splits a template such as "#PK#{merchant}#{externalOrderId}" into segments
+func parseTemplate(tmpl string) ([]templateSegment, error) {
+	var segments []templateSegment
+	for rest := tmpl; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			segments = append(segments, templateSegment{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in %q", tmpl)
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unterminated '{' in %q", tmpl)
+		}
+		field := rest[open+1 : open+1+end]
+		if field == "" {
+			return nil, fmt.Errorf("empty field reference in %q", tmpl)
+		}
+		if open > 0 {
+			segments = append(segments, templateSegment{literal: rest[:open]})
+		}
+		segments = append(segments, templateSegment{field: field})
+		rest = rest[open+end+2:]
+	}
+	return segments, nil
+}
+
+// expandTemplate substitutes every field reference of a template using lookup
+func expandTemplate(tmpl string, lookup func(string) (string, error)) (string, error) {
+	segments, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, segment := range segments {
+		if segment.field == "" {
+			b.WriteString(segment.literal)
+			continue
+		}
+		value, err := lookup(segment.field)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// fieldValue returns a scalar payload field as a string, following dots into nested objects
+func fieldValue(fields map[string]interface{}, path string) (string, error) {
+	var value interface{} = fields
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("field %s not found", path)
+		}
+		if value, ok = object[name]; !ok || value == nil {
+			return "", fmt.Errorf("field %s not found", path)
+		}
+	}
+
+	return scalarString(path, value)
+}
+
+// scalarString formats a decoded JSON scalar for use in a key or attribute
+func scalarString(path string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", errors.New("field " + path + " is not a string, number or boolean")
+}
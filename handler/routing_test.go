@@ -0,0 +1,65 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestRoutingConfigReload checks that event types added to a YAML routing config are routed
+// after a reload, and that an invalid config leaves the current routes in place
+func TestRoutingConfigReload(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook", persistent.RoleProducts: "ProductWebhook"}
+	routesPath := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(routesPath, []byte("routes: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := handler.NewWebhookHandler(db, tables, handler.WithRoutesFile(routesPath))
+
+	body := []byte(`{"$type": "inventory/adjusted", "eventId": "adj-1", "warehouse": {"code": "SYD1"}, "sku": "SKU-9", "delta": -3}`)
+	assert.Equal(t, http.StatusBadRequest, deliver(h, body).Code)
+
+	routes := `routes:
+  - type: inventory/adjusted
+    table: 1
+    pk: "#INV#{merchant}#{warehouse.code}"
+    sk: "{sku}#{eventId}"
+    attributes:
+      Delta: "{delta}"
+    required: [sku]
+`
+	if err := os.WriteFile(routesPath, []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.Make(h.ReloadRoutesHandler)(w, httptest.NewRequest("POST", "/admin/routes/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	db.On("StoreEvent", "ProductWebhook", mock.MatchedBy(func(record persistent.EventRecord) bool {
+		return record.PK == "#INV#BIGW#SYD1" && record.SK == "SKU-9#adj-1" && record.Attributes["Delta"] == "-3"
+	}), model.EventOptions{}).Return(nil).Once()
+	assert.Equal(t, http.StatusOK, deliver(h, body).Code)
+
+	// A route with an unknown model is rejected and the previous routes stay installed
+	if err := os.WriteFile(routesPath, []byte("routes:\n  - {type: inventory/adjusted, model: Missing, pk: a, sk: b}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.Make(h.ReloadRoutesHandler)(w, httptest.NewRequest("POST", "/admin/routes/reload", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Result().StatusCode)
+	if routes := h.Routes(); assert.Len(t, routes, 1) {
+		assert.Equal(t, "inventory/adjusted", routes[0].Type)
+	}
+	db.AssertExpectations(t)
+}
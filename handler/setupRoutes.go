@@ -1,20 +1,39 @@
 package handler
 
 import (
-    "net/http"
-    "log"
+	"log"
+	"net/http"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
 )
 
 // SetupRoutes configures the HTTP server routes
-func SetupRoutes(webhookHandler *WebhookHandler) {
-    http.HandleFunc("/ready", Make(ReadyHandler))
-    http.HandleFunc("/live", Make(LiveHandler))
-    http.HandleFunc("/health", Make(HealthHandler))
-    http.HandleFunc("/dbhealth", Make(webhookHandler.DBHealthHandler))
-    http.HandleFunc("/", Make(webhookHandler.WebhookEvents))
-    http.HandleFunc("/order", Make(webhookHandler.GetOrderEventsByPK))
-    http.HandleFunc("/externalOrderId", Make(webhookHandler.GetOrderByExternalID))
+func SetupRoutes(mux *http.ServeMux, webhookHandler *WebhookHandler) {
+	handle(mux, "/ready", Make(webhookHandler.ReadyHandler))
+	handle(mux, "/live", Make(LiveHandler))
+	handle(mux, "/health", Make(webhookHandler.HealthHandler))
+	handle(mux, "/dbhealth", Make(webhookHandler.DBHealthHandler))
+	handle(mux, "/", Make(webhookHandler.Authorize(model.RoleIngest, webhookMerchant, webhookHandler.RateLimit(webhookMerchant, webhookHandler.WebhookEvents))))
+	handle(mux, "/order", Make(webhookHandler.Authorize(model.RoleRead, queryMerchant, webhookHandler.GetOrderEventsByPK)))
+	handle(mux, "/externalOrderId", Make(webhookHandler.Authorize(model.RoleRead, nil, webhookHandler.GetOrderByExternalID)))
+	handle(mux, "/bins", Make(webhookHandler.Authorize(model.RoleIngest, nil, webhookHandler.CreateBinHandler)))
+	handle(mux, "/bins/", Make(webhookHandler.Authorize(model.RoleIngest, nil, webhookHandler.BinHandler)))
+	handle(mux, "/b/", Make(webhookHandler.Authorize(model.RoleIngest, binMerchant, webhookHandler.RateLimit(binMerchant, webhookHandler.BinWebhookHandler))))
+	handle(mux, "/admin/routes", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.RoutesHandler)))
+	handle(mux, "/admin/routes/reload", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.ReloadRoutesHandler)))
+	handle(mux, "/admin/event-types", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.EventTypesHandler)))
+	handle(mux, "/admin/api-keys", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.APIKeysHandler)))
+	handle(mux, "/admin/rate-limits", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.RateLimitsHandler)))
+	handle(mux, "/admin/config", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.ConfigHandler)))
+	handle(mux, "/admin/chaos", Make(webhookHandler.Authorize(model.RoleAdmin, nil, webhookHandler.ChaosHandler)))
+	mux.Handle("/metrics", metrics.Handler())
+
+	// Log route configuration
+	log.Println("HTTP routes configured successfully.")
+}
 
-    // Log route configuration 
-    log.Println("HTTP routes configured successfully.")
+// handle registers a route with request latency instrumentation
+func handle(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	mux.HandleFunc(pattern, metrics.InstrumentRoute(pattern, h))
 }
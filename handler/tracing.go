@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"webhook_test_server/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var tracer = otel.Tracer("webhook_test_server/handler")
+
+// decodeEvent unmarshals an event body into target, tracing the time spent decoding
+func decodeEvent(ctx context.Context, body []byte, target interface{}) error {
+	_, span := tracer.Start(ctx, "decode")
+	span.SetAttributes(attribute.Int("webhook.body_size", len(body)))
+	err := json.Unmarshal(body, target)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+// validateEvent validates a decoded event, tracing the time spent validating
+func validateEvent(ctx context.Context, data interface{}) error {
+	_, span := tracer.Start(ctx, "validate")
+	err := validateByType(data)
+	tracing.EndSpan(span, err)
+	return err
+}
@@ -1,17 +1,26 @@
 package handler
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"mime"
 	"net/http"
+	"time"
 
+	"webhook_test_server/ingest"
+	"webhook_test_server/metrics"
 	"webhook_test_server/model"
 	"webhook_test_server/persistent"
+	"webhook_test_server/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func (h *WebhookHandler) WebhookEvents(w http.ResponseWriter, r *http.Request) error {
+func (h *WebhookHandler) WebhookEvents(w http.ResponseWriter, r *http.Request) (err error) {
+	ctx, span := tracer.Start(r.Context(), "WebhookEvents")
+	defer func() { tracing.EndSpan(span, err) }()
+
 	handlerName := "WebhookEvents"
 	startTime, method, url := logRequestStart(r, handlerName)
 	if r.Method != http.MethodPost {
@@ -24,37 +33,110 @@ func (h *WebhookHandler) WebhookEvents(w http.ResponseWriter, r *http.Request) e
 		return NewAPIError(http.StatusBadRequest, err, "Invalid merchant ID format.")
 	}
 
-	//Read the request body into a byte slice
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return NewAPIError(http.StatusInternalServerError, err, "Error reading request body")
+	if err := checkContentType(r); err != nil {
+		return err
 	}
 
-	defer r.Body.Close() // Close the body after reading
+	//Read the request body into a byte slice, decoding any Content-Encoding
+	raw, body, err := h.readBody(w, r)
+	if err != nil {
+		return err
+	}
 	// Log the raw JSON body
 	log.Printf("Received body: %s", body)
 
+	// CloudEvents are unwrapped into the $type envelope the event handlers decode
+	opts := model.EventOptions{Delivery: deliveryInfo(r, raw, body)}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == cloudEventsBatchJSON {
+		items, err := h.cloudEventBatch(body)
+		if err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Invalid CloudEvents batch")
+		}
+		return h.bulkEvents(ctx, w, marketplace, items, opts)
+	}
+	ce, data, err := parseCloudEvent(r.Header, body)
+	if err != nil {
+		return NewAPIError(http.StatusBadRequest, err, "Invalid CloudEvent")
+	}
+	if ce != nil {
+		if body, err = h.cloudEventBody(ce, data); err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Invalid CloudEvent")
+		}
+		opts.CloudEvent = ce
+		span.SetAttributes(attribute.String("cloudevents.event_id", ce.ID), attribute.String("cloudevents.event_source", ce.Source))
+	} else {
+		// JSON array and NDJSON bodies carry several events, each dispatched individually
+		items, bulk, err := splitBulkBody(body, r.Header.Get("Content-Type"))
+		if err != nil {
+			return NewAPIError(http.StatusBadRequest, err, "Failed to decode JSON:")
+		}
+		if bulk {
+			return h.bulkEvents(ctx, w, marketplace, bulkItems(items), opts)
+		}
+	}
+
 	//Decode the JSON into a generic map to identify the event type
 	var event model.EventTypeHolder
-	if err := json.Unmarshal(body, &event); err != nil {
+	if err := decodeEvent(ctx, body, &event); err != nil {
+		metrics.EventReceived(marketplace, "")
+		metrics.EventProcessed(marketplace, "", metrics.OutcomeRejected)
 		return NewAPIError(http.StatusBadRequest, err, "Failed to decode JSON:")
 	}
 
 	log.Printf("Received event type: %s", event.Type)
+	span.SetAttributes(attribute.String("webhook.merchant", marketplace), attribute.String("webhook.event_type", event.Type))
 
-	handler, found := h.eventHandlers[event.Type]
+	handler, found := h.eventHandler(event.Type)
 
 	if !found {
 		log.Printf("No handler found for event type: %s", event.Type)
-		return NewAPIError(http.StatusBadRequest, err, fmt.Sprintf("Unhandled event type: %s", event.Type))
+		metrics.EventReceived(marketplace, metrics.UnknownEventType)
+		metrics.EventProcessed(marketplace, metrics.UnknownEventType, metrics.OutcomeUnknown)
+		return NewAPIError(http.StatusBadRequest, fmt.Errorf("unhandled event type: %s", event.Type), fmt.Sprintf("Unhandled event type: %s", event.Type))
 	}
+	metrics.EventReceived(marketplace, event.Type)
 
-	// Handle the event
-	if err := handler(marketplace, body); err != nil {
-		logRequestEnd(startTime, method, url, handlerName, http.StatusInternalServerError)
+	// Decode and validate the event
+	handlerCtx, handlerSpan := tracer.Start(ctx, "handle "+event.Type)
+	store, err := handler(handlerCtx, marketplace, body, opts)
+	if err != nil {
+		tracing.EndSpan(handlerSpan, err)
+		metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeRejected)
+		logRequestEnd(startTime, method, url, handlerName, http.StatusBadRequest)
 		return NewAPIError(http.StatusBadRequest, err, "Failed to handle event")
 	}
 
+	// In async mode the event is acknowledged once queued and persisted by the ingest workers
+	if h.queue != nil {
+		err = h.queue.Enqueue(ingest.Job{Merchant: marketplace, Type: event.Type, Body: body, ReceivedAt: time.Now(), CloudEvent: opts.CloudEvent, Bin: jobBin(ctx), Delivery: opts.Delivery})
+		tracing.EndSpan(handlerSpan, err)
+		if err != nil {
+			metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeRejected)
+			logRequestEnd(startTime, method, url, handlerName, http.StatusServiceUnavailable)
+			if errors.Is(err, ingest.ErrQueueFull) || errors.Is(err, ingest.ErrQueueClosed) {
+				w.Header().Set("Retry-After", "1")
+				return NewAPIError(http.StatusServiceUnavailable, err, "Event queue is not accepting events, retry later")
+			}
+			return NewAPIError(http.StatusInternalServerError, err, "Failed to queue event")
+		}
+		metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeAccepted)
+		logRequestEnd(startTime, method, url, handlerName, http.StatusAccepted)
+		writeJSON(w, http.StatusAccepted, map[string]string{"message": "Accepted"})
+		return nil
+	}
+
+	// Store the event
+	storeCtx, cancel := h.dbContext(handlerCtx)
+	err = store(storeCtx)
+	cancel()
+	tracing.EndSpan(handlerSpan, err)
+	if err != nil {
+		metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeRejected)
+		logRequestEnd(startTime, method, url, handlerName, http.StatusInternalServerError)
+		return NewAPIError(http.StatusInternalServerError, err, "Failed to store event")
+	}
+	metrics.EventProcessed(marketplace, event.Type, metrics.OutcomeAccepted)
+
 	// Log success and write the response
 	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
 	writeJSON(w, http.StatusOK, map[string]string{"message": "Success"})
@@ -92,13 +174,17 @@ func (h *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) e
 	pKey := "PK#MerchantId:" + id
 
 	// Ensure the table exists or create if it does not exist
-	if err := h.db.CreateTableIfNotExists(tableName); err != nil {
+	createCtx, cancelCreate := h.dbContext(r.Context())
+	defer cancelCreate()
+	if err := h.db.CreateTableIfNotExists(createCtx, tableName); err != nil {
 		log.Printf("Error ensuring table exists: %v", err)
 		return NewAPIError(http.StatusInternalServerError, err, "Database table creation failed.")
 	}
 
 	// Store the data in the database
-	if err := h.db.StoreData(tableName, pKey, data); err != nil {
+	storeCtx, cancelStore := h.dbContext(r.Context())
+	defer cancelStore()
+	if err := h.db.StoreData(storeCtx, tableName, pKey, data); err != nil {
 		return NewAPIError(http.StatusInternalServerError, err, "Failed to store data.")
 	}
 
@@ -122,35 +208,43 @@ func (h *WebhookHandler) GetOrderEventsByPK(w http.ResponseWriter, r *http.Reque
 	if merchantId == "" || externalOrderId == "" {
 		return NewAPIError(http.StatusBadRequest, fmt.Errorf("missing merchantId or externalOrderId parameter"), "Missing merchantId or externalOrderId parameter")
 	}
+	if err := checkKeyParams(r, "merchantId", "externalOrderId"); err != nil {
+		return err
+	}
 
 	// Construct the primary key
 	pk := fmt.Sprintf("#PK#%s#%s", merchantId, externalOrderId)
 
 	// Fetch data based on primary key without requiring SK
-	tableName := h.tableNames[0]
-	result, err := h.db.FetchByPrimaryKey(tableName, pk)
+	tableName, err := h.table(persistent.RoleOrders)
+	if err != nil {
+		return err
+	}
+	queryCtx, err := h.queryContext(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := h.dbContext(queryCtx)
+	defer cancel()
+	query, err := eventQuery(r, model.EventQuery{PK: pk})
+	if err != nil {
+		return err
+	}
+	page, err := h.db.QueryEvents(ctx, tableName, query)
 	if err != nil {
 		return NewAPIError(http.StatusBadRequest, err, "Failed to fetch order events:")
 	}
 
 	// Check if items were found
-	if len(result.Items) == 0 {
+	if len(page.Events) == 0 && page.NextCursor == "" {
 		http.Error(w, "Order events not found", http.StatusNotFound)
 		return NewAPIError(http.StatusNotFound, fmt.Errorf("order event Not found for PK : %s", pk), "Order events not found")
 	}
 
-	// Convert DynamoDB items to OrderEvent structs
-	var orderEvents []persistent.OrderEvent
-	for _, item := range result.Items {
-		event, err := persistent.ConvertDynamoItemToOrderEvent(item)
-		if err != nil {
-			return NewAPIError(http.StatusInternalServerError, err, "Failed to parse order event")
-		}
-		orderEvents = append(orderEvents, event)
-	}
-
 	// Write the result to the response
-	writeJSON(w, http.StatusOK, orderEvents)
+	if err := writeEventPage(w, r, page.Events, page.NextCursor); err != nil {
+		return err
+	}
 	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
 
 	return nil
@@ -169,31 +263,49 @@ func (h *WebhookHandler) GetOrderByExternalID(w http.ResponseWriter, r *http.Req
 	if externalOrderId == "" {
 		return NewAPIError(http.StatusBadRequest, fmt.Errorf("missing externalOrderId parameter"), "Missing externalOrderId parameter")
 	}
+	if err := checkKeyParams(r, "externalOrderId"); err != nil {
+		return err
+	}
 
 	// Fetch data based on primary key without requiring SK
-	tableName := h.tableNames[0]
-	result, err := h.db.QueryOrderEventsByExternalOrderId(tableName, externalOrderId)
+	tableName, err := h.table(persistent.RoleOrders)
 	if err != nil {
-		return NewAPIError(http.StatusBadRequest, err, "Failed to fetch order events: by external order Id")
+		return err
 	}
-
-	// Check if items were found
-	if len(result.Items) == 0 {
-		return NewAPIError(http.StatusNotFound, fmt.Errorf("order event Not found for PK : %s", externalOrderId), "Order events not found")
+	queryCtx, err := h.queryContext(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := h.dbContext(queryCtx)
+	defer cancel()
+	query, err := eventQuery(r, model.EventQuery{ExternalOrderID: externalOrderId})
+	if err != nil {
+		return err
+	}
+	page, err := h.db.QueryEvents(ctx, tableName, query)
+	if err != nil {
+		return NewAPIError(http.StatusBadRequest, err, "Failed to fetch order events: by external order Id")
 	}
 
-	// Convert DynamoDB items to OrderEvent structs
-	var orderEvents []persistent.OrderEvent
-	for _, item := range result.Items {
-		event, err := persistent.ConvertDynamoItemToOrderEvent(item)
-		if err != nil {
-			return NewAPIError(http.StatusInternalServerError, err, "Failed to parse order event")
+	// Leave out merchants the API key may not read
+	key := requestAPIKey(r.Context())
+	orderEvents := make([]model.StoredEvent, 0, len(page.Events))
+	for _, event := range page.Events {
+		if key != nil && !key.AllowsMerchant(orderEventMerchant(event)) {
+			continue
 		}
 		orderEvents = append(orderEvents, event)
 	}
 
+	// Check if items were found
+	if len(orderEvents) == 0 && page.NextCursor == "" {
+		return NewAPIError(http.StatusNotFound, fmt.Errorf("order event Not found for PK : %s", externalOrderId), "Order events not found")
+	}
+
 	// Write the result to the response
-	writeJSON(w, http.StatusOK, orderEvents)
+	if err := writeEventPage(w, r, orderEvents, page.NextCursor); err != nil {
+		return err
+	}
 	logRequestEnd(startTime, method, url, handlerName, http.StatusOK)
 
 	return nil
@@ -0,0 +1,150 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webhook_test_server/handler"
+	"webhook_test_server/ingest"
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+	"webhook_test_server/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// TestMetricsEndpoint checks that processed webhook events are exposed on /metrics
+func TestMetricsEndpoint(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "METRICS", "metrics-order-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{}).Return(nil)
+
+	metrics.SetMerchants([]string{"METRICS"})
+	defer metrics.SetMerchants(nil)
+	h := handler.NewWebhookHandler(db, tables)
+	req := httptest.NewRequest("POST", "/METRICS", bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "metrics-order-1")))
+	w := httptest.NewRecorder()
+	handler.Make(h.WebhookEvents)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Merchants outside the allow-list and unhandled types are not labelled with request input
+	req = httptest.NewRequest("POST", "/METRICS-UNLISTED", bytes.NewReader([]byte(`{"$type": "made-up/type-1"}`)))
+	w = httptest.NewRecorder()
+	handler.Make(h.WebhookEvents)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Non-standard methods share one label value
+	metrics.InstrumentRoute("/metrics-test", func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("MADE-UP-METHOD", "/metrics-test", nil))
+
+	w = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, `webhook_events_received_total{merchant="METRICS",type="order-line/shipping-deleted"} 1`)
+	assert.Contains(t, body, `webhook_events_processed_total{merchant="METRICS",outcome="accepted",type="order-line/shipping-deleted"} 1`)
+	assert.Contains(t, body, `webhook_events_processed_total{merchant="other",outcome="unknown",type="unknown"}`)
+	assert.NotContains(t, body, "METRICS-UNLISTED")
+	assert.NotContains(t, body, "made-up/type-1")
+	assert.Contains(t, body, `http_request_duration_seconds_count{code="200",method="other",route="/metrics-test"} 1`)
+	assert.NotContains(t, body, "MADE-UP-METHOD")
+
+	db.AssertExpectations(t)
+}
+
+// TestTraceparentPropagation checks that spans continue the sender's W3C trace
+func TestTraceparentPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(tracenoop.NewTracerProvider())
+	if _, err := tracing.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	db := new(persistenttest.MockDB)
+	db.On("DescribeTable", "EventWebhook").Return(nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+
+	req := httptest.NewRequest("GET", "/dbhealth", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.Make(h.DBHealthHandler)(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+	}
+}
+
+// slowDB never completes order writes before the operation deadline
+type slowDB struct {
+	persistenttest.MockDB
+}
+
+func (s *slowDB) StoreEvent(ctx context.Context, tableName string, record persistent.EventRecord, opts model.EventOptions) error {
+	<-ctx.Done()
+	return fmt.Errorf("failed to put item: %w", ctx.Err())
+}
+
+// TestWebhookEventsDBTimeout checks that a database deadline is reported as 504
+func TestWebhookEventsDBTimeout(t *testing.T) {
+	db := new(slowDB)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"}, handler.WithDBTimeout(10*time.Millisecond))
+
+	assert.Equal(t, http.StatusGatewayTimeout, deliver(h, persistenttest.ShippingDeletedEvent(t, "timeout-order-1")).Code)
+}
+
+// TestWebhookEventsAsync checks that async mode acknowledges with 202 and persists in the background
+func TestWebhookEventsAsync(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "async-order-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{}).Return(nil).Once()
+
+	queue, err := ingest.Open(ingest.Config{QueueSize: 10, Workers: 2, WALPath: filepath.Join(t.TempDir(), "ingest.wal")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler.NewWebhookHandler(db, tables, handler.WithQueue(queue))
+	queue.Start(h.ProcessJob)
+
+	assert.Equal(t, http.StatusAccepted, deliver(h, persistenttest.ShippingDeletedEvent(t, "async-order-1")).Code)
+
+	if err := h.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, queue.Stats().WALPending)
+	db.AssertExpectations(t)
+}
+
+// TestWebhookEventsRecordsClientCertSubject checks that the subject of a verified client certificate is stored with the event
+func TestWebhookEventsRecordsClientCertSubject(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	delivery := &model.Delivery{ClientCertSubject: "CN=partner,O=Example"}
+	db.On("StoreEvent", "EventWebhook", persistenttest.OrderEventRecord("order-line/shipping-deleted", "BIGW", "mtls-1", "2024-05-03T03:48:13.506Z"), model.EventOptions{Delivery: delivery}).Return(nil)
+	h := handler.NewWebhookHandler(db, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "partner", Organization: []string{"Example"}}}
+	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(persistenttest.ShippingDeletedEvent(t, "mtls-1")))
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	w := httptest.NewRecorder()
+	handler.Make(h.WebhookEvents)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	db.AssertExpectations(t)
+}
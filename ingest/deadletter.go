@@ -0,0 +1,87 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// deadLetter is a single line of the dead-letter file: a job that could not be persisted
+type deadLetter struct {
+	Job      Job       `json:"job"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// deadLetters is an append-only JSON lines file of jobs that failed permanently after being
+// acknowledged, kept so they can be inspected and redelivered by hand
+type deadLetters struct {
+	mu    sync.Mutex
+	f     *os.File
+	count int
+}
+
+// openDeadLetters opens the dead-letter file at path, counting the jobs it already holds
+func openDeadLetters(path string) (*deadLetters, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %w", err)
+	}
+	d := &deadLetters{}
+	existing, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			d.count++
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read dead-letter file: %w", err)
+		}
+	}
+	d.f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	return d, nil
+}
+
+// add durably records a job that failed with err
+func (d *deadLetters) add(job Job, err error) error {
+	line, jsonErr := json.Marshal(deadLetter{Job: job, Error: err.Error(), FailedAt: time.Now().UTC()})
+	if jsonErr != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", jsonErr)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := d.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dead-letter file: %w", err)
+	}
+	d.count++
+	return nil
+}
+
+// size returns the number of jobs in the dead-letter file
+func (d *deadLetters) size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+func (d *deadLetters) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
@@ -0,0 +1,318 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue is at capacity
+	ErrQueueFull = errors.New("ingest queue is full")
+	// ErrQueueClosed is returned by Enqueue once Shutdown has been called
+	ErrQueueClosed = errors.New("ingest queue is closed")
+)
+
+// Job is a webhook event accepted for asynchronous persistence
+type Job struct {
+	Seq        uint64          `json:"seq"`
+	Merchant   string          `json:"merchant"`
+	Type       string          `json:"type"`
+	Body       json.RawMessage `json:"body"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	// CloudEvent is the CloudEvents context of an event received as a CloudEvent
+	CloudEvent *model.CloudEventAttributes `json:"cloudEvent,omitempty"`
+	// Bin is the bin the event was delivered to, if any
+	Bin *model.BinScope `json:"bin,omitempty"`
+	// Delivery describes how the event reached the server
+	Delivery *model.Delivery `json:"delivery,omitempty"`
+}
+
+// ProcessFunc persists a single job
+type ProcessFunc func(ctx context.Context, job Job) error
+
+// Config controls the queue size, worker pool and retry behaviour
+type Config struct {
+	QueueSize      int
+	Workers        int
+	WALPath        string
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retryable reports whether a failed job should be retried, e.g. on DynamoDB throttling
+	Retryable func(error) bool
+	// DeadLetterPath is the file jobs are moved to once they fail permanently; without it they stay in
+	// the WAL and are retried on the next start
+	DeadLetterPath string
+}
+
+// Stats is a snapshot of the queue for health reporting
+type Stats struct {
+	Depth      int `json:"depth"`
+	Capacity   int `json:"capacity"`
+	InFlight   int `json:"inFlight"`
+	Workers    int `json:"workers"`
+	WALPending int `json:"walPending"`
+	// DeadLetters is the number of acknowledged jobs that failed permanently, in the dead-letter file or kept in the WAL
+	DeadLetters int `json:"deadLetters"`
+}
+
+// Queue is a bounded in-process queue of accepted webhook events, persisted by a worker pool
+type Queue struct {
+	cfg         Config
+	jobs        chan Job
+	wal         *wal
+	deadLetters *deadLetters
+
+	mu      sync.Mutex
+	closed  bool
+	nextSeq uint64
+	// reserved counts the queue slots held by enqueues waiting for the WAL sync
+	reserved  int
+	enqueuing sync.WaitGroup
+	// failed counts the jobs kept in the WAL after failing permanently, without a dead-letter file
+	failed atomic.Int64
+
+	inFlight atomic.Int64
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// Open creates the queue and, when a WAL path is configured, replays jobs that were
+// accepted but not persisted before the last shutdown or crash.
+func Open(cfg Config) (*Queue, error) {
+	if cfg.QueueSize <= 0 || cfg.Workers <= 0 {
+		return nil, fmt.Errorf("ingest queue size and workers must be positive, got %d and %d", cfg.QueueSize, cfg.Workers)
+	}
+	if cfg.Retryable == nil {
+		cfg.Retryable = func(error) bool { return false }
+	}
+
+	var replayed []Job
+	q := &Queue{cfg: cfg}
+	if cfg.WALPath != "" {
+		var err error
+		q.wal, replayed, err = openWAL(cfg.WALPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Replayed %d pending jobs from WAL %s", len(replayed), cfg.WALPath)
+	}
+	if cfg.DeadLetterPath != "" {
+		var err error
+		if q.deadLetters, err = openDeadLetters(cfg.DeadLetterPath); err != nil {
+			if q.wal != nil {
+				q.wal.close()
+			}
+			return nil, err
+		}
+		if n := q.deadLetters.size(); n > 0 {
+			log.Printf("Dead-letter file %s holds %d failed jobs", cfg.DeadLetterPath, n)
+		}
+	}
+
+	// Replayed jobs are always re-queued, even if there are more of them than the configured size
+	q.jobs = make(chan Job, max(cfg.QueueSize, len(replayed)))
+	for _, job := range replayed {
+		q.jobs <- job
+		q.nextSeq = max(q.nextSeq, job.Seq)
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q, nil
+}
+
+// Start launches the worker pool
+func (q *Queue) Start(process ProcessFunc) {
+	metrics.RegisterQueue("ingest", func() int { return len(q.jobs) })
+	metrics.RegisterQueue("ingest_dead_letter", func() int { return q.Stats().DeadLetters })
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker(process)
+	}
+	log.Printf("Started %d ingest workers with queue size %d", q.cfg.Workers, q.cfg.QueueSize)
+}
+
+// Enqueue records the job in the WAL and queues it for persistence. The WAL is synced outside the
+// queue lock, so concurrent enqueues share an fsync.
+func (q *Queue) Enqueue(job Job) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	if len(q.jobs)+q.reserved >= q.cfg.QueueSize {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.nextSeq++
+	job.Seq = q.nextSeq
+	if q.wal == nil {
+		q.jobs <- job
+		q.mu.Unlock()
+		return nil
+	}
+	// Appending under the lock keeps the WAL in sequence order
+	if err := q.wal.append(job); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	q.reserved++
+	q.enqueuing.Add(1)
+	q.mu.Unlock()
+	defer q.enqueuing.Done()
+
+	err := q.wal.sync(job.Seq)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved--
+	if err != nil {
+		// The job is not acknowledged, so it must not be replayed either
+		q.wal.done(job.Seq)
+		return err
+	}
+	// Shutdown waits for pending enqueues before closing the channel, and the slot was reserved
+	q.jobs <- job
+	return nil
+}
+
+// Stats returns the current queue depth and worker activity
+func (q *Queue) Stats() Stats {
+	stats := Stats{
+		Depth:    len(q.jobs),
+		Capacity: q.cfg.QueueSize,
+		InFlight: int(q.inFlight.Load()),
+		Workers:  q.cfg.Workers,
+	}
+	if q.wal != nil {
+		stats.WALPending = q.wal.size()
+	}
+	stats.DeadLetters = int(q.failed.Load())
+	if q.deadLetters != nil {
+		stats.DeadLetters += q.deadLetters.size()
+	}
+	return stats
+}
+
+// Shutdown stops accepting jobs and waits for the workers to drain the queue.
+// If ctx expires first, in-flight work is cancelled and unfinished jobs stay in
+// the WAL to be replayed on the next start.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	wasClosed := q.closed
+	q.closed = true
+	q.mu.Unlock()
+	if !wasClosed {
+		q.enqueuing.Wait()
+		close(q.jobs)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("Ingest queue drain timed out with %d jobs left, cancelling", len(q.jobs))
+		q.cancel()
+		<-drained
+		err = ctx.Err()
+	}
+	q.cancel()
+
+	if q.wal != nil {
+		if closeErr := q.wal.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if q.deadLetters != nil {
+		if closeErr := q.deadLetters.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (q *Queue) worker(process ProcessFunc) {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.inFlight.Add(1)
+		err := q.processWithRetry(process, job)
+		q.inFlight.Add(-1)
+
+		if q.ctx.Err() != nil {
+			// Cancelled by a forced shutdown: keep the job in the WAL for replay
+			metrics.IngestJob(metrics.IngestAbandoned)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to persist %s event %d for merchant %s: %v", job.Type, job.Seq, job.Merchant, err)
+			metrics.IngestJob(metrics.IngestFailed)
+			if !q.deadLetter(job, err) {
+				continue
+			}
+		} else {
+			metrics.IngestJob(metrics.IngestStored)
+		}
+		if q.wal != nil {
+			q.wal.done(job.Seq)
+		}
+	}
+}
+
+// deadLetter moves a job that failed permanently to the dead-letter file, reporting whether it may be
+// removed from the WAL. Without a dead-letter file, or when writing to it fails, the job stays in the
+// WAL, so an acknowledged event is never dropped.
+func (q *Queue) deadLetter(job Job, err error) bool {
+	if q.deadLetters == nil {
+		q.failed.Add(1)
+		if q.wal != nil {
+			log.Printf("Keeping failed %s event %d in the WAL for the next start", job.Type, job.Seq)
+		}
+		return false
+	}
+	if dlErr := q.deadLetters.add(job, err); dlErr != nil {
+		log.Printf("Keeping failed %s event %d in the WAL: %v", job.Type, job.Seq, dlErr)
+		q.failed.Add(1)
+		return false
+	}
+	log.Printf("Moved failed %s event %d to the dead-letter file %s", job.Type, job.Seq, q.cfg.DeadLetterPath)
+	return true
+}
+
+// processWithRetry runs process, retrying retryable errors with capped exponential backoff and full jitter
+func (q *Queue) processWithRetry(process ProcessFunc, job Job) error {
+	for attempt := 0; ; attempt++ {
+		err := process(q.ctx, job)
+		if err == nil || !q.cfg.Retryable(err) || attempt >= q.cfg.MaxRetries {
+			return err
+		}
+
+		backoff := q.cfg.InitialBackoff << attempt
+		if backoff <= 0 || backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Printf("Retrying %s event %d in %s after attempt %d: %v", job.Type, job.Seq, wait, attempt+1, err)
+		metrics.IngestJob(metrics.IngestRetried)
+
+		select {
+		case <-time.After(wait):
+		case <-q.ctx.Done():
+			return q.ctx.Err()
+		}
+	}
+}
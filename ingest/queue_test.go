@@ -0,0 +1,117 @@
+package ingest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"webhook_test_server/ingest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIngestQueueReplaysWAL checks that events accepted before a shutdown are replayed on the next start
+func TestIngestQueueReplaysWAL(t *testing.T) {
+	cfg := ingest.Config{QueueSize: 1, Workers: 1, WALPath: filepath.Join(t.TempDir(), "ingest.wal")}
+	queue, err := ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, queue.Enqueue(ingest.Job{Merchant: "BIGW", Type: "order/created", Body: json.RawMessage(`{}`)}))
+	assert.ErrorIs(t, queue.Enqueue(ingest.Job{Merchant: "BIGW", Type: "order/created", Body: json.RawMessage(`{}`)}), ingest.ErrQueueFull)
+
+	// Simulate a crash: the job was never processed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue.Shutdown(ctx)
+
+	replayed, err := ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, replayed.Stats().Depth)
+	assert.Equal(t, 1, replayed.Stats().WALPending)
+
+	processed := make(chan ingest.Job, 1)
+	replayed.Start(func(ctx context.Context, job ingest.Job) error {
+		processed <- job
+		return nil
+	})
+	assert.NoError(t, replayed.Shutdown(context.Background()))
+	job := <-processed
+	assert.Equal(t, "order/created", job.Type)
+	assert.Equal(t, 0, replayed.Stats().WALPending)
+}
+
+// TestIngestQueueDeadLetters checks that a job failing permanently is moved to the dead-letter file, or
+// kept in the WAL for the next start when there is none
+func TestIngestQueueDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	failing := func(ctx context.Context, job ingest.Job) error { return errors.New("validation failed") }
+
+	cfg := ingest.Config{QueueSize: 4, Workers: 1, WALPath: filepath.Join(dir, "kept.wal")}
+	queue, err := ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Start(failing)
+	assert.NoError(t, queue.Enqueue(ingest.Job{Merchant: "BIGW", Type: "order/created", Body: json.RawMessage(`{}`)}))
+	assert.NoError(t, queue.Shutdown(context.Background()))
+	assert.Equal(t, 1, queue.Stats().WALPending)
+	assert.Equal(t, 1, queue.Stats().DeadLetters)
+
+	cfg = ingest.Config{QueueSize: 4, Workers: 1, WALPath: filepath.Join(dir, "moved.wal"), DeadLetterPath: filepath.Join(dir, "dead.jsonl")}
+	queue, err = ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Start(failing)
+	assert.NoError(t, queue.Enqueue(ingest.Job{Merchant: "BIGW", Type: "order/created", Body: json.RawMessage(`{}`)}))
+	assert.NoError(t, queue.Shutdown(context.Background()))
+	assert.Equal(t, 0, queue.Stats().WALPending)
+	assert.Equal(t, 1, queue.Stats().DeadLetters)
+	dead, err := os.ReadFile(cfg.DeadLetterPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(dead), `"error":"validation failed"`)
+
+	// The dead letters are counted again on the next start
+	queue, err = ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, queue.Stats().DeadLetters)
+	assert.NoError(t, queue.Shutdown(context.Background()))
+}
+
+// TestIngestQueueConcurrentEnqueue checks that enqueues sharing WAL syncs are all queued and replayed
+func TestIngestQueueConcurrentEnqueue(t *testing.T) {
+	cfg := ingest.Config{QueueSize: 64, Workers: 1, WALPath: filepath.Join(t.TempDir(), "ingest.wal")}
+	queue, err := ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, queue.Enqueue(ingest.Job{Merchant: "BIGW", Type: "order/created", Body: json.RawMessage(`{}`)}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 32, queue.Stats().Depth)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue.Shutdown(ctx)
+	replayed, err := ingest.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 32, replayed.Stats().WALPending)
+	replayed.Shutdown(ctx)
+}
@@ -0,0 +1,199 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// walRecord is a single line of the write-ahead log. A "put" record holds a job
+// accepted into the queue and a "done" record marks that job as finished.
+type walRecord struct {
+	Op  string `json:"op"`
+	Job *Job   `json:"job,omitempty"`
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// wal is an append-only JSON lines file recording queued jobs until they are persisted.
+// It is truncated whenever no job is pending, so it only grows while the queue is busy.
+type wal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	pending map[uint64]struct{}
+	// written is the sequence number of the last job appended
+	written uint64
+
+	// syncMu serialises fsyncs; synced is the last job covered by one, so concurrent
+	// enqueues share a single fsync instead of queueing one each
+	syncMu sync.Mutex
+	synced uint64
+}
+
+// openWAL replays the log at path and returns the jobs that were never marked done,
+// in the order they were accepted. The log is rewritten to hold only those jobs.
+func openWAL(path string) (*wal, []Job, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	jobs, err := replayWAL(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Compact the log down to the pending jobs before appending to it again
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create WAL: %w", err)
+	}
+	w := &wal{path: path, f: tmp, pending: make(map[uint64]struct{}, len(jobs))}
+	for i := range jobs {
+		if err := w.write(walRecord{Op: "put", Job: &jobs[i]}); err != nil {
+			tmp.Close()
+			return nil, nil, err
+		}
+		w.pending[jobs[i].Seq] = struct{}{}
+		w.written = jobs[i].Seq
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, nil, fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	w.synced = w.written
+	tmp.Close()
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, nil, fmt.Errorf("failed to replace WAL: %w", err)
+	}
+
+	w.f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	return w, jobs, nil
+}
+
+// replayWAL reads the log at path and returns the jobs without a matching "done" record
+func replayWAL(path string) ([]Job, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL for replay: %w", err)
+	}
+	defer f.Close()
+
+	pending := make(map[uint64]Job)
+	reader := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record walRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				// A torn write from a crash can only affect the last line
+				log.Printf("Skipping unreadable WAL record at %s:%d: %v", path, lineNo, jsonErr)
+			} else if record.Op == "put" && record.Job != nil {
+				pending[record.Job.Seq] = *record.Job
+			} else if record.Op == "done" {
+				delete(pending, record.Seq)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WAL: %w", err)
+		}
+	}
+
+	jobs := make([]Job, 0, len(pending))
+	for _, job := range pending {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Seq < jobs[j].Seq })
+	return jobs, nil
+}
+
+// write appends a record to the log
+func (w *wal) write(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode WAL record: %w", err)
+	}
+	if _, err := w.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	return nil
+}
+
+// append records an accepted job; it is not durable until sync covers it
+func (w *wal) append(job Job) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.write(walRecord{Op: "put", Job: &job}); err != nil {
+		return err
+	}
+	w.pending[job.Seq] = struct{}{}
+	w.written = max(w.written, job.Seq)
+	return nil
+}
+
+// sync makes the job with sequence number seq, and every job appended before it, durable.
+// A caller whose job was covered by another caller's fsync returns without syncing again.
+func (w *wal) sync(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if w.synced >= seq {
+		return nil
+	}
+	w.mu.Lock()
+	written := w.written
+	w.mu.Unlock()
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	w.synced = written
+	return nil
+}
+
+// done marks a job as finished, truncating the log once nothing is pending.
+// Done records are not synced: losing one only means the job is persisted again after a crash.
+func (w *wal) done(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.pending, seq)
+	var err error
+	if len(w.pending) == 0 {
+		err = w.f.Truncate(0)
+	} else {
+		err = w.write(walRecord{Op: "done", Seq: seq})
+	}
+	if err != nil {
+		log.Printf("Failed to record completion of job %d in WAL: %v", seq, err)
+	}
+}
+
+// size returns the number of jobs recorded as pending
+func (w *wal) size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
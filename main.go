@@ -1,83 +1,232 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 
+	"webhook_test_server/chaos"
 	"webhook_test_server/handler"
+	"webhook_test_server/ingest"
+	"webhook_test_server/metrics"
 	"webhook_test_server/persistent"
-
-	"github.com/joho/godotenv"
+	"webhook_test_server/ratelimit"
+	"webhook_test_server/resilience"
+	"webhook_test_server/tracing"
 )
 
 func main() {
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+// run loads the configuration from args, prepares the tables and serves until the server is shut down
+func run(args []string) error {
+	cfg, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
 	}
+	view, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	log.Printf("Starting with configuration %s", view)
 
-	port := os.Getenv("SERVER_PORT")
-	log.Println("server listening on port: ", port)
+	ctx := context.Background()
 
-	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
-	region := os.Getenv("DYNAMODB_REGION")
-	log.Println("### MAIN LOCAL_DYNAMODB.", region)
-	log.Println("### MAIN LOCAL_DYNAMODB.", endpoint)
+	// Initialize tracing before anything that creates spans
+	shutdownTracing, err := tracing.Init(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(ctx); err != nil {
+			log.Printf("failed to shut down tracing: %v", err)
+		}
+	}()
+
+	// Data operations are retried by the resilience wrapper below, so the SDK sends each request once
+	connection := cfg.DynamoDB.Connection()
+	connection.DisableSDKRetries = true
+	dbOpts := []persistent.DatabaseOption{
+		persistent.WithConnection(connection),
+		persistent.WithTableDefinitions(cfg.DynamoDB.TableDefinitions),
+		persistent.WithMigrations(persistent.MigrationConfig{
+			PollInterval:  cfg.DynamoDB.Migrations.PollInterval,
+			Timeout:       cfg.DynamoDB.Migrations.Timeout,
+			DeleteIndexes: cfg.DynamoDB.Migrations.DeleteIndexes,
+		}),
+	}
+	// Optionally coalesce event writes into BatchWriteItem calls
+	if batch := cfg.DynamoDB.Batch; batch.Enabled {
+		dbOpts = append(dbOpts, persistent.WithBatchWrites(persistent.BatchConfig{
+			FlushSize:      batch.Size,
+			Linger:         batch.Linger,
+			MaxRetries:     batch.MaxRetries,
+			InitialBackoff: batch.InitialBackoff,
+			MaxBackoff:     batch.MaxBackoff,
+		}))
+	}
 
 	// Initialize the database
-	db, err := persistent.NewDatabase()
+	db, err := persistent.NewDatabase(ctx, dbOpts...)
 	if err != nil {
-		log.Fatalf("failed to initialize database: %v", err)
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer func() {
+		log.Println("Closing database connection")
+		db.Close()
+	}()
+
+	// With fault injection enabled database operations go through a fault injector controlled on /admin/chaos
+	var faults *chaos.Database
+	if cfg.Chaos.Enabled {
+		var chaosConfig chaos.Config
+		if path := cfg.Chaos.ConfigPath; path != "" {
+			if chaosConfig, err = chaos.LoadConfig(path); err != nil {
+				return fmt.Errorf("invalid fault config: %w", err)
+			}
+		}
+		faults = chaos.Wrap(db, chaosConfig)
+		db = faults
+		log.Printf("Fault injection available on /admin/chaos (enabled=%t, %d rules)", chaosConfig.Enabled, len(chaosConfig.Rules))
 	}
-	defer db.Close()
 
-	// Define the environment variable keys
-	envVars := []string{
-		"DYNAMODB_ORDER_TABLE_NAME",
-		"DYNAMODB_PRODUCT_TABLE_NAME",
+	// Data operations are retried with backoff and guarded by a circuit breaker, outside any injected faults
+	retry := cfg.DynamoDB.Retry
+	resilient := resilience.Wrap(db, resilience.Config{
+		MaxAttempts:     retry.MaxAttempts,
+		InitialBackoff:  retry.InitialBackoff,
+		MaxBackoff:      retry.MaxBackoff,
+		BreakerFailures: retry.BreakerFailures,
+		BreakerCooldown: retry.BreakerCooldown,
+	})
+	db = resilient
+
+	tables := cfg.Tables()
+	for _, role := range tables.Roles() {
+		log.Printf("Loaded %s table name: %s", role, tables[role])
 	}
 
-	// Load the table names from environment variables
-	tableNames := LoadTableNames(envVars...)
+	// A migration plan only reports how the tables differ from their definitions
+	if cfg.DynamoDB.Migrations.Mode == "plan" {
+		changes, err := db.MigrateTables(ctx, tables, true)
+		if err != nil {
+			return fmt.Errorf("failed to plan table migrations: %w", err)
+		}
+		if len(changes) == 0 {
+			log.Printf("Tables match their definitions, nothing to migrate")
+		}
+		for _, change := range changes {
+			log.Printf("Planned migration: %s", change)
+		}
+		return nil
+	}
 
-	// Example usage: Print the loaded table names
-	for _, tableName := range tableNames {
-		log.Printf("Loaded table name: %s", tableName)
+	if err := db.InitializeTables(ctx, tables); err != nil {
+		return fmt.Errorf("failed to initialize tables %s: %w", tables.Names(), err)
 	}
-	if err := db.InitializeTables(tableNames); err != nil {
-		log.Fatalf("failed to initialize tables:%s: %v", tableNames, err)
+	// Existing tables gain the indexes and capacity added to the definitions since they were created
+	if cfg.DynamoDB.Migrations.Mode == "apply" {
+		if _, err := db.MigrateTables(ctx, tables, false); err != nil {
+			return fmt.Errorf("failed to migrate tables: %w", err)
+		}
 	}
 
 	// Create the webhook handler with the database dependency
-	webhookHandler := handler.NewWebhookHandler(db, tableNames)
-	handler.SetupRoutes(webhookHandler)
-
-	log.Printf("Server starting on port: %s", port)
-	err = http.ListenAndServe(":"+port, nil)
+	log.Printf("Database operation timeout: %s", cfg.DynamoDB.OperationTimeout)
+	bulkPolicy, err := handler.ParseBulkPolicy(cfg.Events.BulkPolicy)
 	if err != nil {
-		log.Fatalf("failed to start HTTP server %v", err)
+		return fmt.Errorf("invalid BULK_POLICY: %w", err)
+	}
+	opts := []handler.Option{
+		handler.WithDBTimeout(cfg.DynamoDB.OperationTimeout),
+		handler.WithReadiness(cfg.Readiness.StartupGracePeriod, cfg.Readiness.RefreshInterval),
+		handler.WithBulkPolicy(bulkPolicy),
+		handler.WithCloudEventTypes(cfg.Events.CloudEventTypes),
+		handler.WithDynamicTypesFile(cfg.Events.DynamicTypesPath),
+		handler.WithBinTTL(cfg.Bins.DefaultTTL, cfg.Bins.MaxTTL),
+		handler.WithMaxBodyBytes(cfg.Events.MaxBodyBytes),
+		handler.WithCircuitBreaker(resilient.Breaker()),
+		handler.WithConfigView(cfg.Redacted()),
 	}
 
-	if errors.Is(err, http.ErrServerClosed) {
-		log.Printf("server closed\n")
+	// Event routes come from the routing config when set, otherwise the built-in routes are used
+	if routesPath := cfg.Events.RoutesConfig; routesPath != "" {
+		if _, err := handler.LoadRoutes(routesPath); err != nil {
+			return fmt.Errorf("invalid routing config: %w", err)
+		}
+		opts = append(opts, handler.WithRoutesFile(routesPath))
+	}
+
+	// With authentication enabled every route except health checks and metrics requires an API key
+	if cfg.Auth.Enabled {
+		if err := db.CreateAPIKeysTableIfNotExists(ctx, cfg.Auth.APIKeysTable); err != nil {
+			return fmt.Errorf("failed to create API keys table %s: %w", cfg.Auth.APIKeysTable, err)
+		}
+		auditLog, err := handler.OpenAuditLog(cfg.Auth.AuditLogPath)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer auditLog.Close()
+		opts = append(opts, handler.WithAPIKeys(cfg.Auth.APIKeysTable, cfg.Auth.AdminAPIKey), handler.WithAuditSink(auditLog))
 	}
-}
 
-func LoadTableNames(envVars ...string) []string {
-	var tableNames []string
+	// Merchants outside the allow-list share the other label, so senders cannot add series at will
+	metrics.SetMerchants(cfg.Metrics.Merchants)
+
+	// Rate limits apply to webhook deliveries and can be changed at runtime through /admin/rate-limits
+	rateLimits, err := cfg.RateLimits.Limits()
+	if err != nil {
+		return fmt.Errorf("invalid rate limits: %w", err)
+	}
+	opts = append(opts, handler.WithRateLimiter(ratelimit.New(rateLimits)))
+	if faults != nil {
+		opts = append(opts, handler.WithFaultInjection(faults))
+	}
 
-	for _, envVar := range envVars {
-		tableName := os.Getenv(envVar)
-		if tableName != "" {
-			tableNames = append(tableNames, tableName)
+	// In async mode events are acknowledged with 202 and persisted by a worker pool
+	var queue *ingest.Queue
+	if cfg.Ingest.Mode == "async" {
+		queue, err = ingest.Open(ingest.Config{
+			QueueSize:      cfg.Ingest.QueueSize,
+			Workers:        cfg.Ingest.Workers,
+			WALPath:        cfg.Ingest.WALPath,
+			MaxRetries:     cfg.Ingest.MaxRetries,
+			InitialBackoff: cfg.Ingest.InitialBackoff,
+			MaxBackoff:     cfg.Ingest.MaxBackoff,
+			Retryable:      resilience.Retryable,
+			DeadLetterPath: cfg.Ingest.DeadLetterPath,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to open ingest queue: %w", err)
 		}
+		opts = append(opts, handler.WithQueue(queue))
 	}
 
-	if len(tableNames) == 0 {
-		log.Fatalf("No valid table names provided in environment variables")
+	webhookHandler := handler.NewWebhookHandler(db, tables, opts...)
+	if queue != nil {
+		queue.Start(webhookHandler.ProcessJob)
 	}
+	mux := http.NewServeMux()
+	handler.SetupRoutes(mux, webhookHandler)
 
-	return tableNames
+	server := NewServer(cfg.Server, mux)
+	if server.TLSConfig, err = NewTLSConfig(cfg.TLS); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	if err := Serve(server, webhookHandler, cfg.Server); err != nil {
+		return fmt.Errorf("failed to start HTTP server: %w", err)
+	}
+	log.Printf("server closed\n")
+	return nil
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,80 +11,22 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"webhook_test_server/handler"
 	"webhook_test_server/model"
 	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
-// Mock for the DatabaseInterface
-type MockDB struct {
-	mock.Mock
-}
-
-func (m *MockDB) ConnectToDatabase() error {
-	args := m.Called()
-	return args.Error(0)
-}
-
-func (m *MockDB) Close() {
-	m.Called()
-}
-
-func (m *MockDB) CreateTableIfNotExists(tableName string) error {
-	args := m.Called(tableName)
-	return args.Error(0)
-}
-
-func (m *MockDB) CreateEventsTableIfNotExist(config persistent.TableConfig) error {
-	args := m.Called(config)
-	return args.Error(0)
-}
-
-func (m *MockDB) StoreData(tableName, pKey string, data interface{}) error {
-	args := m.Called(tableName, pKey, data)
-	return args.Error(0)
-}
-
-func (m *MockDB) DescribeTable(tableName string) error {
-	args := m.Called(tableName)
-	return args.Error(0)
-}
-
-func (m *MockDB) InitializeTables(tableName []string) error {
-	args := m.Called(tableName)
-	return args.Error(0)
-}
-
-func (m *MockDB) StoreEventData(tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
-	args := m.Called(tableName, eventType, eventId, lastUpdated, merchantId, eventData, opts)
-	return args.Error(0)
-}
-
-func (m *MockDB) StoreOrderEventData(tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}) error {
-	args := m.Called(tableName, eventType, externalOrderId, lastUpdated, merchantId, eventData)
-	return args.Error(0)
-}
-func (m *MockDB) FetchByPrimaryKey(tableName, pk string) (*dynamodb.QueryOutput, error) {
-	args := m.Called(tableName, pk)
-	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
-}
-
-func (m *MockDB) FetchByGSI(tableName, gsiName string, keyConditions map[string]*dynamodb.Condition) (*dynamodb.QueryOutput, error) {
-	args := m.Called(tableName, gsiName, keyConditions)
-	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
-}
-
-func (m *MockDB) QueryOrderEventsByExternalOrderId(tableName, externalOrderId string) (*dynamodb.QueryOutput, error) {
-	args := m.Called(tableName, externalOrderId)
-	return args.Get(0).(*dynamodb.QueryOutput), args.Error(1)
-}
+// MockDB is the DatabaseInterface mock shared with the package tests
+type MockDB = persistenttest.MockDB
 
 // TestHandleWebhook tests the webhook handler function
 func TestHandleWebhook(t *testing.T) {
@@ -100,17 +44,17 @@ func TestHandleWebhook(t *testing.T) {
 		t.Fatal(err) // Handle errors with JSON marshaling
 	}
 
-	tableNames := []string{"My_Table"}
-	fmt.Println("TableName before mock setup:", tableNames[0])
+	tables := persistent.Tables{persistent.RoleOrders: "My_Table"}
+	fmt.Println("TableName before mock setup:", tables[persistent.RoleOrders])
 	// Setting up the expected call with mock for CreateTableIfNotExists
-	db.On("CreateTableIfNotExists", tableNames[0]).Return(nil)
+	db.On("CreateTableIfNotExists", tables[persistent.RoleOrders]).Return(nil)
 	// Setting up the expected call with mock
 	db.On("StoreData",
-		tableNames[0],
+		tables[persistent.RoleOrders],
 		"PK#MerchantId:45",
 		mock.AnythingOfType("model.UserMessageData")).Return(nil)
 
-	handler := handler.NewWebhookHandler(db, tableNames)
+	handler := handler.NewWebhookHandler(db, tables)
 
 	// Setting up a request
 	req := httptest.NewRequest("POST", "/45", bytes.NewReader(jsonData))
@@ -129,14 +73,14 @@ func TestHandleWebhook(t *testing.T) {
 	db.AssertExpectations(t)
 }
 
-// TestWebhookEvents tests the webhook handler function
+// TestWebhookVariantStockUpdateEvents checks that stock updates are stored in the products table, and
+// rejected as unhandled when no products table is configured
 func TestWebhookVariantStockUpdateEvents(t *testing.T) {
-	t.Skip()
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook", persistent.RoleProducts: "ProductWebhook"}
 
 	// Initialize the handler
-	handler := handler.NewWebhookHandler(db, tableNames)
+	webhooks := handler.NewWebhookHandler(db, tables)
 
 	// Setup a sample dynamic event for testing
 	variantStockUpdatedEvent := model.VariantStockUpdated{
@@ -146,7 +90,7 @@ func TestWebhookVariantStockUpdateEvents(t *testing.T) {
 			LastUpdated: "2024-05-07T01:47:00.138Z",
 		},
 		DealID:    "378397",
-		VariantID: nil,
+		VariantID: "1024",
 		Stock:     16,
 	}
 
@@ -157,14 +101,14 @@ func TestWebhookVariantStockUpdateEvents(t *testing.T) {
 	log.Printf("jsonData %s", jsonData)
 
 	// Mock expected database interactions
-	db.On("StoreEventData",
-		tableNames[0],
-		"variant/stock-updated",
-		"529c8a0d-4b85-495a-a54c-6031995d9c2a",
-		"2024-05-07T01:47:00.138Z",
-		"BIGW",
-		mock.Anything,
-		mock.AnythingOfType("model.EventOptions")).Return(nil)
+	db.On("StoreEvent",
+		tables[persistent.RoleProducts],
+		mock.MatchedBy(func(record persistent.EventRecord) bool {
+			return record.PK == "PKBIGW#variant/stock-updated#529c8a0d-4b85-495a-a54c-6031995d9c2a" &&
+				record.SK == "SK2024-05-07T01:47:00.138Z" &&
+				record.Attributes["DealId"] == "378397"
+		}),
+		model.EventOptions{}).Return(nil)
 
 	// Setup a HTTP request for POST method
 	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(jsonData))
@@ -172,7 +116,7 @@ func TestWebhookVariantStockUpdateEvents(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// Call the handler
-	handler.WebhookEvents(w, req)
+	handler.Make(webhooks.WebhookEvents)(w, req)
 
 	// Check the response
 	res := w.Result()
@@ -181,24 +125,25 @@ func TestWebhookVariantStockUpdateEvents(t *testing.T) {
 		t.Errorf("Expected status OK; got %v", res.StatusCode)
 	}
 
-	// Verify the body of the response
-	body, _ := io.ReadAll(res.Body)
-	expectedBody := "Success"
-	if string(body) != expectedBody {
-		t.Errorf("Expected body %s; got %s", expectedBody, string(body))
-	}
-
 	/// Check that the mock was called as expected
 	db.AssertExpectations(t)
+
+	// Without a products table the route is disabled rather than writing elsewhere
+	ordersOnly := new(MockDB)
+	h := handler.NewWebhookHandler(ordersOnly, persistent.Tables{persistent.RoleOrders: "EventWebhook"})
+	w = httptest.NewRecorder()
+	handler.Make(h.WebhookEvents)(w, httptest.NewRequest("POST", "/BIGW", bytes.NewReader(jsonData)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	ordersOnly.AssertNotCalled(t, "StoreEvent", mock.Anything, mock.Anything, mock.Anything)
 }
 
 // TestWebhookEvents tests the webhook handler function
 func TestWebhookOrderCreatedEvents(t *testing.T) {
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
 
 	// Initialize the handler
-	handler := handler.NewWebhookHandler(db, tableNames)
+	handler := handler.NewWebhookHandler(db, tables)
 
 	// Setup a sample dynamic event for testing
 	orderCreated := model.OrderCreated{
@@ -225,13 +170,7 @@ func TestWebhookOrderCreatedEvents(t *testing.T) {
 	log.Printf("jsonData %s", jsonData)
 
 	// Mock expected database interactions
-	db.On("StoreOrderEventData",
-		tableNames[0],
-		"order/created",
-		"auto-test-3aef291d-1bf0-41c3-9797-de544b1a41a2",
-		"2024-05-03T03:48:13.506Z",
-		"BIGW",
-		mock.Anything).Return(nil)
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order/created", "BIGW", "auto-test-3aef291d-1bf0-41c3-9797-de544b1a41a2", "2024-05-03T03:48:13.506Z"), model.EventOptions{}).Return(nil)
 
 	// Setup a HTTP request for POST method
 	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(jsonData))
@@ -268,10 +207,10 @@ func TestWebhookOrderCreatedEvents(t *testing.T) {
 // TestWebhookEvents tests the webhook handler function
 func TestWebhookOrderCreatedFailedEvents(t *testing.T) {
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
 
 	// Initialize the handler
-	handler := handler.NewWebhookHandler(db, tableNames)
+	handler := handler.NewWebhookHandler(db, tables)
 
 	// Setup a sample dynamic event for testing
 	orderCreated := model.OrderCreationFailed{
@@ -296,13 +235,7 @@ func TestWebhookOrderCreatedFailedEvents(t *testing.T) {
 	log.Printf("jsonData %s", jsonData)
 
 	// Mock expected database interactions
-	db.On("StoreOrderEventData",
-		tableNames[0],
-		"order/creation-failed",
-		"auto-test-3aef291d-1bf0-41c3-9797-we2322ew",
-		"2024-05-16T03:48:13.506Z",
-		"BIGW",
-		mock.Anything).Return(nil)
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order/creation-failed", "BIGW", "auto-test-3aef291d-1bf0-41c3-9797-we2322ew", "2024-05-16T03:48:13.506Z"), model.EventOptions{}).Return(nil)
 
 	// Setup a HTTP request for POST method
 	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(jsonData))
@@ -339,10 +272,10 @@ func TestWebhookOrderCreatedFailedEvents(t *testing.T) {
 // TestWebhookEvents tests the webhook handler function
 func TestWebhookOrderLineCancelledEvents(t *testing.T) {
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
 
 	// Initialize the handler
-	handler := handler.NewWebhookHandler(db, tableNames)
+	handler := handler.NewWebhookHandler(db, tables)
 
 	// Setup a sample dynamic event for testing
 	orderCreated := model.OrderLineCancelled{
@@ -372,13 +305,7 @@ func TestWebhookOrderLineCancelledEvents(t *testing.T) {
 	log.Printf("jsonData %s", jsonData)
 
 	// Mock expected database interactions
-	db.On("StoreOrderEventData",
-		tableNames[0],
-		"order-line/cancelled",
-		"auto-test-AUBW273415166_0",
-		"2024-05-15T03:48:13.506Z",
-		"BIGW",
-		mock.Anything).Return(nil)
+	db.On("StoreEvent", tables[persistent.RoleOrders], persistenttest.OrderEventRecord("order-line/cancelled", "BIGW", "auto-test-AUBW273415166_0", "2024-05-15T03:48:13.506Z"), model.EventOptions{}).Return(nil)
 
 	// Setup a HTTP request for POST method
 	req := httptest.NewRequest("POST", "/BIGW", bytes.NewReader(jsonData))
@@ -415,10 +342,10 @@ func TestWebhookOrderLineCancelledEvents(t *testing.T) {
 // TestDBHealthHandler tests the database health check endpoint
 func TestDBHealthHandlerOk(t *testing.T) {
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
-	db.On("DescribeTable", tableNames[0]).Return(nil) // Simulate a healthy database
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("DescribeTable", tables[persistent.RoleOrders]).Return(nil) // Simulate a healthy database
 
-	handler := handler.NewWebhookHandler(db, tableNames)
+	handler := handler.NewWebhookHandler(db, tables)
 	req := httptest.NewRequest("GET", "/dbhealth", nil)
 	w := httptest.NewRecorder()
 
@@ -435,10 +362,10 @@ func TestDBHealthHandlerOk(t *testing.T) {
 // TestDBHealthHandlerFail tests the scenario where the database is unhealthy
 func TestDBHealthHandlerFail(t *testing.T) {
 	db := new(MockDB)
-	tableNames := []string{"EventWebhook"}
-	db.On("DescribeTable", tableNames[0]).Return(errors.New("database error")) // Simulate an unhealthy database
+	tables := persistent.Tables{persistent.RoleOrders: "EventWebhook"}
+	db.On("DescribeTable", tables[persistent.RoleOrders]).Return(errors.New("database error")) // Simulate an unhealthy database
 
-	h := handler.NewWebhookHandler(db, tableNames)
+	h := handler.NewWebhookHandler(db, tables)
 	handlerFunc := handler.Make(h.DBHealthHandler)
 
 	req := httptest.NewRequest("GET", "/dbhealth", nil)
@@ -475,25 +402,165 @@ func TestFetchByPrimaryKey(t *testing.T) {
 	tableName := "OrderEvents"
 	pk := "#PK#BIGW#DB-Update1-770014-34f0-45b3-89b4-7b22fc4a43d1"
 
-	expectedOutput := &dynamodb.QueryOutput{
-		Items: []map[string]*dynamodb.AttributeValue{
+	expectedOutput := model.EventPage{
+		Events: []model.StoredEvent{
 			{
-				"PK": {S: aws.String(pk)},
+				PK: pk,
 				// Add other attributes as needed
 			},
 		},
 	}
 
-	mockDB.On("FetchByPrimaryKey", tableName, pk).Return(expectedOutput, nil)
+	mockDB.On("QueryEvents", tableName, model.EventQuery{PK: pk}).Return(expectedOutput, nil)
 
-	result, err := mockDB.FetchByPrimaryKey(tableName, pk)
+	result, err := mockDB.QueryEvents(context.Background(), tableName, model.EventQuery{PK: pk})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if len(result.Items) != 1 || *result.Items[0]["PK"].S != pk {
-		t.Fatalf("Expected item with PK %s, got %v", pk, result.Items)
+	if len(result.Events) != 1 || result.Events[0].PK != pk {
+		t.Fatalf("Expected item with PK %s, got %v", pk, result)
 	}
 
 	mockDB.AssertExpectations(t)
 }
+
+// TestTLSConfigDevCertificate checks that a development certificate is generated once, reused and
+// replaced once it expires
+func TestTLSConfigDevCertificate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	settings := DefaultConfig().TLS
+	settings.Enabled = true
+	settings.DevCertDir = dir
+	settings.MinVersion = "1.3"
+
+	config, err := NewTLSConfig(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+	assert.Len(t, config.Certificates, 1)
+	generated, err := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	assert.NoError(t, err)
+
+	config, err = NewTLSConfig(settings)
+	assert.NoError(t, err)
+	reused, err := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, generated, reused)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	// An expired certificate is replaced
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := writeDevCertificate(certFile, keyFile, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewTLSConfig(settings)
+	assert.NoError(t, err)
+	notAfter, err := certificateExpiry(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.True(t, notAfter.After(time.Now().Add(devCertRenewBefore)))
+
+	settings.MinVersion = "1.0"
+	_, err = NewTLSConfig(settings)
+	assert.Error(t, err)
+}
+
+// TestLoadConfig checks that flags override the environment, which overrides the config file, and that
+// invalid settings and secrets are reported by name and redacted
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	file := `
+server:
+  port: "9000"
+dynamodb:
+  orderTable: Orders
+  operationTimeout: 2s
+auth:
+  enabled: true
+  adminApiKey: s3cret
+events:
+  cloudEventTypes: {com.example.order.created: order/created}
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(dir, "missing.env")
+	t.Setenv("DYNAMODB_PRODUCT_TABLE_NAME", "Products")
+	t.Setenv("DB_OPERATION_TIMEOUT", "3s")
+	t.Setenv("DYNAMODB_ACCESS_KEY_ID", "AKIAEXAMPLEKEY")
+
+	cfg, err := LoadConfig([]string{"-config", path, "-env-file", envFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "9000", cfg.Server.Port)
+	assert.Equal(t, persistent.Tables{persistent.RoleOrders: "Orders", persistent.RoleProducts: "Products"}, cfg.Tables())
+	assert.Equal(t, 3*time.Second, cfg.DynamoDB.OperationTimeout)
+	assert.Equal(t, map[string]string{"com.example.order.created": "order/created"}, cfg.Events.CloudEventTypes)
+	assert.Equal(t, 30*time.Second, cfg.Server.ShutdownTimeout)
+
+	cfg, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-db-operation-timeout", "4s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4*time.Second, cfg.DynamoDB.OperationTimeout)
+
+	view := cfg.Redacted()
+	assert.Equal(t, "REDACTED", view["auth"].(map[string]interface{})["adminApiKey"])
+	assert.Equal(t, "REDACTED", view["dynamodb"].(map[string]interface{})["accessKeyId"])
+	assert.Equal(t, "4s", view["dynamodb"].(map[string]interface{})["operationTimeout"])
+
+	h := handler.NewWebhookHandler(new(persistenttest.MockDB), cfg.Tables(), handler.WithConfigView(view))
+	w := httptest.NewRecorder()
+	handler.Make(h.ConfigHandler)(w, httptest.NewRequest("GET", "/admin/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "s3cret")
+	assert.NotContains(t, w.Body.String(), "AKIAEXAMPLEKEY")
+
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-ingest-mode", "later", "-server-port", "http"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "INGEST_MODE")
+		assert.Contains(t, err.Error(), "SERVER_PORT")
+	}
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-tls-client-auth", "require"})
+	assert.ErrorContains(t, err, "TLS_CLIENT_AUTH: require needs TLS_CLIENT_CA_FILE")
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-tls-client-auth", "require", "-tls-client-ca-file", filepath.Join(dir, "ca.pem")})
+	assert.NoError(t, err)
+	ordersOnly := persistenttest.WriteDefinitions(t, `{"role": "orders", "tableName": "Orders", "billingMode": "PAY_PER_REQUEST",
+		"attributeDefinitions": [{"attributeName": "PK", "attributeType": "S"}], "keySchema": [{"attributeName": "PK", "keyType": "HASH"}]}`)
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-table-definitions-path", ordersOnly})
+	assert.ErrorContains(t, err, "DYNAMODB_TABLES: the products table has no definition")
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile, "-dynamodb-product-table-name", "Orders"})
+	assert.ErrorContains(t, err, "DYNAMODB_TABLES: the orders and products roles both use table Orders")
+	t.Setenv("SERVER_IDLE_TIMEOUT", "soon")
+	_, err = LoadConfig([]string{"-config", path, "-env-file", envFile})
+	assert.ErrorContains(t, err, "SERVER_IDLE_TIMEOUT")
+}
+
+// TestLoadConfigDynamoDB checks that the credentials mode is validated, that migrations are off by default
+// and that --plan selects the plan migration mode
+func TestLoadConfigDynamoDB(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "missing.env")
+	t.Setenv("DYNAMODB_ORDER_TABLE_NAME", "Orders")
+	_, err := LoadConfig([]string{"-env-file", envFile, "-dynamodb-credentials-mode", "static"})
+	assert.ErrorContains(t, err, "DYNAMODB_CREDENTIALS_MODE")
+
+	cfg, err := LoadConfig([]string{"-env-file", envFile})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "off", cfg.DynamoDB.Migrations.Mode)
+		assert.False(t, cfg.DynamoDB.Migrations.DeleteIndexes)
+	}
+	cfg, err = LoadConfig([]string{"-env-file", envFile, "--plan"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "plan", cfg.DynamoDB.Migrations.Mode)
+	}
+}
+
+// TestRunInvalidConfig checks that run reports configuration errors instead of exiting
+func TestRunInvalidConfig(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "missing.env")
+	err := run([]string{"-env-file", envFile, "-ingest-mode", "later"})
+	assert.ErrorContains(t, err, "INGEST_MODE")
+}
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Event outcomes recorded by EventProcessed
+const (
+	OutcomeAccepted = "accepted"
+	OutcomeRejected = "rejected"
+	OutcomeUnknown  = "unknown"
+)
+
+// Label values standing in for request input that is not bounded
+const (
+	// UnknownEventType labels events whose $type has no handler
+	UnknownEventType = "unknown"
+	// OtherMerchant labels merchants that are not in the allow-list set with SetMerchants
+	OtherMerchant = "other"
+	// OtherMethod labels HTTP requests whose method is not one of the standard methods
+	OtherMethod = "other"
+)
+
+// Asynchronous ingestion results recorded by IngestJob
+const (
+	IngestStored    = "stored"
+	IngestRetried   = "retried"
+	IngestFailed    = "failed"
+	IngestAbandoned = "abandoned"
+)
+
+var registry = prometheus.NewRegistry()
+
+// merchants is the allow-list of merchants labelled by name; merchants come from the request path, so any
+// other merchant is labelled OtherMerchant to keep the number of series bounded
+var merchants struct {
+	sync.RWMutex
+	names map[string]bool
+}
+
+var (
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_events_received_total",
+		Help: "Webhook events received, by merchant and event type.",
+	}, []string{"merchant", "type"})
+
+	eventsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_events_processed_total",
+		Help: "Webhook events processed, by merchant, event type and outcome (accepted, rejected, unknown).",
+	}, []string{"merchant", "type", "outcome"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	dynamoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dynamodb_operation_duration_seconds",
+		Help:    "DynamoDB operation latency, by operation and table.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "table"})
+
+	dynamoErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynamodb_operation_errors_total",
+		Help: "DynamoDB operations that returned an error, by operation and table.",
+	}, []string{"operation", "table"})
+
+	ingestJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_ingest_jobs_total",
+		Help: "Asynchronously ingested events, by result (stored, retried, failed, abandoned).",
+	}, []string{"result"})
+
+	authDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_auth_decisions_total",
+		Help: "API key access decisions, by required role and decision (allowed, forbidden, unauthenticated).",
+	}, []string{"role", "decision"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_rate_limited_total",
+		Help: "Requests rejected with 429, by merchant and the scope of the exceeded limit (merchant, global).",
+	}, []string{"merchant", "scope"})
+
+	dynamoRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_dynamodb_retries_total",
+		Help: "DynamoDB operations retried after a retryable error, by operation.",
+	}, []string{"operation"})
+
+	faultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_chaos_faults_total",
+		Help: "Faults injected into database operations, by operation and fault (throttle, latency, timeout, partial).",
+	}, []string{"operation", "fault"})
+
+	queues = &queueCollector{
+		desc:  prometheus.NewDesc("webhook_queue_size", "Number of items currently held in an in-memory queue.", []string{"queue"}, nil),
+		sizes: make(map[string]func() int),
+	}
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		eventsReceived,
+		eventsProcessed,
+		httpDuration,
+		dynamoDuration,
+		dynamoErrors,
+		dynamoRetries,
+		ingestJobs,
+		authDecisions,
+		rateLimited,
+		faultsInjected,
+		queues,
+	)
+}
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// SetMerchants replaces the merchants labelled by name; every other merchant is labelled OtherMerchant
+func SetMerchants(names []string) {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	merchants.Lock()
+	defer merchants.Unlock()
+	merchants.names = allowed
+}
+
+// merchantLabel returns the label value of a merchant
+func merchantLabel(merchant string) string {
+	merchants.RLock()
+	defer merchants.RUnlock()
+	if merchants.names[merchant] {
+		return merchant
+	}
+	return OtherMerchant
+}
+
+// EventReceived counts a webhook event as received for the merchant and event type. The event type must
+// be a handled type, UnknownEventType or empty for an event that could not be decoded.
+func EventReceived(merchant, eventType string) {
+	eventsReceived.WithLabelValues(merchantLabel(merchant), eventType).Inc()
+}
+
+// EventProcessed counts the outcome of handling a webhook event
+func EventProcessed(merchant, eventType, outcome string) {
+	eventsProcessed.WithLabelValues(merchantLabel(merchant), eventType, outcome).Inc()
+}
+
+// ObserveDynamoDB records the latency of a DynamoDB operation and counts it as failed when err is non-nil
+func ObserveDynamoDB(operation, table string, start time.Time, err error) {
+	dynamoDuration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dynamoErrors.WithLabelValues(operation, table).Inc()
+	}
+}
+
+// DynamoDBRetry counts a retry of a DynamoDB operation
+func DynamoDBRetry(operation string) {
+	dynamoRetries.WithLabelValues(operation).Inc()
+}
+
+// IngestJob counts a result of persisting an asynchronously ingested event
+func IngestJob(result string) {
+	ingestJobs.WithLabelValues(result).Inc()
+}
+
+// AuthDecision counts an API key access decision for an endpoint requiring the role
+func AuthDecision(role, decision string) {
+	authDecisions.WithLabelValues(role, decision).Inc()
+}
+
+// RateLimited counts a request rejected because the merchant or global rate limit was exceeded
+func RateLimited(merchant, scope string) {
+	rateLimited.WithLabelValues(merchantLabel(merchant), scope).Inc()
+}
+
+// FaultInjected counts a fault injected into a database operation
+func FaultInjected(operation, fault string) {
+	faultsInjected.WithLabelValues(operation, fault).Inc()
+}
+
+// RegisterQueue exposes the size of an in-memory queue; size is called on every scrape
+func RegisterQueue(name string, size func() int) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+	queues.sizes[name] = size
+}
+
+// queueCollector reports the sizes of registered queues at scrape time
+type queueCollector struct {
+	desc  *prometheus.Desc
+	mu    sync.Mutex
+	sizes map[string]func() int
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, size := range c.sizes {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(size()), name)
+	}
+}
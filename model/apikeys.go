@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// API key roles. Admin keys hold every role.
+const (
+	RoleIngest = "ingest"
+	RoleRead   = "read"
+	RoleAdmin  = "admin"
+)
+
+// APIKey is an API key as stored; only the SHA-256 hash of the secret key is kept
+type APIKey struct {
+	// ID is the first 16 hex characters of the key hash and identifies the key in logs and the admin API
+	ID      string   `json:"id" dynamodbav:"ID"`
+	Name    string   `json:"name" dynamodbav:"Name"`
+	KeyHash string   `json:"-" dynamodbav:"KeyHash"`
+	Roles   []string `json:"roles" dynamodbav:"Roles"`
+	// Merchants limits the key to these merchant IDs; an empty list allows every merchant
+	Merchants []string  `json:"merchants,omitempty" dynamodbav:"Merchants,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"CreatedAt"`
+}
+
+// HasRole reports whether the key may act in the role
+func (k *APIKey) HasRole(role string) bool {
+	for _, held := range k.Roles {
+		if held == role || held == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsMerchant reports whether the key may access the merchant's events
+func (k *APIKey) AllowsMerchant(merchant string) bool {
+	if len(k.Merchants) == 0 {
+		return true
+	}
+	for _, allowed := range k.Merchants {
+		if allowed == merchant {
+			return true
+		}
+	}
+	return false
+}
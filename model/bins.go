@@ -0,0 +1,71 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Bin is an isolated space for capturing webhook deliveries, received at /b/{binId}/{merchantId}.
+// Its events are kept apart from every other bin and from the unscoped events.
+type Bin struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// RetentionSeconds is how long events received into the bin are kept
+	RetentionSeconds int64 `json:"retentionSeconds"`
+	// Secret is the HMAC-SHA256 key deliveries must be signed with; empty accepts unsigned deliveries
+	Secret string `json:"secret,omitempty"`
+	// ResponseRules override the response sent for matching deliveries; the first match applies
+	ResponseRules []ResponseRule `json:"responseRules,omitempty"`
+	// Owner is the ID of the API key that created the bin; empty when API keys were disabled
+	Owner string `json:"owner,omitempty"`
+	// Merchants limits deliveries to these merchant IDs, those of the creating key; empty allows every merchant
+	Merchants []string `json:"merchants,omitempty"`
+}
+
+// ResponseRule is a canned response a bin returns instead of the regular one
+type ResponseRule struct {
+	// EventType limits the rule to one $type; empty matches every delivery
+	EventType string            `json:"eventType,omitempty"`
+	Status    int               `json:"status"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// DelayMs holds the response back, e.g. to exercise sender timeouts
+	DelayMs int `json:"delayMs,omitempty"`
+}
+
+// Expired reports whether the bin no longer accepts deliveries or queries
+func (b *Bin) Expired(now time.Time) bool {
+	return !b.ExpiresAt.After(now)
+}
+
+// OwnedBy reports whether the key may read or delete the bin: its creator and admin keys may. Every
+// caller may when API keys are disabled, which is when key is nil.
+func (b *Bin) OwnedBy(key *APIKey) bool {
+	return key == nil || key.HasRole(RoleAdmin) || (b.Owner != "" && b.Owner == key.ID)
+}
+
+// AllowsMerchant reports whether the bin accepts deliveries for the merchant
+func (b *Bin) AllowsMerchant(merchant string) bool {
+	if len(b.Merchants) == 0 {
+		return true
+	}
+	for _, allowed := range b.Merchants {
+		if allowed == merchant {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope returns the scope database operations on the bin's events run in
+func (b *Bin) Scope() BinScope {
+	return BinScope{ID: b.ID, Retention: time.Duration(b.RetentionSeconds) * time.Second}
+}
+
+// BinScope identifies the bin an operation is scoped to and the retention of events written into it
+type BinScope struct {
+	ID        string        `json:"id"`
+	Retention time.Duration `json:"retention"`
+}
@@ -0,0 +1,12 @@
+package model
+
+// CloudEventAttributes holds the CloudEvents 1.0 context attributes of an event received as a CloudEvent
+type CloudEventAttributes struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Time            string `json:"time,omitempty"`
+	Subject         string `json:"subject,omitempty"`
+	DataContentType string `json:"datacontenttype,omitempty"`
+}
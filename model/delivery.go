@@ -0,0 +1,11 @@
+package model
+
+// Delivery describes how an event reached the server and is recorded with the event
+type Delivery struct {
+	// ClientCertSubject is the subject of the verified TLS client certificate the sender presented
+	ClientCertSubject string `json:"clientCertSubject,omitempty"`
+	// ContentEncoding is the Content-Encoding of a compressed body, with its size as received and once decoded
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	CompressedBytes int64  `json:"compressedBytes,omitempty"`
+	BodyBytes       int64  `json:"bodyBytes,omitempty"`
+}
@@ -3,6 +3,12 @@ package model
 type EventOptions struct {
 	ExternalOrderId *string
 	DealId          *string
+	// CloudEvent is set when the event was received as a CloudEvent
+	CloudEvent *CloudEventAttributes
+	// Attributes are additional string attributes stored with the event, such as grouping keys
+	Attributes map[string]string
+	// Delivery describes how the event reached the server
+	Delivery *Delivery
 }
 
 // BaseEvent struct holds common fields for all events.
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidCursor is returned for a query whose cursor was not returned by an earlier page
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// StoredEvent is an event as it was stored, with the keys it was stored under
+type StoredEvent struct {
+	EventType       string `json:"eventType"`
+	ExternalOrderID string `json:"externalOrderID"`
+	LastUpdated     string `json:"lastUpdated"`
+	PK              string `json:"pk"`
+	SK              string `json:"sk"`
+	EventData       string `json:"eventData"`
+	// CloudEvent is the CloudEvents context of an event received as a CloudEvent
+	CloudEvent *CloudEventAttributes `json:"cloudEvent,omitempty"`
+	// Delivery describes how the event reached the server, such as the sender's client certificate
+	Delivery *Delivery `json:"delivery,omitempty"`
+}
+
+// EventQuery selects stored events either by partition key or by external order ID, and narrows
+// them with the optional filters
+type EventQuery struct {
+	// PK selects the events stored under a partition key, newest first
+	PK string
+	// ExternalOrderID selects the events of an order across merchants
+	ExternalOrderID string
+	// EventType keeps only events of this type
+	EventType string
+	// Since and Until keep only events whose LastUpdated is within them, inclusive, compared as UTC RFC 3339 strings with milliseconds, the layout of stored times
+	Since string
+	Until string
+	// Limit bounds the events read for a page, before the filters apply; zero reads up to DynamoDB's 1 MB page
+	Limit int
+	// Cursor continues the query from the page that returned it as NextCursor
+	Cursor string
+}
+
+// Validate checks that the query selects events one way and has a usable limit
+func (q EventQuery) Validate() error {
+	if (q.PK == "") == (q.ExternalOrderID == "") {
+		return errors.New("a query needs exactly one of a partition key and an external order ID")
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("limit %d cannot be negative", q.Limit)
+	}
+	return nil
+}
+
+// EventPage is a page of the events selected by a query
+type EventPage struct {
+	Events []StoredEvent
+	// NextCursor continues the query; it is empty on the last page
+	NextCursor string
+}
@@ -0,0 +1,36 @@
+package model
+
+import "sort"
+
+// registry maps the model names used by the routing config onto the event structs they decode into
+var registry = map[string]func() interface{}{
+	"OrderCreated":             func() interface{} { return new(OrderCreated) },
+	"OrderCreationFailed":      func() interface{} { return new(OrderCreationFailed) },
+	"OrderLineCancelled":       func() interface{} { return new(OrderLineCancelled) },
+	"OrderLineRefunded":        func() interface{} { return new(OrderLineRefunded) },
+	"OrderLineShipped":         func() interface{} { return new(OrderLineShipped) },
+	"OrderLineShippingDeleted": func() interface{} { return new(OrderLineShippingDeleted) },
+	"VariantStockUpdated":      func() interface{} { return new(VariantStockUpdated) },
+	"ProductUpdateV2":          func() interface{} { return new(ProductUpdateV2) },
+	"ProductSubscribed":        func() interface{} { return new(ProductSubscribed) },
+	"PriceUpdate":              func() interface{} { return new(PriceUpdate) },
+}
+
+// New returns a pointer to a new zero value of the named model
+func New(name string) (interface{}, bool) {
+	newModel, ok := registry[name]
+	if !ok {
+		return nil, false
+	}
+	return newModel(), true
+}
+
+// Names returns the registered model names in sorted order
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
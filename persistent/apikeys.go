@@ -0,0 +1,139 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"webhook_test_server/model"
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CreateAPIKeysTableIfNotExists creates the table holding hashed API keys, keyed by key ID
+func (db *Database) CreateAPIKeysTableIfNotExists(ctx context.Context, tableName string) (err error) {
+	ctx, span := startSpan(ctx, "CreateAPIKeysTableIfNotExists", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	exists, err := db.tableExists(ctx, tableName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Table %s already exists", tableName)
+		return nil
+	}
+
+	ctx, done := observe(ctx, "CreateTable", tableName)
+	_, err = db.svc.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: types.KeyTypeHash},
+		},
+		ProvisionedThroughput: &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(5),
+			WriteCapacityUnits: aws.Int64(5),
+		},
+	})
+	err = done(err)
+	if err != nil {
+		return err
+	}
+	log.Printf("Table %s created successfully", tableName)
+	return nil
+}
+
+// StoreAPIKey stores an API key; the key itself is never stored, only its hash
+func (db *Database) StoreAPIKey(ctx context.Context, tableName string, key model.APIKey) (err error) {
+	ctx, span := startSpan(ctx, "StoreAPIKey", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+	expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("ID"))).Build()
+	if err != nil {
+		return err
+	}
+	ctx, done := observe(ctx, "PutItem", tableName)
+	_, err = db.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(tableName),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	return done(err)
+}
+
+// GetAPIKey returns an API key by ID, or nil if there is no such key
+func (db *Database) GetAPIKey(ctx context.Context, tableName, id string) (_ *model.APIKey, err error) {
+	ctx, span := startSpan(ctx, "GetAPIKey", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	ctx, done := observe(ctx, "GetItem", tableName)
+	result, err := db.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"ID": stringValue(id),
+		},
+	})
+	err = done(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API key %s: %w", id, err)
+	}
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+	var key model.APIKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("failed to parse API key %s: %w", id, err)
+	}
+	return &key, nil
+}
+
+// ListAPIKeys returns every stored API key
+func (db *Database) ListAPIKeys(ctx context.Context, tableName string) (_ []model.APIKey, err error) {
+	ctx, span := startSpan(ctx, "ListAPIKeys", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	var keys []model.APIKey
+	paginator := dynamodb.NewScanPaginator(db.svc, &dynamodb.ScanInput{TableName: aws.String(tableName)})
+	for paginator.HasMorePages() {
+		callCtx, done := observe(ctx, "Scan", tableName)
+		result, err := paginator.NextPage(callCtx)
+		err = done(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list API keys: %w", err)
+		}
+		var page []model.APIKey
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse API keys: %w", err)
+		}
+		keys = append(keys, page...)
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey revokes an API key
+func (db *Database) DeleteAPIKey(ctx context.Context, tableName, id string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteAPIKey", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	ctx, done := observe(ctx, "DeleteItem", tableName)
+	_, err = db.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"ID": stringValue(id),
+		},
+	})
+	return done(err)
+}
@@ -0,0 +1,35 @@
+package persistent
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// stringValue returns a string attribute value
+func stringValue(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+// numberValue returns a number attribute value
+func numberValue(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+// stringAttribute returns a string attribute of an item, or "" when it is missing or not a string
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+// numberAttribute returns a number attribute of an item; ok is false when it is missing or not an integer
+func numberAttribute(item map[string]types.AttributeValue, name string) (n int64, ok bool) {
+	value, isNumber := item[name].(*types.AttributeValueMemberN)
+	if !isNumber {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value.Value, 10, 64)
+	return n, err == nil
+}
@@ -1,121 +1,151 @@
 package persistent
 
 import (
-	"errors"
-	"log"
-	"os"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-// TokenFetcher is a custom implementation of the TokenFetcher interface.
-type TokenFetcher struct {
-	webIdentityToken string
-}
-
-// FetchToken returns the web identity token bytes.
-func (tf *TokenFetcher) FetchToken(_ credentials.Context) ([]byte, error) {
-	return []byte(tf.webIdentityToken), nil
-}
-
-// CustomProvider is a custom implementation of credentials.Provider that wraps the *stscreds.WebIdentityRoleProvider.
-type CustomProvider struct {
-	provider *stscreds.WebIdentityRoleProvider
-}
+// Credential modes selecting where the DynamoDB client gets its credentials
+const (
+	// ModeDefault uses the SDK's default credential chain: environment keys, the shared config and
+	// credentials files, web identity from AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, then the
+	// container or instance role
+	ModeDefault = "default"
+	// ModeLocal uses dummy static credentials against a local DynamoDB at Endpoint
+	ModeLocal = "local"
+	// ModeProfile uses a named profile from the shared config and credentials files
+	ModeProfile = "profile"
+	// ModeIRSA assumes RoleARN with the web identity token in WebIdentityTokenFile, as IAM roles for
+	// service accounts do on EKS
+	ModeIRSA = "irsa"
+	// ModeStatic uses the access key in AccessKeyID, SecretAccessKey and SessionToken
+	ModeStatic = "static"
+)
 
-// Retrieve returns the AWS credentials.
-func (p *CustomProvider) Retrieve() (credentials.Value, error) {
-	return p.provider.Retrieve()
+// defaultLocalEndpoint is where ModeLocal connects when no Endpoint is set
+const defaultLocalEndpoint = "http://localhost:8001"
+
+// defaultRoleSessionName names the session when ModeIRSA assumes the role
+const defaultRoleSessionName = "webhook-test-server"
+
+// ResolvedMode returns the credential mode in force: an empty Mode is local when an Endpoint is set
+// and the default chain otherwise
+func (c ConnectionConfig) ResolvedMode() string {
+	switch {
+	case c.Mode != "":
+		return c.Mode
+	case c.Endpoint != "":
+		return ModeLocal
+	default:
+		return ModeDefault
+	}
 }
 
-// IsExpired returns whether the underlying credentials are expired or not.
-func (p *CustomProvider) IsExpired() bool {
-	return p.provider.IsExpired()
+// Validate checks that the mode is known and has the settings it needs
+func (c ConnectionConfig) Validate() error {
+	switch c.ResolvedMode() {
+	case ModeDefault, ModeLocal:
+	case ModeProfile:
+		if c.Profile == "" {
+			return fmt.Errorf("credentials mode %q needs a profile", ModeProfile)
+		}
+	case ModeIRSA:
+		if c.RoleARN == "" || c.WebIdentityTokenFile == "" {
+			return fmt.Errorf("credentials mode %q needs a role ARN and a web identity token file", ModeIRSA)
+		}
+	case ModeStatic:
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return fmt.Errorf("credentials mode %q needs an access key ID and a secret access key", ModeStatic)
+		}
+	default:
+		return fmt.Errorf("unknown credentials mode %q, expected default, local, profile, irsa or static", c.Mode)
+	}
+	return nil
 }
 
-// CheckAWSRoleAvailability checks if the AWS role is available.
-func CheckAWSRoleAvailability() bool {
-	myRoleArn := os.Getenv("AWS_ROLE_ARN")
-	log.Println("### my Role Arn.", myRoleArn)
-	if myRoleArn == "" {
-		return false
+// loadAWSConfig loads the AWS configuration for the connection's credential mode and region
+func loadAWSConfig(ctx context.Context, c ConnectionConfig) (aws.Config, error) {
+	if err := c.Validate(); err != nil {
+		return aws.Config{}, err
 	}
-
-	sess := session.Must(session.NewSession())
-	log.Println("sess", sess)
-	secret := stscreds.NewCredentials(sess, myRoleArn)
-	stsSvc := sts.New(sess, &aws.Config{Credentials: secret})
-	input := &sts.GetCallerIdentityInput{}
-	_, err := stsSvc.GetCallerIdentity(input)
-	if err != nil {
-		log.Println("error", err)
+	var opts []func(*config.LoadOptions) error
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
 	}
-	return err == nil
-}
-
-// ConnectToAWSDynamoDB connects to AWS DynamoDB.
-func ConnectToAWSDynamoDB() (*dynamodb.DynamoDB, error) {
-	roleARN := os.Getenv("AWS_ROLE_ARN")
-	webIdentityTokenPath := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
-	if roleARN == "" || webIdentityTokenPath == "" {
-		return nil, errors.New("AWS_ROLE_ARN or AWS_WEB_IDENTITY_TOKEN_FILE is not set")
+	switch c.ResolvedMode() {
+	case ModeLocal:
+		// DynamoDB Local accepts any credentials but needs a region to sign with
+		if c.Region == "" {
+			opts = append(opts, config.WithRegion("us-east-1"))
+		}
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("dummy", "dummy", "")))
+	case ModeProfile:
+		opts = append(opts, config.WithSharedConfigProfile(c.Profile))
+	case ModeStatic:
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)))
 	}
 
-	// Read the web identity token from the file
-	webIdentityToken, err := os.ReadFile(webIdentityTokenPath)
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		log.Println("Error reading the web identity token file:", err)
-		return nil, err
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
 	}
-
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-
-	// Create a new STS client to perform AWS STS operations
-	stsClient := sts.New(sess)
-
-	// Create a TokenFetcher instance with the web identity token
-	tokenFetcher := &TokenFetcher{
-		webIdentityToken: string(webIdentityToken),
+	if c.ResolvedMode() == ModeIRSA {
+		sessionName := c.RoleSessionName
+		if sessionName == "" {
+			sessionName = defaultRoleSessionName
+		}
+		// The token file is re-read whenever the credentials are refreshed, so a rotated token is picked up
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), c.RoleARN, stscreds.IdentityTokenFile(c.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) { o.RoleSessionName = sessionName })
+		cfg.Credentials = aws.NewCredentialsCache(provider)
 	}
-
-	// Create a custom AWS credentials provider using the web identity token and role ARN
-	provider := &CustomProvider{
-		provider: stscreds.NewWebIdentityRoleProviderWithOptions(stsClient, roleARN, "WebIdentitySession", tokenFetcher),
+	if cfg.Region == "" {
+		return aws.Config{}, fmt.Errorf("no AWS region set for credentials mode %q: set DYNAMODB_REGION or AWS_REGION", c.ResolvedMode())
 	}
+	return cfg, nil
+}
 
-	credsValue, err := provider.Retrieve()
-	if err != nil {
-		log.Println("Error retrieving AWS credentials:", err)
-		return nil, err
+// newClient creates the DynamoDB client, pointed at the connection's endpoint when one is set and without
+// the SDK's retries when the connection disables them.
+// The endpoint only applies to DynamoDB, so IRSA still reaches the regional STS endpoint.
+func newClient(cfg aws.Config, c ConnectionConfig) *dynamodb.Client {
+	endpoint := c.Endpoint
+	if endpoint == "" && c.ResolvedMode() == ModeLocal {
+		endpoint = defaultLocalEndpoint
 	}
-
-	// Print the AWS credentials obtained through web identity federation
-	log.Println("Access Key ID:", credsValue.AccessKeyID)
-	// log.Println("Secret Access Key:", credsValue.SecretAccessKey)
-	// log.Println("Session Token:", credsValue.SessionToken)
-
-	dynamoDBClient := dynamodb.New(sess, &aws.Config{Credentials: credentials.NewCredentials(provider)})
-
-	// For example, scan the table
-	result, err := dynamoDBClient.Scan(&dynamodb.ScanInput{
-		TableName: aws.String("My_Table"),
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		if c.DisableSDKRetries {
+			o.Retryer = aws.NopRetryer{}
+		}
 	})
-	if err != nil {
-		log.Println("Error scanning table:", err)
-		return nil, err
-	}
+}
 
-	log.Println("Items:")
-	for _, item := range result.Items {
-		log.Println(item)
+// endpointName describes where a client sends its requests, for logs and errors
+func endpointName(svc *dynamodb.Client) string {
+	options := svc.Options()
+	if options.BaseEndpoint != nil {
+		return *options.BaseEndpoint
 	}
+	return "the regional DynamoDB endpoint"
+}
 
-	return dynamoDBClient, nil
+// checkConnectivity makes the cheapest authenticated call DynamoDB offers, listing at most one table,
+// so a bad endpoint, region or credentials fail at startup whichever tables exist
+func checkConnectivity(ctx context.Context, svc *dynamodb.Client) (err error) {
+	ctx, done := observe(ctx, "ListTables", "")
+	_, err = svc.ListTables(ctx, &dynamodb.ListTablesInput{Limit: aws.Int32(1)})
+	if err = done(err); err != nil {
+		return fmt.Errorf("failed to reach DynamoDB at %s: %w", endpointName(svc), err)
+	}
+	return nil
 }
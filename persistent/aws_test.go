@@ -0,0 +1,49 @@
+package persistent_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestConnectionModes checks that connecting only lists tables, signs with the static credentials and
+// reports rejected credentials, and that each mode validates its settings
+func TestConnectionModes(t *testing.T) {
+	var targets []string
+	var authorization string
+	listTables := func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.Header.Get("X-Amz-Target"))
+		authorization = r.Header.Get("Authorization")
+		if strings.Contains(authorization, "Credential=REVOKED/") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazon.coral.service#UnrecognizedClientException","message":"The security token included in the request is invalid."}`))
+			return
+		}
+		w.Write([]byte(`{"TableNames":["Orders"]}`))
+	}
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"ListTables": listTables})
+
+	persistenttest.Connect(t, fakeDynamoDB, persistent.WithConnection(persistent.ConnectionConfig{
+		Mode: persistent.ModeStatic, Region: "ap-southeast-2", Endpoint: fakeDynamoDB.URL, AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret",
+	}))
+	// Connecting only checks that DynamoDB answers, without touching any table
+	assert.Equal(t, []string{"DynamoDB_20120810.ListTables"}, targets)
+	assert.Contains(t, authorization, "Credential=AKIDEXAMPLE/")
+	assert.Contains(t, authorization, "/ap-southeast-2/dynamodb/")
+
+	_, err := persistent.NewDatabase(context.Background(), persistent.WithConnection(persistent.ConnectionConfig{
+		Mode: persistent.ModeStatic, Region: "us-east-1", Endpoint: fakeDynamoDB.URL, AccessKeyID: "REVOKED", SecretAccessKey: "secret",
+	}))
+	assert.ErrorContains(t, err, "UnrecognizedClientException")
+
+	assert.Equal(t, persistent.ModeLocal, persistent.ConnectionConfig{Endpoint: fakeDynamoDB.URL}.ResolvedMode())
+	assert.Equal(t, persistent.ModeDefault, persistent.ConnectionConfig{}.ResolvedMode())
+	assert.ErrorContains(t, persistent.ConnectionConfig{Mode: persistent.ModeIRSA, RoleARN: "arn:aws:iam::123456789012:role/webhook"}.Validate(), "web identity token file")
+	assert.ErrorContains(t, persistent.ConnectionConfig{Mode: "instance"}.Validate(), "unknown credentials mode")
+}
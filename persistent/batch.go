@@ -0,0 +1,296 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webhook_test_server/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxBatchWriteItems is the most write requests DynamoDB accepts in one BatchWriteItem call
+const maxBatchWriteItems = 25
+
+// ErrBatchWriterClosed is returned for items written or retried after the database was closed
+var ErrBatchWriterClosed = errors.New("batch writer is closed")
+
+// ErrUnprocessedItem is returned to a waiting writer whose item DynamoDB still left unprocessed after every retry
+var ErrUnprocessedItem = errors.New("item left unprocessed by BatchWriteItem")
+
+// BatchConfig controls how event writes are coalesced into BatchWriteItem calls
+type BatchConfig struct {
+	// FlushSize is the number of items that triggers a flush, at most 25
+	FlushSize int
+	// Linger is how long a partial batch waits for more items before it is flushed
+	Linger time.Duration
+	// MaxRetries bounds the retries of throttled calls and unprocessed items
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DatabaseOption configures optional Database behaviour
+type DatabaseOption func(*Database)
+
+// WithBatchWrites routes event writes through a batch writer that coalesces them into BatchWriteItem calls
+func WithBatchWrites(cfg BatchConfig) DatabaseOption {
+	return func(db *Database) {
+		if cfg.FlushSize <= 0 || cfg.FlushSize > maxBatchWriteItems {
+			cfg.FlushSize = maxBatchWriteItems
+		}
+		db.batchConfig = &cfg
+	}
+}
+
+// batchRequest is a single item waiting to be written by the batch writer
+type batchRequest struct {
+	table  string
+	item   map[string]types.AttributeValue
+	result chan error
+	// deadline is the writer's deadline, zero when it has none
+	deadline time.Time
+}
+
+// key identifies the item so duplicates are never sent in the same batch
+func (r *batchRequest) key() string {
+	return r.table + "\x00" + stringAttribute(r.item, "PK") + "\x00" + stringAttribute(r.item, "SK")
+}
+
+// batchWriter collects items from concurrent writers and flushes them in batches,
+// reporting each item's outcome back to the writer waiting on it
+type batchWriter struct {
+	svc      *dynamodb.Client
+	cfg      BatchConfig
+	requests chan *batchRequest
+	pending  atomic.Int64
+
+	mu      sync.RWMutex
+	closed  bool
+	flushes sync.WaitGroup
+	stopped chan struct{}
+	// done is closed once every queued item has been handed to a flush, ending their retries
+	done chan struct{}
+}
+
+func newBatchWriter(svc *dynamodb.Client, cfg BatchConfig) *batchWriter {
+	b := &batchWriter{
+		svc:      svc,
+		cfg:      cfg,
+		requests: make(chan *batchRequest, cfg.FlushSize),
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	metrics.RegisterQueue("dynamodb_batch", func() int { return int(b.pending.Load()) })
+	go b.run()
+	log.Printf("Batch writes enabled: flush size %d, linger %s", cfg.FlushSize, cfg.Linger)
+	return b
+}
+
+// put queues an item and waits until its batch has been written or ctx is done
+func (b *batchWriter) put(ctx context.Context, table string, item map[string]types.AttributeValue) error {
+	req := &batchRequest{table: table, item: item, result: make(chan error, 1)}
+	req.deadline, _ = ctx.Deadline()
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrBatchWriterClosed
+	}
+	// Counted before the send, so a flush that finishes first cannot take the counter below zero
+	b.pending.Add(1)
+	select {
+	case b.requests <- req:
+		b.mu.RUnlock()
+	case <-ctx.Done():
+		b.pending.Add(-1)
+		b.mu.RUnlock()
+		return fmt.Errorf("%w: item was not queued for a batch write", ctx.Err())
+	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: batch write did not complete", ctx.Err())
+	}
+}
+
+// close flushes every queued item and waits for in-flight batches to finish. Batches waiting to retry
+// give up instead, failing their items with ErrBatchWriterClosed.
+func (b *batchWriter) close() {
+	b.mu.Lock()
+	wasClosed := b.closed
+	if !b.closed {
+		b.closed = true
+		close(b.requests)
+	}
+	b.mu.Unlock()
+	<-b.stopped
+	if !wasClosed {
+		close(b.done)
+	}
+	b.flushes.Wait()
+}
+
+// run accumulates requests until the batch is full or has lingered long enough
+func (b *batchWriter) run() {
+	defer close(b.stopped)
+
+	var batch []*batchRequest
+	keys := make(map[string]struct{})
+	linger := time.NewTimer(b.cfg.Linger)
+	// stopLinger stops the timer and drains a tick that fired before it was stopped, so it cannot flush the next batch early
+	stopLinger := func() {
+		if !linger.Stop() {
+			select {
+			case <-linger.C:
+			default:
+			}
+		}
+	}
+	stopLinger()
+
+	flush := func() {
+		stopLinger()
+		if len(batch) == 0 {
+			return
+		}
+		b.flushes.Add(1)
+		go b.flush(batch)
+		batch = nil
+		keys = make(map[string]struct{})
+	}
+
+	for {
+		select {
+		case req, ok := <-b.requests:
+			if !ok {
+				flush()
+				return
+			}
+			// DynamoDB rejects a batch that writes the same key twice
+			if _, duplicate := keys[req.key()]; duplicate {
+				flush()
+			}
+			batch = append(batch, req)
+			keys[req.key()] = struct{}{}
+			if len(batch) == 1 {
+				linger.Reset(b.cfg.Linger)
+			}
+			if len(batch) >= b.cfg.FlushSize {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+// flush writes a batch, retrying throttled calls and unprocessed items with jittered backoff. The calls
+// share the latest deadline of the waiting writers, so a batch is not retried after every writer gave up.
+func (b *batchWriter) flush(batch []*batchRequest) {
+	defer b.flushes.Done()
+	defer b.pending.Add(-int64(len(batch)))
+
+	waiting := make(map[string]*batchRequest, len(batch))
+	requestItems := make(map[string][]types.WriteRequest)
+	tables := make(map[string]struct{})
+	var deadline time.Time
+	unbounded := false
+	for _, req := range batch {
+		waiting[req.key()] = req
+		requestItems[req.table] = append(requestItems[req.table], types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: req.item},
+		})
+		tables[req.table] = struct{}{}
+		if req.deadline.IsZero() {
+			unbounded = true
+		} else if req.deadline.After(deadline) {
+			deadline = req.deadline
+		}
+	}
+	tableNames := make([]string, 0, len(tables))
+	for table := range tables {
+		tableNames = append(tableNames, table)
+	}
+	sort.Strings(tableNames)
+	tableLabel := strings.Join(tableNames, ",")
+
+	ctx := context.Background()
+	if !unbounded {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	fail := func(err error) {
+		for _, req := range waiting {
+			req.result <- err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		callCtx, done := observe(ctx, "BatchWriteItem", tableLabel)
+		out, err := b.svc.BatchWriteItem(callCtx, &dynamodb.BatchWriteItemInput{RequestItems: requestItems})
+		err = done(err)
+
+		if err != nil {
+			if !IsThrottlingError(err) || attempt >= b.cfg.MaxRetries {
+				log.Printf("BatchWriteItem failed for %d items: %v", len(waiting), err)
+				fail(err)
+				return
+			}
+		} else {
+			// Everything not handed back as unprocessed has been written
+			unprocessed := make(map[string]*batchRequest)
+			for table, writes := range out.UnprocessedItems {
+				for _, write := range writes {
+					req := &batchRequest{table: table, item: write.PutRequest.Item}
+					if waiter, ok := waiting[req.key()]; ok {
+						unprocessed[req.key()] = waiter
+					}
+				}
+			}
+			for key, req := range waiting {
+				if _, ok := unprocessed[key]; !ok {
+					req.result <- nil
+				}
+			}
+			waiting = unprocessed
+			if len(waiting) == 0 {
+				return
+			}
+			if attempt >= b.cfg.MaxRetries {
+				log.Printf("BatchWriteItem left %d items unprocessed after %d retries", len(waiting), attempt)
+				fail(ErrUnprocessedItem)
+				return
+			}
+			requestItems = out.UnprocessedItems
+		}
+
+		backoff := b.cfg.InitialBackoff << attempt
+		if backoff <= 0 || backoff > b.cfg.MaxBackoff {
+			backoff = b.cfg.MaxBackoff
+		}
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff) + 1))):
+		case <-ctx.Done():
+			log.Printf("BatchWriteItem gave up on %d items: %v", len(waiting), ctx.Err())
+			fail(fmt.Errorf("%w: batch write was not retried", ctx.Err()))
+			return
+		case <-b.done:
+			log.Printf("BatchWriteItem gave up on %d items: the database is closing", len(waiting))
+			fail(ErrBatchWriterClosed)
+			return
+		}
+	}
+}
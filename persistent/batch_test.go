@@ -0,0 +1,112 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBatchWritesRetryUnprocessedItems checks that concurrent writes share BatchWriteItem calls
+// and that items DynamoDB leaves unprocessed are retried until stored
+func TestBatchWritesRetryUnprocessedItems(t *testing.T) {
+	var mu sync.Mutex
+	var calls, written int
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"BatchWriteItem": func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			RequestItems map[string][]json.RawMessage
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		output := struct {
+			UnprocessedItems map[string][]json.RawMessage
+		}{UnprocessedItems: map[string][]json.RawMessage{}}
+		for table, writes := range input.RequestItems {
+			assert.LessOrEqual(t, len(writes), 25)
+			// Leave the first item of every first attempt unprocessed
+			if calls == 1 {
+				output.UnprocessedItems[table] = writes[:1]
+				writes = writes[1:]
+			}
+			written += len(writes)
+		}
+		json.NewEncoder(w).Encode(output)
+	}})
+	db := persistenttest.Connect(t, fakeDynamoDB, persistent.WithBatchWrites(persistent.BatchConfig{
+		FlushSize:      25,
+		Linger:         50 * time.Millisecond,
+		MaxRetries:     3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	}))
+
+	const events = 30
+	var wg sync.WaitGroup
+	for i := 0; i < events; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := db.StoreOrderEventData(ctx, "Orders", "order/created", fmt.Sprintf("ORDER-%d", i), "2024-06-14T15:55:13Z", "BIGW", map[string]int{"line": i}, model.EventOptions{})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, events, written)
+	assert.Less(t, calls, events)
+}
+
+// TestBatchWritesStopRetryingOnClose checks that a throttled batch waiting to retry gives up when the
+// database is closed, and that a writer's deadline bounds the retries
+func TestBatchWritesStopRetryingOnClose(t *testing.T) {
+	calls := make(chan struct{}, 16)
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"BatchWriteItem": func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		persistenttest.WriteError(w, "ProvisionedThroughputExceededException", "slow down")
+	}})
+	db := persistenttest.Connect(t, fakeDynamoDB, persistent.WithBatchWrites(persistent.BatchConfig{
+		FlushSize:      1,
+		MaxRetries:     10,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     time.Minute,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.StoreOrderEventData(ctx, "Orders", "order/created", "ORDER-1", "2024-06-14T15:55:13Z", "BIGW", map[string]int{"line": 1}, model.EventOptions{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	for len(calls) > 0 {
+		<-calls
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- db.StoreOrderEventData(context.Background(), "Orders", "order/created", "ORDER-2", "2024-06-14T15:55:13Z", "BIGW", map[string]int{"line": 2}, model.EventOptions{})
+	}()
+	<-calls
+	db.Close()
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, persistent.ErrBatchWriterClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write kept retrying after Close")
+	}
+}
@@ -0,0 +1,262 @@
+package persistent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// BinAttribute holds the ID of the bin an item belongs to
+	BinAttribute = "Bin"
+	// ExpiresAtAttribute is the TTL attribute of bin items, in epoch seconds
+	ExpiresAtAttribute = "ExpiresAt"
+	// BinKeyPrefix begins every key value written in a bin
+	BinKeyPrefix = "BIN#"
+	// binSK is the sort key of the item holding a bin's definition
+	binSK = "#BIN"
+)
+
+// ErrBinExists is returned by CreateBin when the bin ID is already taken
+var ErrBinExists = errors.New("bin already exists")
+
+type binScopeKey struct{}
+
+// WithBin scopes the database operations made with the returned context to a bin.
+// Keys written in a bin are prefixed with the bin ID, so bins share the configured tables
+// without seeing each other's events.
+func WithBin(ctx context.Context, scope model.BinScope) context.Context {
+	return context.WithValue(ctx, binScopeKey{}, scope)
+}
+
+// BinFromContext returns the bin the context is scoped to, if any
+func BinFromContext(ctx context.Context) (model.BinScope, bool) {
+	scope, ok := ctx.Value(binScopeKey{}).(model.BinScope)
+	return scope, ok
+}
+
+// binKeyPrefix is prepended to the partition and GSI hash keys of the items of a bin
+func binKeyPrefix(id string) string {
+	return BinKeyPrefix + id + "#"
+}
+
+// IsBinKey reports whether a key value belongs to a bin. Such values must not be looked up unscoped,
+// or a query could read a bin's events by naming its prefixed keys.
+func IsBinKey(value string) bool {
+	return strings.HasPrefix(value, BinKeyPrefix)
+}
+
+// scopedAttributes returns the attributes prefixed in a bin: the partition key and every GSI hash key of the table
+func (db *Database) scopedAttributes(tableName string) []string {
+	names := []string{"PK"}
+	for _, gsi := range db.tables[tableName].GlobalSecondaryIndexes {
+		for _, key := range gsi.KeySchema {
+			if types.KeyType(key.KeyType) == types.KeyTypeHash {
+				names = append(names, key.AttributeName)
+			}
+		}
+	}
+	return names
+}
+
+// scopeItem prefixes the keys of an item written in a bin and stamps it with the bin and its expiry
+func (db *Database) scopeItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) {
+	scope, ok := BinFromContext(ctx)
+	if !ok {
+		return
+	}
+	prefix := binKeyPrefix(scope.ID)
+	for _, name := range db.scopedAttributes(tableName) {
+		if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+			item[name] = stringValue(prefix + value.Value)
+		}
+	}
+	item[BinAttribute] = stringValue(scope.ID)
+	if scope.Retention > 0 {
+		item[ExpiresAtAttribute] = numberValue(time.Now().Add(scope.Retention).Unix())
+	}
+}
+
+// scopeKey prefixes a key value looked up in a bin
+func scopeKey(ctx context.Context, value string) string {
+	if scope, ok := BinFromContext(ctx); ok {
+		return binKeyPrefix(scope.ID) + value
+	}
+	return value
+}
+
+// scopeKeys prefixes the hash key values of a GSI query made in a bin
+func (db *Database) scopeKeys(ctx context.Context, tableName string, keys map[string]string) map[string]string {
+	if _, ok := BinFromContext(ctx); !ok {
+		return keys
+	}
+	scoped := make(map[string]string, len(keys))
+	for name, value := range keys {
+		scoped[name] = value
+	}
+	for _, name := range db.scopedAttributes(tableName) {
+		if value, ok := scoped[name]; ok {
+			scoped[name] = scopeKey(ctx, value)
+		}
+	}
+	return scoped
+}
+
+// unscopeItems strips the bin prefix from the keys of items read in a bin and drops expired items,
+// which DynamoDB only deletes some time after their TTL passes
+func (db *Database) unscopeItems(ctx context.Context, tableName string, items []map[string]types.AttributeValue) []map[string]types.AttributeValue {
+	scope, ok := BinFromContext(ctx)
+	if !ok {
+		return items
+	}
+	prefix := binKeyPrefix(scope.ID)
+	now := time.Now().Unix()
+	unscoped := items[:0]
+	for _, item := range items {
+		if itemExpired(item, now) {
+			continue
+		}
+		for _, name := range db.scopedAttributes(tableName) {
+			if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+				item[name] = stringValue(strings.TrimPrefix(value.Value, prefix))
+			}
+		}
+		unscoped = append(unscoped, item)
+	}
+	return unscoped
+}
+
+// itemExpired reports whether an item's TTL has passed
+func itemExpired(item map[string]types.AttributeValue, now int64) bool {
+	expiresAt, ok := numberAttribute(item, ExpiresAtAttribute)
+	return ok && expiresAt <= now
+}
+
+// CreateBin stores a bin's definition; it returns ErrBinExists if the ID is already taken
+func (db *Database) CreateBin(ctx context.Context, tableName string, bin model.Bin) (err error) {
+	ctx, span := startSpan(ctx, "CreateBin", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	binJSON, err := json.Marshal(bin)
+	if err != nil {
+		return err
+	}
+	expr, err := expression.NewBuilder().WithCondition(expression.AttributeNotExists(expression.Name("PK"))).Build()
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]types.AttributeValue{
+			"PK":               stringValue(BinKeyPrefix + bin.ID),
+			"SK":               stringValue(binSK),
+			"EventData":        stringValue(string(binJSON)),
+			BinAttribute:       stringValue(bin.ID),
+			ExpiresAtAttribute: numberValue(bin.ExpiresAt.Unix()),
+		},
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	}
+
+	ctx, done := observe(ctx, "PutItem", tableName)
+	_, err = db.svc.PutItem(ctx, input)
+	err = done(err)
+	var exists *types.ConditionalCheckFailedException
+	if errors.As(err, &exists) {
+		return ErrBinExists
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Bin %s created in table %s", bin.ID, tableName)
+	return nil
+}
+
+// GetBin returns a bin's definition, or nil if there is no such bin
+func (db *Database) GetBin(ctx context.Context, tableName, id string) (_ *model.Bin, err error) {
+	ctx, span := startSpan(ctx, "GetBin", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": stringValue(BinKeyPrefix + id),
+			"SK": stringValue(binSK),
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+
+	ctx, done := observe(ctx, "GetItem", tableName)
+	result, err := db.svc.GetItem(ctx, input)
+	err = done(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bin %s: %w", id, err)
+	}
+	data := stringAttribute(result.Item, "EventData")
+	if data == "" {
+		return nil, nil
+	}
+	var bin model.Bin
+	if err := json.Unmarshal([]byte(data), &bin); err != nil {
+		return nil, fmt.Errorf("failed to parse bin %s: %w", id, err)
+	}
+	return &bin, nil
+}
+
+// DeleteBin removes a bin's definition. Events already received into it are no longer
+// reachable and are removed by the table TTL once their retention passes.
+func (db *Database) DeleteBin(ctx context.Context, tableName, id string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteBin", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"PK": stringValue(BinKeyPrefix + id),
+			"SK": stringValue(binSK),
+		},
+	}
+
+	ctx, done := observe(ctx, "DeleteItem", tableName)
+	_, err = db.svc.DeleteItem(ctx, input)
+	return done(err)
+}
+
+// enableTTL turns on expiry through ExpiresAtAttribute; a table that already has a TTL attribute is left alone
+func (db *Database) enableTTL(ctx context.Context, tableName string) error {
+	callCtx, done := observe(ctx, "DescribeTimeToLive", tableName)
+	described, err := db.svc.DescribeTimeToLive(callCtx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err = done(err); err != nil {
+		return err
+	}
+	if description := described.TimeToLiveDescription; description != nil &&
+		description.TimeToLiveStatus != types.TimeToLiveStatusDisabled {
+		return nil
+	}
+
+	callCtx, done = observe(ctx, "UpdateTimeToLive", tableName)
+	_, err = db.svc.UpdateTimeToLive(callCtx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(ExpiresAtAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err = done(err); err != nil {
+		return err
+	}
+	log.Printf("Enabled TTL on %s for attribute %s", tableName, ExpiresAtAttribute)
+	return nil
+}
@@ -0,0 +1,58 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBinScopedKeys checks that items written and read in a bin use the bin's key prefix
+func TestBinScopedKeys(t *testing.T) {
+	// Attribute values are decoded from the wire format, such as {"S": "value"}
+	var put struct {
+		Item map[string]map[string]string
+	}
+	var query struct {
+		ExpressionAttributeValues map[string]map[string]string
+	}
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{
+		"PutItem": func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&put))
+			w.Write([]byte(`{}`))
+		},
+		"Query": func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+			w.Write([]byte(`{"Items":[
+				{"PK":{"S":"BIN#abc##PK#BIGW#ORDER-1"},"ExpiresAt":{"N":"4102444800"}},
+				{"PK":{"S":"BIN#abc##PK#BIGW#ORDER-1"},"ExpiresAt":{"N":"1"}}
+			]}`))
+		},
+	})
+	db := persistenttest.Connect(t, fakeDynamoDB)
+
+	ctx := persistent.WithBin(context.Background(), model.BinScope{ID: "abc", Retention: time.Hour})
+	err := db.StoreOrderEventData(ctx, "Orders", "order/created", "ORDER-1", "2024-06-14T15:55:13Z", "BIGW", map[string]string{}, model.EventOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "BIN#abc##PK#BIGW#ORDER-1", put.Item["PK"]["S"])
+	assert.Equal(t, "abc", put.Item[persistent.BinAttribute]["S"])
+	assert.NotNil(t, put.Item[persistent.ExpiresAtAttribute])
+
+	result, err := db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1"})
+	assert.NoError(t, err)
+	assert.Len(t, query.ExpressionAttributeValues, 1)
+	for _, value := range query.ExpressionAttributeValues {
+		assert.Equal(t, "BIN#abc##PK#BIGW#ORDER-1", value["S"])
+	}
+	// The expired item is dropped and the prefix is stripped from the live one
+	if assert.Len(t, result.Events, 1) {
+		assert.Equal(t, "#PK#BIGW#ORDER-1", result.Events[0].PK)
+	}
+}
@@ -0,0 +1,57 @@
+package persistent
+
+import (
+	"webhook_test_server/model"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Item attributes holding the CloudEvents context of an event received as a CloudEvent
+const (
+	attrCloudEventSpecVersion     = "CeSpecVersion"
+	attrCloudEventID              = "CeId"
+	attrCloudEventSource          = "CeSource"
+	attrCloudEventType            = "CeType"
+	attrCloudEventTime            = "CeTime"
+	attrCloudEventSubject         = "CeSubject"
+	attrCloudEventDataContentType = "CeDataContentType"
+)
+
+// addCloudEventAttributes stores the CloudEvents context alongside the event; empty attributes are omitted
+func addCloudEventAttributes(item map[string]types.AttributeValue, ce *model.CloudEventAttributes) {
+	if ce == nil {
+		return
+	}
+	for name, value := range map[string]string{
+		attrCloudEventSpecVersion:     ce.SpecVersion,
+		attrCloudEventID:              ce.ID,
+		attrCloudEventSource:          ce.Source,
+		attrCloudEventType:            ce.Type,
+		attrCloudEventTime:            ce.Time,
+		attrCloudEventSubject:         ce.Subject,
+		attrCloudEventDataContentType: ce.DataContentType,
+	} {
+		if value != "" {
+			item[name] = stringValue(value)
+		}
+	}
+}
+
+// cloudEventFromItem returns the stored CloudEvents context, or nil when the event was not received as a CloudEvent
+func cloudEventFromItem(item map[string]types.AttributeValue) *model.CloudEventAttributes {
+	if item[attrCloudEventID] == nil {
+		return nil
+	}
+	value := func(name string) string {
+		return stringAttribute(item, name)
+	}
+	return &model.CloudEventAttributes{
+		SpecVersion:     value(attrCloudEventSpecVersion),
+		ID:              value(attrCloudEventID),
+		Source:          value(attrCloudEventSource),
+		Type:            value(attrCloudEventType),
+		Time:            value(attrCloudEventTime),
+		Subject:         value(attrCloudEventSubject),
+		DataContentType: value(attrCloudEventDataContentType),
+	}
+}
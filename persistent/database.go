@@ -1,108 +1,205 @@
 package persistent
 
 import (
+	"context"
 	"log"
-	"os"
 
 	"webhook_test_server/model"
+	"webhook_test_server/tracing"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
 // DatabaseInterface outlines the methods for database operations
 type DatabaseInterface interface {
-	ConnectToDatabase() error
-	InitializeTables(tableName []string) error
+	ConnectToDatabase(ctx context.Context) error
+	InitializeTables(ctx context.Context, tables Tables) error
 	Close()
-	CreateTableIfNotExists(tableName string) error
-	CreateEventsTableIfNotExist(config TableConfig) error
-	StoreData(tableName, pKey string, data interface{}) error
-	DescribeTable(tableName string) error
-	StoreEventData(tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error
-	StoreOrderEventData(tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}) error
-	FetchByPrimaryKey(tableName, pk string) (*dynamodb.QueryOutput, error)
-	FetchByGSI(tableName, gsiName string, keyConditions map[string]*dynamodb.Condition) (*dynamodb.QueryOutput, error)
-	QueryOrderEventsByExternalOrderId(tableName, externalOrderId string) (*dynamodb.QueryOutput, error)
+	CreateTableIfNotExists(ctx context.Context, tableName string) error
+	CreateEventsTableIfNotExist(ctx context.Context, config TableConfig) error
+	MigrateTables(ctx context.Context, tables Tables, dryRun bool) ([]TableChange, error)
+	StoreData(ctx context.Context, tableName, pKey string, data interface{}) error
+	DescribeTable(ctx context.Context, tableName string) error
+	CheckTableHealth(ctx context.Context, tableName string) (TableHealth, error)
+	StoreEventData(ctx context.Context, tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error
+	StoreOrderEventData(ctx context.Context, tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error
+	StoreEvent(ctx context.Context, tableName string, record EventRecord, opts model.EventOptions) error
+	QueryEvents(ctx context.Context, tableName string, query model.EventQuery) (model.EventPage, error)
+	CreateBin(ctx context.Context, tableName string, bin model.Bin) error
+	GetBin(ctx context.Context, tableName, id string) (*model.Bin, error)
+	DeleteBin(ctx context.Context, tableName, id string) error
+	CreateAPIKeysTableIfNotExists(ctx context.Context, tableName string) error
+	StoreAPIKey(ctx context.Context, tableName string, key model.APIKey) error
+	GetAPIKey(ctx context.Context, tableName, id string) (*model.APIKey, error)
+	ListAPIKeys(ctx context.Context, tableName string) ([]model.APIKey, error)
+	DeleteAPIKey(ctx context.Context, tableName, id string) error
 }
 
 // Database represents the database connection.
 type Database struct {
-	svc *dynamodb.DynamoDB
+	svc    *dynamodb.Client
+	tables map[string]TableConfig
+
+	batchConfig *BatchConfig
+	batch       *batchWriter
+
+	connection ConnectionConfig
+	migration  MigrationConfig
+	// tableDefinitions is the table.json describing the tables InitializeTables creates
+	tableDefinitions string
+}
+
+// ConnectionConfig describes how to reach DynamoDB and where the credentials come from. Mode is one of
+// ModeDefault, ModeLocal, ModeProfile, ModeIRSA or ModeStatic; see ResolvedMode for an empty Mode.
+type ConnectionConfig struct {
+	Mode     string
+	Region   string
+	Endpoint string
+	// Profile names the shared config profile used by ModeProfile
+	Profile string
+	// RoleARN, WebIdentityTokenFile and RoleSessionName are used by ModeIRSA
+	RoleARN              string
+	WebIdentityTokenFile string
+	RoleSessionName      string
+	// AccessKeyID, SecretAccessKey and SessionToken are used by ModeStatic
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// DisableSDKRetries makes the SDK send each request once, for callers that retry failed calls themselves
+	// so retries are not stacked
+	DisableSDKRetries bool
 }
 
+// WithConnection sets how the database connects to DynamoDB
+func WithConnection(cfg ConnectionConfig) DatabaseOption {
+	return func(db *Database) {
+		db.connection = cfg
+	}
+}
+
+// WithTableDefinitions sets the table.json InitializeTables reads, instead of persistent/table.json
+func WithTableDefinitions(path string) DatabaseOption {
+	return func(db *Database) {
+		db.tableDefinitions = path
+	}
+}
+
+// TableConfig describes an events table in table.json. The table is created under the name configured for
+// its Role; a definition without a role takes the role of its position, orders then products. BillingMode is
+// PROVISIONED, the default, or PAY_PER_REQUEST, which ignores the capacity units of the table and its indexes.
 type TableConfig struct {
-	TableName              string                           `json:"tableName"`
-	AttributeDefinitions   []*dynamodb.AttributeDefinition  `json:"attributeDefinitions"`
-	KeySchema              []*dynamodb.KeySchemaElement     `json:"keySchema"`
-	GlobalSecondaryIndexes []*dynamodb.GlobalSecondaryIndex `json:"globalSecondaryIndexes"`
-	ReadCapacityUnits      int64                            `json:"readCapacityUnits"`
-	WriteCapacityUnits     int64                            `json:"writeCapacityUnits"`
+	Role                   string                 `json:"role"`
+	TableName              string                 `json:"tableName"`
+	BillingMode            string                 `json:"billingMode"`
+	AttributeDefinitions   []AttributeDefinition  `json:"attributeDefinitions"`
+	KeySchema              []KeySchemaElement     `json:"keySchema"`
+	GlobalSecondaryIndexes []GlobalSecondaryIndex `json:"globalSecondaryIndexes"`
+	ReadCapacityUnits      int64                  `json:"readCapacityUnits"`
+	WriteCapacityUnits     int64                  `json:"writeCapacityUnits"`
+	StreamSpecification    *StreamSpecification   `json:"streamSpecification"`
+	SSESpecification       *SSESpecification      `json:"sseSpecification"`
+	// Tags are applied when the table is created
+	Tags map[string]string `json:"tags"`
+}
+
+// AttributeDefinition declares the type, S, N or B, of a key attribute
+type AttributeDefinition struct {
+	AttributeName string `json:"attributeName"`
+	AttributeType string `json:"attributeType"`
+}
+
+// KeySchemaElement names a HASH or RANGE key attribute
+type KeySchemaElement struct {
+	AttributeName string `json:"attributeName"`
+	KeyType       string `json:"keyType"`
+}
+
+// GlobalSecondaryIndex describes a global secondary index. The projection is ALL, the default, KEYS_ONLY or
+// INCLUDE, which also projects NonKeyAttributes; the capacity defaults to 10 read and 10 write units.
+type GlobalSecondaryIndex struct {
+	IndexName          string             `json:"indexName"`
+	KeySchema          []KeySchemaElement `json:"keySchema"`
+	ProjectionType     string             `json:"projectionType"`
+	NonKeyAttributes   []string           `json:"nonKeyAttributes"`
+	ReadCapacityUnits  int64              `json:"readCapacityUnits"`
+	WriteCapacityUnits int64              `json:"writeCapacityUnits"`
+}
+
+// StreamSpecification enables the table's stream with a view type of KEYS_ONLY, NEW_IMAGE, OLD_IMAGE or
+// NEW_AND_OLD_IMAGES, or disables it. A migration leaves the stream of a table without one as it is.
+type StreamSpecification struct {
+	StreamEnabled  bool   `json:"streamEnabled"`
+	StreamViewType string `json:"streamViewType"`
+}
+
+// SSESpecification encrypts the table with a KMS key, the AWS managed key unless KMSMasterKeyID is set.
+// When it is not enabled the table is encrypted with a key owned by DynamoDB. A migration leaves the
+// encryption of a table without one as it is.
+type SSESpecification struct {
+	Enabled        bool   `json:"enabled"`
+	SSEType        string `json:"sseType"`
+	KMSMasterKeyID string `json:"kmsMasterKeyId"`
 }
 
 type Config struct {
 	Tables []TableConfig `json:"tables"`
 }
 
+// Definition returns the table definition of a role
+func (c *Config) Definition(role string) (TableConfig, bool) {
+	for i, table := range c.Tables {
+		if table.role(i) == role {
+			return table, true
+		}
+	}
+	return TableConfig{}, false
+}
+
 // NewDatabase creates a new database connection based on the environment configuration
-func NewDatabase() (DatabaseInterface, error) {
-	db := &Database{}
-	err := db.ConnectToDatabase()
+func NewDatabase(ctx context.Context, opts ...DatabaseOption) (DatabaseInterface, error) {
+	db := &Database{tableDefinitions: "persistent/table.json", migration: defaultMigrationConfig}
+	for _, opt := range opts {
+		opt(db)
+	}
+	err := db.ConnectToDatabase(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if db.batchConfig != nil {
+		db.batch = newBatchWriter(db.svc, *db.batchConfig)
+	}
 	return db, nil
 }
 
-// ConnectToLocalDynamoDB connects to a local DynamoDB instance.
-func ConnectToLocalDynamoDB() (*dynamodb.DynamoDB, error) {
-	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
-	region := os.Getenv("DYNAMODB_REGION")
-	log.Println("### LOCAL_DYNAMODB.", region)
-	log.Println("### LOCAL_DYNAMODB.", endpoint)
-	if endpoint == "" {
-		endpoint = "http://localhost:8001" // Default local endpoint
-	}
+// ConnectToDatabase creates the DynamoDB client for the configured credential mode and checks that
+// DynamoDB can be reached with it
+func (db *Database) ConnectToDatabase(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "ConnectToDatabase", "")
+	defer func() { tracing.EndSpan(span, err) }()
 
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region:   aws.String(region), // Replace with your desired region
-		Endpoint: aws.String(endpoint),
-		Credentials: credentials.NewStaticCredentials(
-			"dummy",
-			"dummy",
-			""),
-	}))
-
-	return dynamodb.New(sess), nil
-}
-
-// ConnectToDatabase establishes a connection to DynamoDB, either locally or via AWS depending on the environment
-func (db *Database) ConnectToDatabase() error {
-	// Read role ARN and region from environment variables
-	roleAvailable := CheckAWSRoleAvailability()
-	log.Println("### ConnectToDatabase.", roleAvailable)
-
-	var err error
-	if roleAvailable {
-		db.svc, err = ConnectToAWSDynamoDB()
-	} else {
-		db.svc, err = ConnectToLocalDynamoDB()
-	}
+	cfg, err := loadAWSConfig(ctx, db.connection)
 	if err != nil {
 		return err
 	}
-	log.Println("Database connected with signing region:", db.svc.SigningRegion)
+	svc := newClient(cfg, db.connection)
+	if err := checkConnectivity(ctx, svc); err != nil {
+		return err
+	}
+	source := ""
+	if creds, err := cfg.Credentials.Retrieve(ctx); err == nil {
+		source = creds.Source
+	}
+	db.svc = svc
+	log.Printf("Database connected in %s mode to %s in %s with credentials from %s", db.connection.ResolvedMode(), endpointName(svc), cfg.Region, source)
 	return nil
 }
 
 // Close terminates the connection to DynamoDB
 func (db *Database) Close() {
-	if db.svc != nil {
-		db.svc.Client.Config.Credentials.Expire()
-		db.svc.Client.Config.Credentials = nil
-		db.svc.Client = nil
-		db.svc = nil
+	// Flush pending batched writes while the client is still usable
+	if db.batch != nil {
+		db.batch.close()
+		db.batch = nil
 	}
+	db.svc = nil
 }
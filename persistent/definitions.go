@@ -0,0 +1,153 @@
+package persistent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Validate checks every table definition, reporting each invalid setting by its path in table.json
+func (c *Config) Validate() error {
+	if len(c.Tables) == 0 {
+		return errors.New("tables: at least one table is required")
+	}
+	var errs []error
+	roles := make(map[string]bool, len(c.Tables))
+	for i, table := range c.Tables {
+		role := table.role(i)
+		if role == "" {
+			errs = append(errs, fmt.Errorf("tables[%d].role: required past the second table", i))
+		} else if roles[role] {
+			errs = append(errs, fmt.Errorf("tables[%d].role: %q has another definition", i, role))
+		}
+		roles[role] = true
+
+		err := table.Validate()
+		if err == nil {
+			continue
+		}
+		// Each of the table's errors is prefixed, not just the first line of them joined
+		tableErrs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			tableErrs = joined.Unwrap()
+		}
+		for _, err := range tableErrs {
+			errs = append(errs, fmt.Errorf("tables[%d].%w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks that the table definition is one DynamoDB accepts
+func (c TableConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	// DynamoDB only accepts definitions of attributes that are part of a key
+	defined := make(map[string]bool, len(c.AttributeDefinitions))
+	for i, attribute := range c.AttributeDefinitions {
+		check(attribute.AttributeName != "", "attributeDefinitions[%d].attributeName: required", i)
+		check(!defined[attribute.AttributeName], "attributeDefinitions[%d]: %q is defined twice", i, attribute.AttributeName)
+		check(oneOf(attribute.AttributeType, "S", "N", "B"), "attributeDefinitions[%d].attributeType: %q is not S, N or B", i, attribute.AttributeType)
+		defined[attribute.AttributeName] = true
+	}
+	used := make(map[string]bool)
+	keySchemaErrors := func(path string, schema []KeySchemaElement) {
+		for _, err := range validateKeySchema(schema, defined) {
+			errs = append(errs, fmt.Errorf("%s%w", path, err))
+		}
+		for _, element := range schema {
+			used[element.AttributeName] = true
+		}
+	}
+	keySchemaErrors("keySchema", c.KeySchema)
+
+	check(oneOf(c.BillingMode, "", string(types.BillingModeProvisioned), string(types.BillingModePayPerRequest)),
+		"billingMode: %q is not PROVISIONED or PAY_PER_REQUEST", c.BillingMode)
+	if !c.payPerRequest() {
+		check(c.ReadCapacityUnits > 0 && c.WriteCapacityUnits > 0, "readCapacityUnits and writeCapacityUnits: must be positive for PROVISIONED billing")
+	}
+
+	indexes := make(map[string]bool, len(c.GlobalSecondaryIndexes))
+	for i, index := range c.GlobalSecondaryIndexes {
+		path := fmt.Sprintf("globalSecondaryIndexes[%d]", i)
+		check(index.IndexName != "", "%s.indexName: required", path)
+		check(!indexes[index.IndexName], "%s: index %q is defined twice", path, index.IndexName)
+		indexes[index.IndexName] = true
+		keySchemaErrors(path+".keySchema", index.KeySchema)
+		check(oneOf(index.ProjectionType, "", string(types.ProjectionTypeAll), string(types.ProjectionTypeKeysOnly), string(types.ProjectionTypeInclude)),
+			"%s.projectionType: %q is not ALL, KEYS_ONLY or INCLUDE", path, index.ProjectionType)
+		if index.projectionType() == types.ProjectionTypeInclude {
+			check(len(index.NonKeyAttributes) > 0, "%s.nonKeyAttributes: required for an INCLUDE projection", path)
+		} else {
+			check(len(index.NonKeyAttributes) == 0, "%s.nonKeyAttributes: only allowed with an INCLUDE projection", path)
+		}
+		check(index.ReadCapacityUnits >= 0 && index.WriteCapacityUnits >= 0, "%s: capacity units cannot be negative", path)
+	}
+	for _, attribute := range c.AttributeDefinitions {
+		check(used[attribute.AttributeName], "attributeDefinitions: %q is not used by the key schema or an index", attribute.AttributeName)
+	}
+
+	if stream := c.StreamSpecification; stream != nil {
+		if stream.StreamEnabled {
+			check(oneOf(stream.StreamViewType, string(types.StreamViewTypeKeysOnly), string(types.StreamViewTypeNewImage), string(types.StreamViewTypeOldImage), string(types.StreamViewTypeNewAndOldImages)),
+				"streamSpecification.streamViewType: %q is not KEYS_ONLY, NEW_IMAGE, OLD_IMAGE or NEW_AND_OLD_IMAGES", stream.StreamViewType)
+		} else {
+			check(stream.StreamViewType == "", "streamSpecification.streamViewType: only allowed when streamEnabled is true")
+		}
+	}
+	if sse := c.SSESpecification; sse != nil {
+		check(oneOf(sse.SSEType, "", string(types.SSETypeKms)), "sseSpecification.sseType: %q is not KMS", sse.SSEType)
+		check(sse.Enabled || (sse.SSEType == "" && sse.KMSMasterKeyID == ""), "sseSpecification: sseType and kmsMasterKeyId need enabled to be true")
+	}
+	for key, value := range c.Tags {
+		check(key != "" && len(key) <= 128, "tags: key %q must be 1 to 128 characters", key)
+		check(len(value) <= 256, "tags.%s: value must be at most 256 characters", key)
+		check(!strings.HasPrefix(key, "aws:"), "tags: key %q uses the reserved aws: prefix", key)
+	}
+	return errors.Join(errs...)
+}
+
+// role returns the role of the definition at a position in table.json
+func (c TableConfig) role(position int) string {
+	if c.Role != "" {
+		return c.Role
+	}
+	return PositionalRole(position)
+}
+
+// validateKeySchema checks a key schema has a HASH key, optionally followed by a RANGE key, on defined attributes
+func validateKeySchema(schema []KeySchemaElement, defined map[string]bool) []error {
+	if len(schema) == 0 || len(schema) > 2 {
+		return []error{errors.New(": needs a HASH key and at most one RANGE key")}
+	}
+	var errs []error
+	for i, element := range schema {
+		keyType := string(types.KeyTypeHash)
+		if i == 1 {
+			keyType = string(types.KeyTypeRange)
+		}
+		if element.KeyType != keyType {
+			errs = append(errs, fmt.Errorf("[%d].keyType: %q should be %s", i, element.KeyType, keyType))
+		}
+		if !defined[element.AttributeName] {
+			errs = append(errs, fmt.Errorf("[%d].attributeName: %q is not in attributeDefinitions", i, element.AttributeName))
+		}
+	}
+	return errs
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTableDefinitions checks that table.json is validated on load and that on-demand billing, index
+// projections, streams, encryption and tags reach CreateTable
+func TestTableDefinitions(t *testing.T) {
+	_, err := persistent.LoadTableDefinitions(persistenttest.WriteDefinitions(t, `{"tableName": "Orders", "projection": "ALL"}`))
+	assert.ErrorContains(t, err, `unknown field "projection"`)
+
+	_, err = persistent.LoadTableDefinitions(persistenttest.WriteDefinitions(t, `{
+		"tableName": "Orders", "billingMode": "ON_DEMAND",
+		"attributeDefinitions": [{"attributeName": "PK", "attributeType": "S"}, {"attributeName": "Unused", "attributeType": "S"}],
+		"keySchema": [{"attributeName": "PK", "keyType": "HASH"}],
+		"globalSecondaryIndexes": [{"indexName": "ByPK", "keySchema": [{"attributeName": "PK", "keyType": "HASH"}], "projectionType": "INCLUDE"}],
+		"streamSpecification": {"streamEnabled": true, "streamViewType": "EVERYTHING"}
+	}`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `tables[0].billingMode: "ON_DEMAND" is not PROVISIONED or PAY_PER_REQUEST`)
+		assert.Contains(t, err.Error(), `tables[0].attributeDefinitions: "Unused" is not used`)
+		assert.Contains(t, err.Error(), "tables[0].globalSecondaryIndexes[0].nonKeyAttributes: required for an INCLUDE projection")
+		assert.Contains(t, err.Error(), `streamSpecification.streamViewType: "EVERYTHING"`)
+	}
+
+	definitions := persistenttest.WriteDefinitions(t, `{
+		"tableName": "Orders", "billingMode": "PAY_PER_REQUEST",
+		"attributeDefinitions": [{"attributeName": "PK", "attributeType": "S"}, {"attributeName": "DealId", "attributeType": "S"}],
+		"keySchema": [{"attributeName": "PK", "keyType": "HASH"}],
+		"globalSecondaryIndexes": [{"indexName": "DealIdIndex", "keySchema": [{"attributeName": "DealId", "keyType": "HASH"}],
+			"projectionType": "INCLUDE", "nonKeyAttributes": ["EventType"]}],
+		"streamSpecification": {"streamEnabled": true, "streamViewType": "NEW_IMAGE"},
+		"sseSpecification": {"enabled": true, "kmsMasterKeyId": "alias/webhooks"},
+		"tags": {"team": "integrations"}
+	}`)
+	var create map[string]interface{}
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{
+		"DescribeTable": func(w http.ResponseWriter, r *http.Request) {
+			if create == nil {
+				persistenttest.WriteError(w, "ResourceNotFoundException", "Requested resource not found")
+				return
+			}
+			w.Write([]byte(`{"Table":{"TableName":"Orders","TableStatus":"ACTIVE"}}`))
+		},
+		"CreateTable": func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&create))
+			w.Write([]byte(`{}`))
+		},
+	})
+	db := persistenttest.Connect(t, fakeDynamoDB,
+		persistent.WithTableDefinitions(definitions),
+		persistent.WithMigrations(persistent.MigrationConfig{PollInterval: time.Millisecond}))
+	_, err = db.MigrateTables(context.Background(), persistent.Tables{persistent.RoleOrders: "Orders"}, false)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "PAY_PER_REQUEST", create["BillingMode"])
+	assert.NotContains(t, create, "ProvisionedThroughput")
+	index := create["GlobalSecondaryIndexes"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"ProjectionType": "INCLUDE", "NonKeyAttributes": []interface{}{"EventType"}}, index["Projection"])
+	assert.NotContains(t, index, "ProvisionedThroughput")
+	assert.Equal(t, map[string]interface{}{"StreamEnabled": true, "StreamViewType": "NEW_IMAGE"}, create["StreamSpecification"])
+	assert.Equal(t, map[string]interface{}{"Enabled": true, "SSEType": "KMS", "KMSMasterKeyId": "alias/webhooks"}, create["SSESpecification"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"Key": "team", "Value": "integrations"}}, create["Tags"])
+}
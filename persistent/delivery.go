@@ -0,0 +1,44 @@
+package persistent
+
+import (
+	"webhook_test_server/model"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Item attributes describing how an event reached the server
+const (
+	attrClientCertSubject = "ClientCertSubject"
+	attrContentEncoding   = "ContentEncoding"
+	attrCompressedBytes   = "CompressedBytes"
+	attrBodyBytes         = "BodyBytes"
+)
+
+// addDeliveryAttributes stores the delivery details alongside the event; empty attributes are omitted
+func addDeliveryAttributes(item map[string]types.AttributeValue, delivery *model.Delivery) {
+	if delivery == nil {
+		return
+	}
+	if delivery.ClientCertSubject != "" {
+		item[attrClientCertSubject] = stringValue(delivery.ClientCertSubject)
+	}
+	if delivery.ContentEncoding != "" {
+		item[attrContentEncoding] = stringValue(delivery.ContentEncoding)
+		item[attrCompressedBytes] = numberValue(delivery.CompressedBytes)
+		item[attrBodyBytes] = numberValue(delivery.BodyBytes)
+	}
+}
+
+// deliveryFromItem returns the stored delivery details, or nil when none were recorded
+func deliveryFromItem(item map[string]types.AttributeValue) *model.Delivery {
+	delivery := model.Delivery{
+		ClientCertSubject: stringAttribute(item, attrClientCertSubject),
+		ContentEncoding:   stringAttribute(item, attrContentEncoding),
+	}
+	delivery.CompressedBytes, _ = numberAttribute(item, attrCompressedBytes)
+	delivery.BodyBytes, _ = numberAttribute(item, attrBodyBytes)
+	if delivery == (model.Delivery{}) {
+		return nil
+	}
+	return &delivery
+}
@@ -0,0 +1,58 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// IsThrottlingError reports whether err was caused by DynamoDB or AWS request throttling
+func IsThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException",
+		"RequestLimitExceeded",
+		"ThrottlingException",
+		"Throttling":
+		return true
+	}
+	return false
+}
+
+// IsRetryableError reports whether a failed call may succeed when it is made again: throttling,
+// server-side errors, timeouts and network errors. Client errors such as validation failures and
+// failed conditions are not retryable.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsThrottlingError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "InternalServerError",
+			"TransactionConflictException",
+			"ServiceUnavailable",
+			"InternalFailure",
+			"RequestTimeout",
+			"RequestTimeoutException":
+			return true
+		}
+	}
+	// The request never got a response, or timed out waiting for one
+	var sendErr *smithyhttp.RequestSendError
+	var netErr net.Error
+	if errors.As(err, &sendErr) || errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var response interface{ HTTPStatusCode() int }
+	return errors.As(err, &response) && response.HTTPStatusCode() >= 500
+}
@@ -0,0 +1,64 @@
+package persistent
+
+import (
+	"context"
+	"sort"
+
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TableHealth describes whether a table and its global secondary indexes can serve traffic
+type TableHealth struct {
+	TableName      string            `json:"tableName"`
+	Status         string            `json:"status"`
+	Indexes        map[string]string `json:"indexes,omitempty"`
+	MissingIndexes []string          `json:"missingIndexes,omitempty"`
+}
+
+// Ready reports whether the table and every index on it are ACTIVE and no expected index is missing
+func (t TableHealth) Ready() bool {
+	if t.Status != string(types.TableStatusActive) || len(t.MissingIndexes) > 0 {
+		return false
+	}
+	for _, status := range t.Indexes {
+		if status != string(types.IndexStatusActive) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckTableHealth describes a table and compares its indexes with the ones configured in table.json
+func (db *Database) CheckTableHealth(ctx context.Context, tableName string) (_ TableHealth, err error) {
+	ctx, span := startSpan(ctx, "CheckTableHealth", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	ctx, done := observe(ctx, "DescribeTable", tableName)
+	result, err := db.svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	err = done(err)
+	if err != nil {
+		return TableHealth{TableName: tableName}, err
+	}
+
+	health := TableHealth{
+		TableName: tableName,
+		Status:    string(result.Table.TableStatus),
+		Indexes:   make(map[string]string),
+	}
+	for _, index := range result.Table.GlobalSecondaryIndexes {
+		health.Indexes[aws.ToString(index.IndexName)] = string(index.IndexStatus)
+	}
+	for _, index := range db.tables[tableName].GlobalSecondaryIndexes {
+		if _, ok := health.Indexes[index.IndexName]; !ok {
+			health.MissingIndexes = append(health.MissingIndexes, index.IndexName)
+		}
+	}
+	sort.Strings(health.MissingIndexes)
+	return health, nil
+}
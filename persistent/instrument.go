@@ -0,0 +1,47 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("webhook_test_server/persistent")
+
+// startSpan starts the span covering a Database method that operates on table
+func startSpan(ctx context.Context, method, table string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Database."+method, trace.WithAttributes(
+		semconv.DBSystemDynamoDB,
+		attribute.String("db.dynamodb.table", table),
+	))
+}
+
+// observe starts a client span for a single DynamoDB API call. The returned
+// function ends the span, records the call's latency and error metrics, and
+// returns the call's error wrapped with the context error when the call was
+// cut short by a deadline or cancellation.
+func observe(ctx context.Context, operation, table string) (context.Context, func(error) error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "DynamoDB."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemDynamoDB,
+		semconv.RPCService("DynamoDB"),
+		semconv.RPCMethod(operation),
+		attribute.String("db.dynamodb.table", table),
+	))
+	return ctx, func(err error) error {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		metrics.ObserveDynamoDB(operation, table, start, err)
+		tracing.EndSpan(span, err)
+		return err
+	}
+}
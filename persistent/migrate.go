@@ -0,0 +1,350 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MigrationConfig controls how a migration waits for a table to settle after each change
+type MigrationConfig struct {
+	// PollInterval is how often the table is described while waiting for it to become ACTIVE
+	PollInterval time.Duration
+	// Timeout bounds the wait after each change; backfilling a new index on a large table takes a while
+	Timeout time.Duration
+	// DeleteIndexes allows deleting indexes that are no longer defined or must be recreated. Without it they
+	// are left in place, as queries on them fail until a recreated index has been backfilled.
+	DeleteIndexes bool
+}
+
+var defaultMigrationConfig = MigrationConfig{PollInterval: 5 * time.Second, Timeout: 30 * time.Minute}
+
+// WithMigrations sets how migrations wait for tables to become ACTIVE and whether they delete indexes;
+// unset durations keep their defaults
+func WithMigrations(cfg MigrationConfig) DatabaseOption {
+	return func(db *Database) {
+		if cfg.PollInterval > 0 {
+			db.migration.PollInterval = cfg.PollInterval
+		}
+		if cfg.Timeout > 0 {
+			db.migration.Timeout = cfg.Timeout
+		}
+		db.migration.DeleteIndexes = cfg.DeleteIndexes
+	}
+}
+
+// TableChange is a step of a table migration, made with a single CreateTable or UpdateTable call
+type TableChange struct {
+	Table       string
+	Description string
+
+	create *dynamodb.CreateTableInput
+	update *dynamodb.UpdateTableInput
+}
+
+func (c TableChange) String() string {
+	return c.Table + ": " + c.Description
+}
+
+// MigrateTables brings the configured tables in line with table.json. Missing tables are created, indexes
+// are added, and removed when DeleteIndexes allows it, and the billing mode, capacity, stream and encryption
+// are adjusted. DynamoDB creates or deletes one index per call, so each change is applied on its own and
+// waited on until the table and its indexes are ACTIVE. A table another replica is already changing is left
+// to that replica. With dryRun the changes are only returned.
+func (db *Database) MigrateTables(ctx context.Context, tables Tables, dryRun bool) (changes []TableChange, err error) {
+	ctx, span := startSpan(ctx, "MigrateTables", "")
+	defer func() { tracing.EndSpan(span, err) }()
+
+	configs, err := db.tableConfigs(tables)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, tableConfig := range configs {
+		tableChanges, err := db.planMigration(ctx, tableConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to plan migration of table %s: %w", tableConfig.TableName, err))
+			continue
+		}
+		changes = append(changes, tableChanges...)
+		if dryRun {
+			continue
+		}
+		for _, change := range tableChanges {
+			log.Printf("Migrating %s", change)
+			err := db.applyChange(ctx, change)
+			var inUse *types.ResourceInUseException
+			if errors.As(err, &inUse) {
+				log.Printf("Table %s is being changed, presumably by another replica migrating it, leaving the rest of its migration", change.Table)
+				break
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to migrate %s: %w", change, err))
+				break
+			}
+		}
+	}
+	return changes, errors.Join(errs...)
+}
+
+// planMigration lists the changes that turn the table as it exists into the table config
+func (db *Database) planMigration(ctx context.Context, config TableConfig) ([]TableChange, error) {
+	table, err := db.describeTable(ctx, config.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return []TableChange{{Table: config.TableName, Description: "create table", create: config.createTableInput()}}, nil
+	}
+	return config.diff(table, db.migration.DeleteIndexes), nil
+}
+
+// diff lists the UpdateTable calls that turn a table description into the table config. Indexes are removed
+// first, so a switch to provisioned billing only needs capacity for the indexes that stay, and created last.
+// An index whose key schema or projection changed cannot be updated, so it is removed and created again.
+// Without deleteIndexes such indexes and those no longer defined are left as they are. Tags are only set
+// when a table is created.
+func (c TableConfig) diff(table *types.TableDescription, deleteIndexes bool) []TableChange {
+	var changes []TableChange
+	update := func(description string, input *dynamodb.UpdateTableInput) {
+		input.TableName = aws.String(c.TableName)
+		changes = append(changes, TableChange{Table: c.TableName, Description: description, update: input})
+	}
+	deleteIndex := func(description, name string) {
+		update(description, &dynamodb.UpdateTableInput{GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: aws.String(name)}},
+		}})
+	}
+
+	current := make(map[string]types.GlobalSecondaryIndexDescription, len(table.GlobalSecondaryIndexes))
+	for _, index := range table.GlobalSecondaryIndexes {
+		current[aws.ToString(index.IndexName)] = index
+	}
+	desired := make(map[string]bool, len(c.GlobalSecondaryIndexes))
+	for _, index := range c.GlobalSecondaryIndexes {
+		desired[index.IndexName] = true
+	}
+	// Undefined indexes that stay need capacity of their own on a switch to provisioned billing
+	var undefined []string
+	for _, index := range table.GlobalSecondaryIndexes {
+		name := aws.ToString(index.IndexName)
+		switch {
+		case desired[name]:
+		case deleteIndexes:
+			deleteIndex("delete index "+name, name)
+		default:
+			log.Printf("Leaving index %s of table %s, which is no longer defined, as deleting indexes is not enabled", name, c.TableName)
+			undefined = append(undefined, name)
+		}
+	}
+	var kept, created []GlobalSecondaryIndex
+	for _, index := range c.GlobalSecondaryIndexes {
+		existing, ok := current[index.IndexName]
+		switch {
+		case !ok:
+			created = append(created, index)
+		case !index.matches(existing) && deleteIndexes:
+			deleteIndex("delete index "+index.IndexName+" to recreate it with a new key schema or projection", index.IndexName)
+			created = append(created, index)
+		case !index.matches(existing):
+			log.Printf("Leaving index %s of table %s with its old key schema or projection, as deleting indexes is not enabled", index.IndexName, c.TableName)
+			kept = append(kept, index)
+		default:
+			kept = append(kept, index)
+		}
+	}
+
+	billingMode := types.BillingModeProvisioned
+	if summary := table.BillingModeSummary; summary != nil && summary.BillingMode != "" {
+		billingMode = summary.BillingMode
+	}
+	switch {
+	case c.payPerRequest() && billingMode != types.BillingModePayPerRequest:
+		update("switch billing mode to PAY_PER_REQUEST", &dynamodb.UpdateTableInput{BillingMode: types.BillingModePayPerRequest})
+	case !c.payPerRequest() && billingMode != types.BillingModeProvisioned:
+		// Every remaining index needs its capacity in the same call
+		input := &dynamodb.UpdateTableInput{
+			BillingMode:           types.BillingModeProvisioned,
+			ProvisionedThroughput: throughput(c.ReadCapacityUnits, c.WriteCapacityUnits),
+		}
+		for _, index := range kept {
+			input.GlobalSecondaryIndexUpdates = append(input.GlobalSecondaryIndexUpdates, types.GlobalSecondaryIndexUpdate{
+				Update: &types.UpdateGlobalSecondaryIndexAction{IndexName: aws.String(index.IndexName), ProvisionedThroughput: throughput(index.capacity())},
+			})
+		}
+		for _, name := range undefined {
+			input.GlobalSecondaryIndexUpdates = append(input.GlobalSecondaryIndexUpdates, types.GlobalSecondaryIndexUpdate{
+				Update: &types.UpdateGlobalSecondaryIndexAction{IndexName: aws.String(name), ProvisionedThroughput: throughput(GlobalSecondaryIndex{}.capacity())},
+			})
+		}
+		update(fmt.Sprintf("switch billing mode to PROVISIONED with %d read and %d write capacity units", c.ReadCapacityUnits, c.WriteCapacityUnits), input)
+	case !c.payPerRequest():
+		if !sameThroughput(table.ProvisionedThroughput, c.ReadCapacityUnits, c.WriteCapacityUnits) {
+			update(fmt.Sprintf("set capacity to %d read and %d write units", c.ReadCapacityUnits, c.WriteCapacityUnits),
+				&dynamodb.UpdateTableInput{ProvisionedThroughput: throughput(c.ReadCapacityUnits, c.WriteCapacityUnits)})
+		}
+		for _, index := range kept {
+			read, write := index.capacity()
+			if !sameThroughput(current[index.IndexName].ProvisionedThroughput, read, write) {
+				update(fmt.Sprintf("set capacity of index %s to %d read and %d write units", index.IndexName, read, write),
+					&dynamodb.UpdateTableInput{GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+						{Update: &types.UpdateGlobalSecondaryIndexAction{IndexName: aws.String(index.IndexName), ProvisionedThroughput: throughput(read, write)}},
+					}})
+			}
+		}
+	}
+
+	// A table config without a stream or encryption setting leaves the table's as it is, so only settings
+	// table.json states, such as an explicit "streamEnabled": false, are reconciled. A stream's view type
+	// cannot be changed while it is enabled, so it is disabled first.
+	if c.StreamSpecification != nil {
+		currentStream := table.StreamSpecification
+		streamEnabled := currentStream != nil && aws.ToBool(currentStream.StreamEnabled)
+		stream := c.streamSpecification()
+		if streamEnabled && (stream == nil || stream.StreamViewType != currentStream.StreamViewType) {
+			update("disable stream", &dynamodb.UpdateTableInput{StreamSpecification: &types.StreamSpecification{StreamEnabled: aws.Bool(false)}})
+			streamEnabled = false
+		}
+		if !streamEnabled && stream != nil {
+			update("enable stream with view type "+string(stream.StreamViewType), &dynamodb.UpdateTableInput{StreamSpecification: stream})
+		}
+	}
+
+	// The KMS key is not compared, as DynamoDB reports its ARN rather than the ID it was set with
+	if c.SSESpecification != nil {
+		sseEnabled := table.SSEDescription != nil && (table.SSEDescription.Status == types.SSEStatusEnabled || table.SSEDescription.Status == types.SSEStatusEnabling)
+		if sse := c.sseSpecification(); sse != nil && !sseEnabled {
+			update("encrypt with a KMS key", &dynamodb.UpdateTableInput{SSESpecification: sse})
+		} else if sse == nil && sseEnabled {
+			update("encrypt with a key owned by DynamoDB", &dynamodb.UpdateTableInput{SSESpecification: &types.SSESpecification{Enabled: aws.Bool(false)}})
+		}
+	}
+
+	for _, index := range created {
+		gsi := c.globalSecondaryIndex(index)
+		update("create index "+index.IndexName, &dynamodb.UpdateTableInput{
+			AttributeDefinitions: c.attributeDefinitions(),
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:             gsi.IndexName,
+				KeySchema:             gsi.KeySchema,
+				Projection:            gsi.Projection,
+				ProvisionedThroughput: gsi.ProvisionedThroughput,
+			}}},
+		})
+	}
+	return changes
+}
+
+// matches reports whether an existing index has the key schema and projection of the index config
+func (i GlobalSecondaryIndex) matches(existing types.GlobalSecondaryIndexDescription) bool {
+	if existing.Projection == nil || existing.Projection.ProjectionType != i.projectionType() {
+		return false
+	}
+	if !sameSet(existing.Projection.NonKeyAttributes, i.NonKeyAttributes) {
+		return false
+	}
+	if len(existing.KeySchema) != len(i.KeySchema) {
+		return false
+	}
+	for n, element := range i.KeySchema {
+		if aws.ToString(existing.KeySchema[n].AttributeName) != element.AttributeName || existing.KeySchema[n].KeyType != types.KeyType(element.KeyType) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	members := make(map[string]bool, len(a))
+	for _, s := range a {
+		members[s] = true
+	}
+	for _, s := range b {
+		if !members[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameThroughput(current *types.ProvisionedThroughputDescription, read, write int64) bool {
+	return current != nil && aws.ToInt64(current.ReadCapacityUnits) == read && aws.ToInt64(current.WriteCapacityUnits) == write
+}
+
+// applyChange makes a migration change and waits for the table to settle before the next one
+func (db *Database) applyChange(ctx context.Context, change TableChange) error {
+	var err error
+	if change.create != nil {
+		callCtx, done := observe(ctx, "CreateTable", change.Table)
+		_, err = db.svc.CreateTable(callCtx, change.create)
+		err = done(err)
+	} else {
+		callCtx, done := observe(ctx, "UpdateTable", change.Table)
+		_, err = db.svc.UpdateTable(callCtx, change.update)
+		err = done(err)
+	}
+	if err != nil {
+		return err
+	}
+	return db.waitForActive(ctx, change.Table)
+}
+
+// waitForActive polls a table until it and all of its indexes are ACTIVE
+func (db *Database) waitForActive(ctx context.Context, tableName string) error {
+	ctx, cancel := context.WithTimeout(ctx, db.migration.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(db.migration.PollInterval)
+	defer ticker.Stop()
+	for {
+		table, err := db.describeTable(ctx, tableName)
+		if err != nil {
+			return err
+		}
+		if table != nil && tableActive(table) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("table %s did not become ACTIVE within %s: %w", tableName, db.migration.Timeout, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func tableActive(table *types.TableDescription) bool {
+	if table.TableStatus != types.TableStatusActive {
+		return false
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if index.IndexStatus != types.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+// describeTable returns the description of a table, or nil when the table does not exist
+func (db *Database) describeTable(ctx context.Context, tableName string) (*types.TableDescription, error) {
+	ctx, done := observe(ctx, "DescribeTable", tableName)
+	result, err := db.svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		done(nil)
+		return nil, nil
+	}
+	if err = done(err); err != nil {
+		return nil, err
+	}
+	return result.Table, nil
+}
@@ -0,0 +1,139 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTableMigration checks that an existing table is diffed against its definition, that a plan changes
+// nothing, that each change is applied on its own once the table is ACTIVE again, that indexes are only
+// deleted when allowed and that a table another replica is migrating is left alone
+func TestTableMigration(t *testing.T) {
+	definitions := persistenttest.WriteDefinitions(t, `{
+		"tableName": "Orders",
+		"attributeDefinitions": [{"attributeName": "PK", "attributeType": "S"}, {"attributeName": "SK", "attributeType": "S"}, {"attributeName": "DealId", "attributeType": "S"}],
+		"keySchema": [{"attributeName": "PK", "keyType": "HASH"}, {"attributeName": "SK", "keyType": "RANGE"}],
+		"globalSecondaryIndexes": [{"indexName": "DealIdIndex", "keySchema": [{"attributeName": "DealId", "keyType": "HASH"}], "readCapacityUnits": 20}],
+		"readCapacityUnits": 10, "writeCapacityUnits": 10
+	}`)
+
+	var updates []map[string]interface{}
+	tableStatus := "ACTIVE"
+	inUse := false
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{
+		"DescribeTable": func(w http.ResponseWriter, r *http.Request) {
+			// The table reports UPDATING once after each change
+			status := tableStatus
+			tableStatus = "ACTIVE"
+			fmt.Fprintf(w, `{"Table":{"TableName":"Orders","TableStatus":%q,
+				"ProvisionedThroughput":{"ReadCapacityUnits":5,"WriteCapacityUnits":5},
+				"GlobalSecondaryIndexes":[{"IndexName":"LegacyIndex","IndexStatus":"ACTIVE",
+					"KeySchema":[{"AttributeName":"SK","KeyType":"HASH"}],"Projection":{"ProjectionType":"KEYS_ONLY"}}]}}`, status)
+		},
+		"UpdateTable": func(w http.ResponseWriter, r *http.Request) {
+			var update map[string]interface{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+			updates = append(updates, update)
+			if inUse {
+				persistenttest.WriteError(w, "ResourceInUseException", "Attempt to change a resource which is still in use")
+				return
+			}
+			tableStatus = "UPDATING"
+			w.Write([]byte(`{}`))
+		},
+	})
+	connect := func(deleteIndexes bool) persistent.DatabaseInterface {
+		return persistenttest.Connect(t, fakeDynamoDB,
+			persistent.WithTableDefinitions(definitions),
+			persistent.WithMigrations(persistent.MigrationConfig{PollInterval: time.Millisecond, Timeout: time.Second, DeleteIndexes: deleteIndexes}))
+	}
+	plan := func(db persistent.DatabaseInterface) []string {
+		changes, err := db.MigrateTables(context.Background(), persistent.Tables{persistent.RoleOrders: "Orders"}, true)
+		assert.NoError(t, err)
+		var plan []string
+		for _, change := range changes {
+			plan = append(plan, change.String())
+		}
+		return plan
+	}
+
+	// The undefined index is left in place unless deleting indexes is enabled
+	assert.Equal(t, []string{
+		"Orders: set capacity to 10 read and 10 write units",
+		"Orders: create index DealIdIndex",
+	}, plan(connect(false)))
+	db := connect(true)
+	assert.Equal(t, []string{
+		"Orders: delete index LegacyIndex",
+		"Orders: set capacity to 10 read and 10 write units",
+		"Orders: create index DealIdIndex",
+	}, plan(db))
+	assert.Empty(t, updates)
+
+	_, err := db.MigrateTables(context.Background(), persistent.Tables{persistent.RoleOrders: "Orders"}, false)
+	assert.NoError(t, err)
+	if assert.Len(t, updates, 3) {
+		assert.Contains(t, updates[0], "GlobalSecondaryIndexUpdates")
+		assert.Contains(t, updates[1], "ProvisionedThroughput")
+		create := updates[2]["GlobalSecondaryIndexUpdates"].([]interface{})[0].(map[string]interface{})["Create"].(map[string]interface{})
+		assert.Equal(t, "DealIdIndex", create["IndexName"])
+		assert.Equal(t, map[string]interface{}{"ProjectionType": "ALL"}, create["Projection"])
+		// An unset capacity defaults on its own
+		assert.Equal(t, map[string]interface{}{"ReadCapacityUnits": 20.0, "WriteCapacityUnits": 10.0}, create["ProvisionedThroughput"])
+		assert.Len(t, updates[2]["AttributeDefinitions"], 3)
+	}
+
+	// A table another replica is changing is left to it, without failing the start
+	updates, inUse = nil, true
+	_, err = db.MigrateTables(context.Background(), persistent.Tables{persistent.RoleOrders: "Orders"}, false)
+	assert.NoError(t, err)
+	assert.Len(t, updates, 1)
+}
+
+// TestMigrationStreamAndEncryption checks that a stream and encryption left out of a definition are kept
+// and that only settings the definition states are reconciled
+func TestMigrationStreamAndEncryption(t *testing.T) {
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{
+		"DescribeTable": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Table":{"TableName":"Orders","TableStatus":"ACTIVE",
+				"ProvisionedThroughput":{"ReadCapacityUnits":10,"WriteCapacityUnits":10},
+				"StreamSpecification":{"StreamEnabled":true,"StreamViewType":"NEW_IMAGE"},
+				"SSEDescription":{"Status":"ENABLED","SSEType":"KMS"}}}`))
+		},
+	})
+	plan := func(settings string) []string {
+		definitions := persistenttest.WriteDefinitions(t, `{
+			"tableName": "Orders",
+			"attributeDefinitions": [{"attributeName": "PK", "attributeType": "S"}],
+			"keySchema": [{"attributeName": "PK", "keyType": "HASH"}],
+			"readCapacityUnits": 10, "writeCapacityUnits": 10`+settings+`
+		}`)
+		db := persistenttest.Connect(t, fakeDynamoDB, persistent.WithTableDefinitions(definitions))
+		changes, err := db.MigrateTables(context.Background(), persistent.Tables{persistent.RoleOrders: "Orders"}, true)
+		assert.NoError(t, err)
+		var plan []string
+		for _, change := range changes {
+			plan = append(plan, change.String())
+		}
+		return plan
+	}
+
+	assert.Empty(t, plan(""))
+	assert.Equal(t, []string{
+		"Orders: disable stream",
+		"Orders: encrypt with a key owned by DynamoDB",
+	}, plan(`, "streamSpecification": {"streamEnabled": false}, "sseSpecification": {"enabled": false}`))
+	assert.Equal(t, []string{
+		"Orders: disable stream",
+		"Orders: enable stream with view type NEW_AND_OLD_IMAGES",
+	}, plan(`, "streamSpecification": {"streamEnabled": true, "streamViewType": "NEW_AND_OLD_IMAGES"}`))
+}
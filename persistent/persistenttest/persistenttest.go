@@ -0,0 +1,220 @@
+// Package persistenttest provides the database fixtures shared by the package tests: a mock of the
+// DatabaseInterface, a fake DynamoDB endpoint and sample events.
+package persistenttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// MockDB mocks the DatabaseInterface
+type MockDB struct {
+	mock.Mock
+}
+
+func (m *MockDB) ConnectToDatabase(ctx context.Context) error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockDB) Close() {
+	m.Called()
+}
+
+func (m *MockDB) CreateTableIfNotExists(ctx context.Context, tableName string) error {
+	args := m.Called(tableName)
+	return args.Error(0)
+}
+
+func (m *MockDB) CreateEventsTableIfNotExist(ctx context.Context, config persistent.TableConfig) error {
+	args := m.Called(config)
+	return args.Error(0)
+}
+
+func (m *MockDB) MigrateTables(ctx context.Context, tables persistent.Tables, dryRun bool) ([]persistent.TableChange, error) {
+	args := m.Called(tables, dryRun)
+	return args.Get(0).([]persistent.TableChange), args.Error(1)
+}
+
+func (m *MockDB) StoreData(ctx context.Context, tableName, pKey string, data interface{}) error {
+	args := m.Called(tableName, pKey, data)
+	return args.Error(0)
+}
+
+func (m *MockDB) DescribeTable(ctx context.Context, tableName string) error {
+	args := m.Called(tableName)
+	return args.Error(0)
+}
+
+func (m *MockDB) CheckTableHealth(ctx context.Context, tableName string) (persistent.TableHealth, error) {
+	args := m.Called(tableName)
+	return args.Get(0).(persistent.TableHealth), args.Error(1)
+}
+
+func (m *MockDB) InitializeTables(ctx context.Context, tables persistent.Tables) error {
+	args := m.Called(tables)
+	return args.Error(0)
+}
+
+func (m *MockDB) StoreEventData(ctx context.Context, tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	args := m.Called(tableName, eventType, eventId, lastUpdated, merchantId, eventData, opts)
+	return args.Error(0)
+}
+
+func (m *MockDB) StoreOrderEventData(ctx context.Context, tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	args := m.Called(tableName, eventType, externalOrderId, lastUpdated, merchantId, eventData, opts)
+	return args.Error(0)
+}
+
+func (m *MockDB) StoreEvent(ctx context.Context, tableName string, record persistent.EventRecord, opts model.EventOptions) error {
+	args := m.Called(tableName, record, opts)
+	return args.Error(0)
+}
+
+func (m *MockDB) QueryEvents(ctx context.Context, tableName string, query model.EventQuery) (model.EventPage, error) {
+	args := m.Called(tableName, query)
+	return args.Get(0).(model.EventPage), args.Error(1)
+}
+
+func (m *MockDB) CreateBin(ctx context.Context, tableName string, bin model.Bin) error {
+	args := m.Called(tableName, bin)
+	return args.Error(0)
+}
+
+func (m *MockDB) GetBin(ctx context.Context, tableName, id string) (*model.Bin, error) {
+	args := m.Called(tableName, id)
+	bin, _ := args.Get(0).(*model.Bin)
+	return bin, args.Error(1)
+}
+
+func (m *MockDB) DeleteBin(ctx context.Context, tableName, id string) error {
+	args := m.Called(tableName, id)
+	return args.Error(0)
+}
+
+func (m *MockDB) CreateAPIKeysTableIfNotExists(ctx context.Context, tableName string) error {
+	args := m.Called(tableName)
+	return args.Error(0)
+}
+
+func (m *MockDB) StoreAPIKey(ctx context.Context, tableName string, key model.APIKey) error {
+	args := m.Called(tableName, key)
+	return args.Error(0)
+}
+
+func (m *MockDB) GetAPIKey(ctx context.Context, tableName, id string) (*model.APIKey, error) {
+	args := m.Called(tableName, id)
+	key, _ := args.Get(0).(*model.APIKey)
+	return key, args.Error(1)
+}
+
+func (m *MockDB) ListAPIKeys(ctx context.Context, tableName string) ([]model.APIKey, error) {
+	args := m.Called(tableName)
+	keys, _ := args.Get(0).([]model.APIKey)
+	return keys, args.Error(1)
+}
+
+func (m *MockDB) DeleteAPIKey(ctx context.Context, tableName, id string) error {
+	args := m.Called(tableName, id)
+	return args.Error(0)
+}
+
+// OrderEventRecord matches the record the built-in routes build for an order event
+func OrderEventRecord(eventType, merchant, externalOrderID, lastUpdated string) interface{} {
+	return mock.MatchedBy(func(record persistent.EventRecord) bool {
+		return record.EventType == eventType &&
+			record.PK == fmt.Sprintf("#PK#%s#%s", merchant, externalOrderID) &&
+			record.SK == fmt.Sprintf("#SK#%s#%s", lastUpdated, eventType) &&
+			record.Attributes["ExternalOrderId"] == externalOrderID &&
+			record.Attributes["LastUpdated"] == lastUpdated
+	})
+}
+
+// ShippingDeletedEvent returns a marshalled order-line/shipping-deleted event for the external order ID
+func ShippingDeletedEvent(t *testing.T, externalOrderID string) []byte {
+	t.Helper()
+	return MarshalEvent(t, model.OrderLineShippingDeleted{
+		BaseEvent: model.BaseEvent{
+			Type:        "order-line/shipping-deleted",
+			EventId:     "event-" + externalOrderID,
+			LastUpdated: "2024-05-03T03:48:13.506Z",
+		},
+		ExternalOrderID:      externalOrderID,
+		ExternalOrderGroupID: "group-" + externalOrderID,
+		ExternalOrderLineID:  "line-" + externalOrderID,
+	})
+}
+
+// MarshalEvent returns the JSON of an event, failing the test if it cannot be marshalled
+func MarshalEvent(t *testing.T, event interface{}) []byte {
+	t.Helper()
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonData
+}
+
+// FakeDynamoDB serves the DynamoDB JSON API from handlers keyed by operation, such as "PutItem". The
+// connectivity check made on connect is answered unless a ListTables handler is given, and any other
+// operation fails the test. The server is closed when the test ends.
+func FakeDynamoDB(t *testing.T, operations map[string]http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if handler, ok := operations[operation]; ok {
+			handler(w, r)
+			return
+		}
+		if operation == "ListTables" {
+			w.Write([]byte(`{"TableNames":[]}`))
+			return
+		}
+		t.Errorf("unexpected call %s", operation)
+		WriteError(w, "ValidationException", "unexpected call "+operation)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// WriteError answers a fake DynamoDB call with an error of the DynamoDB type, such as ResourceNotFoundException
+func WriteError(w http.ResponseWriter, errorType, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.dynamodb.v20120810#" + errorType, "message": message})
+}
+
+// WriteDefinitions writes table definitions, the JSON objects of the tables array, to a table.json in a
+// temporary directory and returns its path
+func WriteDefinitions(t *testing.T, tables string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "table.json")
+	if err := os.WriteFile(path, []byte(`{"tables": [`+tables+`]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Connect opens a database against a fake DynamoDB and closes it when the test ends
+func Connect(t *testing.T, server *httptest.Server, opts ...persistent.DatabaseOption) persistent.DatabaseInterface {
+	t.Helper()
+	opts = append([]persistent.DatabaseOption{persistent.WithConnection(persistent.ConnectionConfig{Region: "us-east-1", Endpoint: server.URL})}, opts...)
+	db, err := persistent.NewDatabase(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
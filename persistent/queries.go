@@ -1,61 +1,171 @@
 package persistent
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"webhook_test_server/model"
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-func (db *Database) FetchByPrimaryKey(tableName, pk string) (*dynamodb.QueryOutput, error) {
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
-		KeyConditionExpression: aws.String("#pk = :pkval"),
-		ExpressionAttributeNames: map[string]*string{
-			"#pk": aws.String("PK"),
-		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":pkval": {
-				S: aws.String(pk),
-			},
-		},
-		ScanIndexForward: aws.Bool(false), // Set to false if you want to sort in descending order
-	}
-
-	result, err := db.svc.Query(input)
+// externalOrderIdIndex is the global secondary index queried for the events of an external order ID
+const externalOrderIdIndex = "ExternalOrderIdIndex"
+
+// QueryEvents returns a page of the stored events selected by a query, read with a single DynamoDB query.
+// Events under a partition key are returned newest first and events of an external order ID in the order
+// of the index's sort key.
+func (db *Database) QueryEvents(ctx context.Context, tableName string, query model.EventQuery) (_ model.EventPage, err error) {
+	ctx, span := startSpan(ctx, "QueryEvents", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	if err := query.Validate(); err != nil {
+		return model.EventPage{}, err
+	}
+	input, err := db.queryInput(ctx, tableName, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch items by primary key without SK: %w", err)
+		return model.EventPage{}, err
 	}
 
+	// One page is read per call, so a query never holds more than a page of events in memory
+	ctx, done := observe(ctx, "Query", tableName)
+	output, err := db.svc.Query(ctx, input)
+	if err = done(err); err != nil {
+		return model.EventPage{}, fmt.Errorf("failed to query events: %w", err)
+	}
+
+	result := model.EventPage{Events: make([]model.StoredEvent, 0, len(output.Items))}
+	for _, item := range db.unscopeItems(ctx, tableName, output.Items) {
+		result.Events = append(result.Events, storedEventFromItem(item))
+	}
+	if result.NextCursor, err = db.encodeCursor(ctx, tableName, output.LastEvaluatedKey); err != nil {
+		return model.EventPage{}, err
+	}
 	return result, nil
 }
 
-func (db *Database) FetchByGSI(tableName, gsiName string, keyConditions map[string]*dynamodb.Condition) (*dynamodb.QueryOutput, error) {
-	input := &dynamodb.QueryInput{
-		TableName:     aws.String(tableName),
-		IndexName:     aws.String(gsiName),
-		KeyConditions: keyConditions,
+// queryInput translates an event query into a DynamoDB query on the table or the external order ID index
+func (db *Database) queryInput(ctx context.Context, tableName string, query model.EventQuery) (*dynamodb.QueryInput, error) {
+	input := &dynamodb.QueryInput{TableName: aws.String(tableName)}
+	var keyCondition expression.KeyConditionBuilder
+	if query.PK != "" {
+		// In a bin the key is looked up under the bin's prefix
+		keyCondition = expression.Key("PK").Equal(expression.Value(scopeKey(ctx, query.PK)))
+		input.ScanIndexForward = aws.Bool(false)
+	} else {
+		keys := db.scopeKeys(ctx, tableName, map[string]string{"ExternalOrderId": query.ExternalOrderID})
+		keyCondition = expression.Key("ExternalOrderId").Equal(expression.Value(keys["ExternalOrderId"]))
+		input.IndexName = aws.String(externalOrderIdIndex)
 	}
 
-	result, err := db.svc.Query(input)
+	builder := expression.NewBuilder().WithKeyCondition(keyCondition)
+	var filters []expression.ConditionBuilder
+	if query.EventType != "" {
+		filters = append(filters, expression.Name("EventType").Equal(expression.Value(query.EventType)))
+	}
+	if query.Since != "" {
+		filters = append(filters, expression.Name("LastUpdated").GreaterThanEqual(expression.Value(query.Since)))
+	}
+	if query.Until != "" {
+		filters = append(filters, expression.Name("LastUpdated").LessThanEqual(expression.Value(query.Until)))
+	}
+	switch len(filters) {
+	case 0:
+	case 1:
+		builder = builder.WithFilter(filters[0])
+	default:
+		builder = builder.WithFilter(expression.And(filters[0], filters[1], filters[2:]...))
+	}
+	expr, err := builder.Build()
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch item by GSI: %w", err)
+		return nil, err
 	}
+	input.KeyConditionExpression = expr.KeyCondition()
+	input.FilterExpression = expr.Filter()
+	input.ExpressionAttributeNames = expr.Names()
+	input.ExpressionAttributeValues = expr.Values()
 
-	return result, nil
+	if query.Limit > 0 {
+		input.Limit = aws.Int32(int32(min(query.Limit, 1<<31-1)))
+	}
+	if input.ExclusiveStartKey, err = db.decodeCursor(ctx, tableName, query); err != nil {
+		return nil, err
+	}
+	return input, nil
 }
 
-func (db *Database) QueryOrderEventsByExternalOrderId(tableName, externalOrderId string) (*dynamodb.QueryOutput, error) {
-	keyConditions := map[string]*dynamodb.Condition{
-		"ExternalOrderId": {
-			ComparisonOperator: aws.String("EQ"),
-			AttributeValueList: []*dynamodb.AttributeValue{
-				{
-					S: aws.String(externalOrderId),
-				},
-			},
-		},
+// storedEventFromItem converts a stored event item to a StoredEvent
+func storedEventFromItem(item map[string]types.AttributeValue) model.StoredEvent {
+	return model.StoredEvent{
+		EventType:       stringAttribute(item, "EventType"),
+		ExternalOrderID: stringAttribute(item, "ExternalOrderId"),
+		LastUpdated:     stringAttribute(item, "LastUpdated"),
+		PK:              stringAttribute(item, "PK"),
+		SK:              stringAttribute(item, "SK"),
+		EventData:       stringAttribute(item, "EventData"),
+		CloudEvent:      cloudEventFromItem(item),
+		Delivery:        deliveryFromItem(item),
 	}
+}
+
+// encodeCursor turns the key a query stopped at into an opaque cursor; the keys of event items are strings.
+// Bin prefixes are stripped, so a cursor does not show how a bin's keys are stored.
+func (db *Database) encodeCursor(ctx context.Context, tableName string, key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	values := make(map[string]string, len(key))
+	for name := range key {
+		values[name] = stringAttribute(key, name)
+	}
+	if scope, ok := BinFromContext(ctx); ok {
+		for _, name := range db.scopedAttributes(tableName) {
+			if value, ok := values[name]; ok {
+				values[name] = strings.TrimPrefix(value, binKeyPrefix(scope.ID))
+			}
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
 
-	return db.FetchByGSI(tableName, "ExternalOrderIdIndex", keyConditions)
-}
\ No newline at end of file
+// decodeCursor returns the key the query's cursor continues from, or nil without a cursor. The cursor must
+// come from the same query: its hash key must be the partition key or external order ID the query selects,
+// so a cursor cannot move a query into another partition or bin.
+func (db *Database) decodeCursor(ctx context.Context, tableName string, query model.EventQuery) (map[string]types.AttributeValue, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	var values map[string]string
+	if err != nil || json.Unmarshal(data, &values) != nil || len(values) == 0 {
+		return nil, model.ErrInvalidCursor
+	}
+	hashName, hashValue := "PK", query.PK
+	if query.PK == "" {
+		hashName, hashValue = "ExternalOrderId", query.ExternalOrderID
+	}
+	if values[hashName] != hashValue {
+		return nil, model.ErrInvalidCursor
+	}
+	for _, value := range values {
+		if IsBinKey(value) {
+			return nil, model.ErrInvalidCursor
+		}
+	}
+	key := make(map[string]types.AttributeValue, len(values))
+	for name, value := range db.scopeKeys(ctx, tableName, values) {
+		key[name] = stringValue(value)
+	}
+	return key, nil
+}
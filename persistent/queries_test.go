@@ -0,0 +1,236 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// queryRequest is the part of a DynamoDB Query request the fake table reads
+type queryRequest struct {
+	IndexName                 string
+	KeyConditionExpression    string
+	FilterExpression          string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]map[string]string
+	Limit                     int
+	ExclusiveStartKey         map[string]map[string]string
+}
+
+// matches evaluates a condition expression of "=", ">=" and "<=" comparisons joined by AND against an item
+func (q queryRequest) matches(expr string, item map[string]string) bool {
+	for _, clause := range strings.Split(expr, " AND ") {
+		fields := strings.Fields(strings.Trim(clause, "()"))
+		value, want := item[q.ExpressionAttributeNames[fields[0]]], q.ExpressionAttributeValues[fields[2]]["S"]
+		switch fields[1] {
+		case "=":
+			if value != want {
+				return false
+			}
+		case ">=":
+			if value < want {
+				return false
+			}
+		case "<=":
+			if value > want {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fakeTable serves Query requests from items kept in sort key order. Like DynamoDB it reads Limit items
+// after ExclusiveStartKey, applies the filter to them and returns the table and index keys of the last item
+// read when more items follow.
+func fakeTable(t *testing.T, items []map[string]string, requests *[]queryRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var query queryRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&query))
+		*requests = append(*requests, query)
+
+		var selected []map[string]string
+		for _, item := range items {
+			if query.matches(query.KeyConditionExpression, item) {
+				selected = append(selected, item)
+			}
+		}
+		if start := query.ExclusiveStartKey; start != nil {
+			for i, item := range selected {
+				if item["PK"] == start["PK"]["S"] && item["SK"] == start["SK"]["S"] {
+					selected = selected[i+1:]
+					break
+				}
+			}
+		}
+		output := map[string]interface{}{}
+		if query.Limit > 0 && query.Limit < len(selected) {
+			selected = selected[:query.Limit]
+			last := selected[len(selected)-1]
+			key := []string{"PK", "SK"}
+			if query.IndexName != "" {
+				key = append(key, "ExternalOrderId")
+			}
+			output["LastEvaluatedKey"] = attributes(last, key...)
+		}
+		events := []interface{}{}
+		for _, item := range selected {
+			if query.FilterExpression == "" || query.matches(query.FilterExpression, item) {
+				events = append(events, attributes(item))
+			}
+		}
+		output["Items"] = events
+		assert.NoError(t, json.NewEncoder(w).Encode(output))
+	}
+}
+
+// attributes writes an item's string values, or only the named ones, in the DynamoDB wire format
+func attributes(item map[string]string, names ...string) map[string]map[string]string {
+	if len(names) == 0 {
+		for name := range item {
+			names = append(names, name)
+		}
+	}
+	values := map[string]map[string]string{}
+	for _, name := range names {
+		values[name] = map[string]string{"S": item[name]}
+	}
+	return values
+}
+
+// orderEvents are the stored events of ORDER-1 and ORDER-2, in sort key order
+var orderEvents = []map[string]string{
+	{"PK": "#PK#BIGW#ORDER-1", "SK": "#SK#1", "ExternalOrderId": "ORDER-1", "EventType": "order/created", "LastUpdated": "2024-01-01T00:00:00.000Z"},
+	{"PK": "#PK#BIGW#ORDER-1", "SK": "#SK#2", "ExternalOrderId": "ORDER-1", "EventType": "order/updated", "LastUpdated": "2024-01-02T00:00:00.000Z"},
+	{"PK": "#PK#BIGW#ORDER-1", "SK": "#SK#3", "ExternalOrderId": "ORDER-1", "EventType": "order/updated", "LastUpdated": "2024-01-03T00:00:00.000Z"},
+	{"PK": "#PK#BIGW#ORDER-1", "SK": "#SK#4", "ExternalOrderId": "ORDER-1", "EventType": "order/updated", "LastUpdated": "2024-01-04T12:00:00.000Z"},
+	{"PK": "#PK#BIGW#ORDER-1", "SK": "#SK#5", "ExternalOrderId": "ORDER-1", "EventType": "order/cancelled", "LastUpdated": "2024-01-05T00:00:00.000Z"},
+	{"PK": "#PK#BIGW#ORDER-2", "SK": "#SK#1", "ExternalOrderId": "ORDER-2", "EventType": "order/created", "LastUpdated": "2024-01-01T00:00:00.000Z"},
+	{"PK": "BIN#abc##PK#BIGW#ORDER-1", "SK": "#SK#1", "ExternalOrderId": "BIN#abc#ORDER-1", "EventType": "order/created", "LastUpdated": "2024-01-01T00:00:00.000Z"},
+	{"PK": "BIN#abc##PK#BIGW#ORDER-1", "SK": "#SK#2", "ExternalOrderId": "BIN#abc#ORDER-1", "EventType": "order/updated", "LastUpdated": "2024-01-02T00:00:00.000Z"},
+}
+
+// sortKeys returns the sort keys of a page's events
+func sortKeys(page model.EventPage) []string {
+	keys := []string{}
+	for _, event := range page.Events {
+		keys = append(keys, event.SK)
+	}
+	return keys
+}
+
+// TestEventQueryPaging checks that the cursors of limited queries page through all of a partition's events
+func TestEventQueryPaging(t *testing.T) {
+	var requests []queryRequest
+	db := persistenttest.Connect(t, persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"Query": fakeTable(t, orderEvents, &requests)}))
+	ctx := context.Background()
+
+	query := model.EventQuery{ExternalOrderID: "ORDER-1", Limit: 2}
+	var pages [][]string
+	for {
+		page, err := db.QueryEvents(ctx, "Orders", query)
+		if !assert.NoError(t, err) {
+			return
+		}
+		pages = append(pages, sortKeys(page))
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.Equal(t, [][]string{{"#SK#1", "#SK#2"}, {"#SK#3", "#SK#4"}, {"#SK#5"}}, pages)
+	if assert.Len(t, requests, 3) {
+		assert.Equal(t, "ExternalOrderIdIndex", requests[0].IndexName)
+		assert.Equal(t, 2, requests[0].Limit)
+		assert.Empty(t, requests[0].ExclusiveStartKey)
+		assert.Equal(t, "#SK#4", requests[2].ExclusiveStartKey["SK"]["S"])
+	}
+
+	// A query without a limit reads a single page
+	requests = nil
+	page, err := db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1"})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 5)
+	assert.Empty(t, page.NextCursor)
+	assert.Len(t, requests, 1)
+}
+
+// TestEventQueryFilters checks that the event type and time filters select events, after the limit applies
+func TestEventQueryFilters(t *testing.T) {
+	var requests []queryRequest
+	db := persistenttest.Connect(t, persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"Query": fakeTable(t, orderEvents, &requests)}))
+	ctx := context.Background()
+
+	query := model.EventQuery{
+		PK:        "#PK#BIGW#ORDER-1",
+		EventType: "order/updated",
+		Since:     "2024-01-02T00:00:00.000Z",
+		Until:     "2024-01-04T00:00:00.000Z",
+	}
+	page, err := db.QueryEvents(ctx, "Orders", query)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"#SK#2", "#SK#3"}, sortKeys(page))
+	if assert.Len(t, requests, 1) {
+		assert.Contains(t, requests[0].FilterExpression, "AND")
+		values := []string{}
+		for _, value := range requests[0].ExpressionAttributeValues {
+			values = append(values, value["S"])
+		}
+		assert.ElementsMatch(t, []string{"#PK#BIGW#ORDER-1", "order/updated", "2024-01-02T00:00:00.000Z", "2024-01-04T00:00:00.000Z"}, values)
+	}
+
+	// The limit counts the events read, so a filtered page can be short and still have a cursor
+	query = model.EventQuery{PK: "#PK#BIGW#ORDER-1", EventType: "order/cancelled", Limit: 2}
+	page, err = db.QueryEvents(ctx, "Orders", query)
+	assert.NoError(t, err)
+	assert.Empty(t, page.Events)
+	assert.NotEmpty(t, page.NextCursor)
+}
+
+// TestEventQueryCursors checks that a cursor only continues the query it came from and hides bin prefixes
+func TestEventQueryCursors(t *testing.T) {
+	var requests []queryRequest
+	db := persistenttest.Connect(t, persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"Query": fakeTable(t, orderEvents, &requests)}))
+	ctx := context.Background()
+
+	page, err := db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Limit: 1})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, page.NextCursor)
+
+	// A cursor cannot move a query to another partition
+	_, err = db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-2", Limit: 1, Cursor: page.NextCursor})
+	assert.ErrorIs(t, err, model.ErrInvalidCursor)
+	_, err = db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Cursor: "not-a-cursor"})
+	assert.ErrorIs(t, err, model.ErrInvalidCursor)
+
+	// Nor into a bin, by naming its keys
+	forged, _ := json.Marshal(map[string]string{"PK": "#PK#BIGW#ORDER-1", "SK": "BIN#abc##SK#1"})
+	_, err = db.QueryEvents(ctx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Cursor: base64.RawURLEncoding.EncodeToString(forged)})
+	assert.ErrorIs(t, err, model.ErrInvalidCursor)
+
+	// In a bin the cursor holds the unprefixed keys, and the next page is read under the bin's prefix again
+	binCtx := persistent.WithBin(ctx, model.BinScope{ID: "abc"})
+	requests = nil
+	page, err = db.QueryEvents(binCtx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Limit: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"#SK#1"}, sortKeys(page))
+	cursor, err := base64.RawURLEncoding.DecodeString(page.NextCursor)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(cursor), persistent.BinKeyPrefix)
+
+	page, err = db.QueryEvents(binCtx, "Orders", model.EventQuery{PK: "#PK#BIGW#ORDER-1", Limit: 1, Cursor: page.NextCursor})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"#SK#2"}, sortKeys(page))
+	if assert.Len(t, requests, 2) {
+		assert.Equal(t, "BIN#abc##PK#BIGW#ORDER-1", requests[1].ExclusiveStartKey["PK"]["S"])
+	}
+}
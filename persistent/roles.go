@@ -0,0 +1,56 @@
+package persistent
+
+import "sort"
+
+// Table roles name what an events table holds. The configured table names are bound to roles, and
+// handlers and table definitions find their table by role rather than by position.
+const (
+	RoleOrders   = "orders"
+	RoleProducts = "products"
+)
+
+// positionalRoles are the roles of the former positional table names, in their order
+var positionalRoles = []string{RoleOrders, RoleProducts}
+
+// PositionalRole returns the role of a table by its position in the former positional table names,
+// orders then products, or "" for a position past them
+func PositionalRole(position int) string {
+	if position < 0 || position >= len(positionalRoles) {
+		return ""
+	}
+	return positionalRoles[position]
+}
+
+// Tables maps table roles onto the configured table names; a role without a name is not configured
+type Tables map[string]string
+
+// Name returns the table of a role and whether the role is configured
+func (t Tables) Name(role string) (string, bool) {
+	name := t[role]
+	return name, name != ""
+}
+
+// Roles returns the configured roles, sorted
+func (t Tables) Roles() []string {
+	roles := make([]string, 0, len(t))
+	for role, name := range t {
+		if name != "" {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Names returns the configured table names in the order of their roles, each name once
+func (t Tables) Names() []string {
+	seen := make(map[string]bool, len(t))
+	var names []string
+	for _, role := range t.Roles() {
+		if name := t[role]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -1,27 +1,37 @@
 package persistent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+
 	"webhook_test_server/model"
+	"webhook_test_server/tracing"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 // StoreData stores data in a specified DynamoDB table
-func (db *Database) StoreData(tableName, pKey string, data interface{}) error {
-	// First, marshal the data into a map[string]*dynamodb.AttributeValue
-	av, err := dynamodbattribute.MarshalMap(data)
+func (db *Database) StoreData(ctx context.Context, tableName, pKey string, data interface{}) (err error) {
+	ctx, span := startSpan(ctx, "StoreData", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	// First, marshal the data into a map[string]types.AttributeValue, named by the JSON field
+	// names as the attributes stored before SDK v2 were
+	av, err := attributevalue.MarshalMapWithOptions(data, func(o *attributevalue.EncoderOptions) {
+		o.TagKey = "json"
+	})
 	if err != nil {
 		log.Printf("Failed to marshal data: %v", err)
 		return err
 	}
 
 	// Add the primary key to the attribute value map
-	av["PrimaryKey"] = &dynamodb.AttributeValue{S: aws.String(pKey)}
+	av["PrimaryKey"] = stringValue(pKey)
 
 	// Create the PutItem input
 	input := &dynamodb.PutItemInput{
@@ -30,7 +40,9 @@ func (db *Database) StoreData(tableName, pKey string, data interface{}) error {
 	}
 
 	// Perform the PutItem operation
-	_, err = db.svc.PutItem(input)
+	ctx, done := observe(ctx, "PutItem", tableName)
+	_, err = db.svc.PutItem(ctx, input)
+	err = done(err)
 	if err != nil {
 		log.Printf("Failed to put item in table %s: %v", tableName, err)
 		return err
@@ -143,7 +155,10 @@ func (db *Database) CreateEventsTableIfNotExists(tableName string) error {
 */
 // StoreData stores data in the WebhookEvents table in DynamoDB.
 
-func (db *Database) StoreEventData(tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+func (db *Database) StoreEventData(ctx context.Context, tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) (err error) {
+	ctx, span := startSpan(ctx, "StoreEventData", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	log.Printf("StoreEventData")
 	// Prepare the primary key and sort key
 	pk := fmt.Sprintf("PK%s#%s#%s", merchantId, eventType, eventId)
@@ -156,31 +171,30 @@ func (db *Database) StoreEventData(tableName, eventType, eventId, lastUpdated, m
 		return err
 	}
 
-	// Prepare the attribute values for DynamoDB
-	item := map[string]*dynamodb.AttributeValue{
-		"PK":        {S: aws.String(pk)},
-		"SK":        {S: aws.String(sk)},
-		"EventID":   {S: aws.String(eventId)},
-		"EventType": {S: aws.String(eventType)},
-		"EventData": {S: aws.String(string(eventDataJSON))},
+	// Add DealId and ExternalOrderId to the item if available; the core attributes are written last
+	// so grouping keys cannot replace them
+	item := make(map[string]types.AttributeValue)
+	for name, value := range opts.Attributes {
+		item[name] = stringValue(value)
 	}
-
-	// Add DealId and ExternalOrderId to the item if available
 	if opts.DealId != nil {
-		item["DealId"] = &dynamodb.AttributeValue{S: aws.String(*opts.DealId)}
+		item["DealId"] = stringValue(*opts.DealId)
 	}
 	if opts.ExternalOrderId != nil {
-		item["ExternalOrderId"] = &dynamodb.AttributeValue{S: aws.String(*opts.ExternalOrderId)}
+		item["ExternalOrderId"] = stringValue(*opts.ExternalOrderId)
 	}
+	addCloudEventAttributes(item, opts.CloudEvent)
+	addDeliveryAttributes(item, opts.Delivery)
 
-	// Create the PutItem input
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
-	}
+	// Prepare the attribute values for DynamoDB
+	item["PK"] = stringValue(pk)
+	item["SK"] = stringValue(sk)
+	item["EventID"] = stringValue(eventId)
+	item["EventType"] = stringValue(eventType)
+	item["EventData"] = stringValue(string(eventDataJSON))
 
-	// Perform the PutItem operation
-	_, err = db.svc.PutItem(input)
+	// Perform the PutItem operation, batched when batch writes are enabled
+	err = db.putItem(ctx, tableName, item)
 	if err != nil {
 		log.Printf("Failed to put item in table :%v, %v", tableName, err)
 		return err
@@ -191,7 +205,10 @@ func (db *Database) StoreEventData(tableName, eventType, eventId, lastUpdated, m
 }
 
 // StoreData stores data in the WebhookEvents table in DynamoDB.
-func (db *Database) StoreOrderEventData(tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}) error {
+func (db *Database) StoreOrderEventData(ctx context.Context, tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) (err error) {
+	ctx, span := startSpan(ctx, "StoreOrderEventData", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	log.Printf("StoreEventData")
 	// Prepare the primary key and sort key
 	pk := fmt.Sprintf("#PK#%s#%s", merchantId, externalOrderId)
@@ -205,23 +222,90 @@ func (db *Database) StoreOrderEventData(tableName, eventType, externalOrderId, l
 	}
 
 	// Prepare the attribute values for DynamoDB
-	item := map[string]*dynamodb.AttributeValue{
-		"PK":              {S: aws.String(pk)},
-		"SK":              {S: aws.String(sk)},
-		"ExternalOrderId": {S: aws.String(externalOrderId)},
-		"LastUpdated":     {S: aws.String(lastUpdated)},
-		"EventType":       {S: aws.String(eventType)},
-		"EventData":       {S: aws.String(string(eventDataJSON))},
+	item := map[string]types.AttributeValue{
+		"PK":              stringValue(pk),
+		"SK":              stringValue(sk),
+		"ExternalOrderId": stringValue(externalOrderId),
+		"LastUpdated":     stringValue(lastUpdated),
+		"EventType":       stringValue(eventType),
+		"EventData":       stringValue(string(eventDataJSON)),
 	}
+	addCloudEventAttributes(item, opts.CloudEvent)
+	addDeliveryAttributes(item, opts.Delivery)
 
-	// Create the PutItem input
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
+	// Perform the PutItem operation, batched when batch writes are enabled
+	err = db.putItem(ctx, tableName, item)
+	if err != nil {
+		log.Printf("Failed to put item in table :%v, %v", tableName, err)
+		return err
 	}
 
-	// Perform the PutItem operation
-	_, err = db.svc.PutItem(input)
+	log.Printf("Data successfully stored in table : %v", tableName)
+	return nil
+}
+
+// reservedAttributes are the item attributes written by the server itself, which routes and dynamic
+// event types cannot set. EventID is not among them: routes store the event ID in it themselves.
+var reservedAttributes = map[string]bool{
+	"PK": true, "SK": true, "EventType": true, "EventData": true,
+	BinAttribute: true, ExpiresAtAttribute: true,
+	attrCloudEventSpecVersion: true, attrCloudEventID: true, attrCloudEventSource: true, attrCloudEventType: true,
+	attrCloudEventTime: true, attrCloudEventSubject: true, attrCloudEventDataContentType: true,
+	attrClientCertSubject: true, attrContentEncoding: true, attrCompressedBytes: true, attrBodyBytes: true,
+}
+
+// IsReservedAttribute reports whether an attribute name is written by the server and cannot be configured
+func IsReservedAttribute(name string) bool {
+	return reservedAttributes[name]
+}
+
+// EventRecord is an event item whose keys and attributes were resolved by the routing config
+type EventRecord struct {
+	PK        string
+	SK        string
+	EventType string
+	// Attributes are stored alongside the keys, typically as GSI keys
+	Attributes map[string]string
+	EventData  interface{}
+}
+
+// StoreEvent stores an event under the keys and attributes resolved for its route
+func (db *Database) StoreEvent(ctx context.Context, tableName string, record EventRecord, opts model.EventOptions) (err error) {
+	ctx, span := startSpan(ctx, "StoreEvent", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	log.Printf("StoreEvent %s", record.EventType)
+	// Marshal the entire event data into a JSON string for the EventData attribute
+	eventDataJSON, err := json.Marshal(record.EventData)
+	if err != nil {
+		log.Printf("Failed to marshal event data: %v", err)
+		return err
+	}
+
+	// Route and grouping key attributes come first so they cannot replace the keys or the event itself
+	item := make(map[string]types.AttributeValue)
+	for name, value := range record.Attributes {
+		item[name] = stringValue(value)
+	}
+	for name, value := range opts.Attributes {
+		item[name] = stringValue(value)
+	}
+	if opts.DealId != nil {
+		item["DealId"] = stringValue(*opts.DealId)
+	}
+	if opts.ExternalOrderId != nil {
+		item["ExternalOrderId"] = stringValue(*opts.ExternalOrderId)
+	}
+	addCloudEventAttributes(item, opts.CloudEvent)
+	addDeliveryAttributes(item, opts.Delivery)
+
+	item["PK"] = stringValue(record.PK)
+	item["SK"] = stringValue(record.SK)
+	item["EventType"] = stringValue(record.EventType)
+	item["EventData"] = stringValue(string(eventDataJSON))
+
+	// Perform the PutItem operation, batched when batch writes are enabled
+	err = db.putItem(ctx, tableName, item)
 	if err != nil {
 		log.Printf("Failed to put item in table :%v, %v", tableName, err)
 		return err
@@ -229,4 +313,21 @@ func (db *Database) StoreOrderEventData(tableName, eventType, externalOrderId, l
 
 	log.Printf("Data successfully stored in table : %v", tableName)
 	return nil
-}
\ No newline at end of file
+}
+
+// putItem writes a single event item, through the batch writer when batch writes are enabled.
+// Items written in a bin are scoped to it first.
+func (db *Database) putItem(ctx context.Context, tableName string, item map[string]types.AttributeValue) error {
+	db.scopeItem(ctx, tableName, item)
+	if db.batch != nil {
+		return db.batch.put(ctx, tableName, item)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	}
+	ctx, done := observe(ctx, "PutItem", tableName)
+	_, err := db.svc.PutItem(ctx, input)
+	return done(err)
+}
@@ -0,0 +1,43 @@
+package persistent_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStoreEventCoreAttributes checks that route and grouping key attributes cannot replace the keys or the event
+func TestStoreEventCoreAttributes(t *testing.T) {
+	var put struct {
+		Item map[string]map[string]string
+	}
+	fakeDynamoDB := persistenttest.FakeDynamoDB(t, map[string]http.HandlerFunc{"PutItem": func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&put))
+		w.Write([]byte(`{}`))
+	}})
+	db := persistenttest.Connect(t, fakeDynamoDB)
+
+	record := persistent.EventRecord{
+		PK:         "#PK#BIGW#ORDER-1",
+		SK:         "#SK#2024-06-14T15:55:13Z#order/created",
+		EventType:  "order/created",
+		Attributes: map[string]string{"PK": "#PK#OTHER#ORDER-1", "Depot": "SYD"},
+		EventData:  map[string]string{"id": "ORDER-1"},
+	}
+	opts := model.EventOptions{Attributes: map[string]string{"EventType": "order/forged", "EventData": "{}"}}
+	assert.NoError(t, db.StoreEvent(context.Background(), "Orders", record, opts))
+	assert.Equal(t, "#PK#BIGW#ORDER-1", put.Item["PK"]["S"])
+	assert.Equal(t, "order/created", put.Item["EventType"]["S"])
+	assert.Equal(t, `{"id":"ORDER-1"}`, put.Item["EventData"]["S"])
+	assert.Equal(t, "SYD", put.Item["Depot"]["S"])
+
+	assert.True(t, persistent.IsReservedAttribute("SK"))
+	assert.False(t, persistent.IsReservedAttribute("Depot"))
+}
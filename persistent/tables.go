@@ -1,45 +1,75 @@
 package persistent
 
 import (
+	"context"
+	"fmt"
 	"log"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"webhook_test_server/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-func (db *Database) InitializeTables(tableNames []string) error {
+func (db *Database) InitializeTables(ctx context.Context, tables Tables) (err error) {
+	ctx, span := startSpan(ctx, "InitializeTables", "")
+	defer func() { tracing.EndSpan(span, err) }()
+
 	log.Printf("Initialize the dynamodb Tables")
-	config, err := loadConfig("persistent/table.json")
+	configs, err := db.tableConfigs(tables)
 	if err != nil {
-		log.Fatalf("Failed to load config: %s", err)
+		return err
 	}
-
-	ReplaceTableNames(config, tableNames)
-	// Example for a single table, repeat for others or make it dynamic based on configuration
-	for _, tableConfig := range config.Tables {
-		err := db.CreateEventsTableIfNotExist(tableConfig)
+	db.tables = make(map[string]TableConfig, len(configs))
+	for _, tableConfig := range configs {
+		db.tables[tableConfig.TableName] = tableConfig
+		err := db.CreateEventsTableIfNotExist(ctx, tableConfig)
 		if err != nil {
 			log.Printf("Failed to create table %s: %s", tableConfig.TableName, err)
+			continue
+		}
+		// Bin events expire through the table TTL; without it they are still hidden once expired
+		if err := db.enableTTL(ctx, tableConfig.TableName); err != nil {
+			log.Printf("Failed to enable TTL on table %s: %s", tableConfig.TableName, err)
 		}
 	}
 	return nil
 }
 
-// ReplaceTableNames replaces the table names in the JSON configuration with the table names from the tableNames slice.
-func ReplaceTableNames(config *Config, tableNames []string) {
-	if len(config.Tables) != len(tableNames) {
-		log.Fatalf("The number of table names in the environment does not match the number of tables in the JSON configuration")
+// tableConfigs loads the table definitions of the configured roles, named after their tables.
+// Definitions of roles without a table are left out, and a table bound to two roles is an error.
+func (db *Database) tableConfigs(tables Tables) ([]TableConfig, error) {
+	config, err := LoadTableDefinitions(db.tableDefinitions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table definitions: %w", err)
 	}
 
-	for i := range config.Tables {
-		config.Tables[i].TableName = tableNames[i]
+	var configs []TableConfig
+	defined := make(map[string]string)
+	for _, role := range tables.Roles() {
+		tableConfig, ok := config.Definition(role)
+		if !ok {
+			log.Printf("No definition for the %s table in %s, it is not created", role, db.tableDefinitions)
+			continue
+		}
+		tableConfig.TableName = tables[role]
+		if other, ok := defined[tableConfig.TableName]; ok {
+			return nil, fmt.Errorf("table %s is bound to both the %s and %s roles", tableConfig.TableName, other, role)
+		}
+		defined[tableConfig.TableName] = role
+		configs = append(configs, tableConfig)
 	}
+	return configs, nil
 }
 
 // CreateTableIfNotExists checks if a table exists and creates it if it does not
-func (db *Database) CreateTableIfNotExists(tableName string) error {
+func (db *Database) CreateTableIfNotExists(ctx context.Context, tableName string) (err error) {
+	ctx, span := startSpan(ctx, "CreateTableIfNotExists", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	// First, check if the table already exists
-	exists, err := db.tableExists(tableName)
+	exists, err := db.tableExists(ctx, tableName)
 	if err != nil {
 		return err
 	}
@@ -51,26 +81,28 @@ func (db *Database) CreateTableIfNotExists(tableName string) error {
 	// Define table attributes and schema
 	input := &dynamodb.CreateTableInput{
 		TableName: aws.String(tableName),
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+		AttributeDefinitions: []types.AttributeDefinition{
 			{
 				AttributeName: aws.String("PrimaryKey"),
-				AttributeType: aws.String("S"),
+				AttributeType: types.ScalarAttributeTypeS,
 			},
 		},
-		KeySchema: []*dynamodb.KeySchemaElement{
+		KeySchema: []types.KeySchemaElement{
 			{
 				AttributeName: aws.String("PrimaryKey"),
-				KeyType:       aws.String("HASH"),
+				KeyType:       types.KeyTypeHash,
 			},
 		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+		ProvisionedThroughput: &types.ProvisionedThroughput{
 			ReadCapacityUnits:  aws.Int64(10),
 			WriteCapacityUnits: aws.Int64(10),
 		},
 	}
 
 	// Create the table
-	_, err = db.svc.CreateTable(input)
+	ctx, done := observe(ctx, "CreateTable", tableName)
+	_, err = db.svc.CreateTable(ctx, input)
+	err = done(err)
 	if err != nil {
 		return err
 	}
@@ -79,37 +111,38 @@ func (db *Database) CreateTableIfNotExists(tableName string) error {
 }
 
 // tableExists checks the existence of a table
-func (db *Database) tableExists(tableName string) (bool, error) {
-	input := &dynamodb.ListTablesInput{}
-
-	// Loop through all tables in the account to check for existence
-	for {
-		result, err := db.svc.ListTables(input)
+func (db *Database) tableExists(ctx context.Context, tableName string) (bool, error) {
+	// Page through all tables in the account to check for existence
+	paginator := dynamodb.NewListTablesPaginator(db.svc, &dynamodb.ListTablesInput{})
+	for paginator.HasMorePages() {
+		callCtx, done := observe(ctx, "ListTables", "")
+		result, err := paginator.NextPage(callCtx)
+		err = done(err)
 		if err != nil {
 			return false, err
 		}
 		for _, name := range result.TableNames {
-			if *name == tableName {
+			if name == tableName {
 				return true, nil
 			}
 		}
-		// Check if there are more tables beyond the returned set
-		if result.LastEvaluatedTableName == nil {
-			break
-		}
-		input.ExclusiveStartTableName = result.LastEvaluatedTableName
 	}
 
 	return false, nil
 }
 
 // DescribeTable checks details of a specified table
-func (db *Database) DescribeTable(tableName string) error {
+func (db *Database) DescribeTable(ctx context.Context, tableName string) (err error) {
+	ctx, span := startSpan(ctx, "DescribeTable", tableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	input := &dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
 	}
 
-	result, err := db.svc.DescribeTable(input)
+	ctx, done := observe(ctx, "DescribeTable", tableName)
+	result, err := db.svc.DescribeTable(ctx, input)
+	err = done(err)
 	if err != nil {
 		log.Printf("Error describing table %s: %v", tableName, err)
 		return err
@@ -118,18 +151,23 @@ func (db *Database) DescribeTable(tableName string) error {
 	// Output some of the important information about the table
 	table := result.Table
 	log.Printf("Table Description for %s:", tableName)
-	log.Printf("Status: %s", *table.TableStatus)
-	log.Printf("Item Count: %d", *table.ItemCount)
-	log.Printf("Provisioned Read Capacity Units: %d", *table.ProvisionedThroughput.ReadCapacityUnits)
-	log.Printf("Provisioned Write Capacity Units: %d", *table.ProvisionedThroughput.WriteCapacityUnits)
+	log.Printf("Status: %s", table.TableStatus)
+	log.Printf("Item Count: %d", aws.ToInt64(table.ItemCount))
+	if throughput := table.ProvisionedThroughput; throughput != nil {
+		log.Printf("Provisioned Read Capacity Units: %d", aws.ToInt64(throughput.ReadCapacityUnits))
+		log.Printf("Provisioned Write Capacity Units: %d", aws.ToInt64(throughput.WriteCapacityUnits))
+	}
 
 	return nil
 }
 
-func (db *Database) CreateEventsTableIfNotExist(config TableConfig) error {
+func (db *Database) CreateEventsTableIfNotExist(ctx context.Context, config TableConfig) (err error) {
+	ctx, span := startSpan(ctx, "CreateEventsTableIfNotExist", config.TableName)
+	defer func() { tracing.EndSpan(span, err) }()
+
 	log.Printf("CreateEventsTableIfNotExists")
 	// Check if the table already exists
-	exists, err := db.tableExists(config.TableName)
+	exists, err := db.tableExists(ctx, config.TableName)
 	if err != nil {
 		return err
 	}
@@ -138,37 +176,10 @@ func (db *Database) CreateEventsTableIfNotExist(config TableConfig) error {
 		return nil
 	}
 
-	// Ensure each GSI has a properly defined Projection
-	for i := range config.GlobalSecondaryIndexes {
-		if config.GlobalSecondaryIndexes[i].Projection == nil {
-			config.GlobalSecondaryIndexes[i].Projection = &dynamodb.Projection{
-				ProjectionType: aws.String("ALL"), // or "KEYS_ONLY", "INCLUDE"
-				// Uncomment and specify the attributes if ProjectionType is "INCLUDE"
-				// NonKeyAttributes: aws.StringSlice([]string{"Attribute1", "Attribute2"}),
-
-			}
-		}
-
-		// Check and set default Provisioned Throughput if it's not specified
-		if config.GlobalSecondaryIndexes[i].ProvisionedThroughput == nil {
-			config.GlobalSecondaryIndexes[i].ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
-				ReadCapacityUnits:  aws.Int64(10), // Default read capacity
-				WriteCapacityUnits: aws.Int64(10), // Default write capacity
-			}
-		}
-	}
-
 	// Create the table
-	_, err = db.svc.CreateTable(&dynamodb.CreateTableInput{
-		TableName:              aws.String(config.TableName),
-		AttributeDefinitions:   config.AttributeDefinitions,
-		KeySchema:              config.KeySchema,
-		GlobalSecondaryIndexes: config.GlobalSecondaryIndexes,
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(config.ReadCapacityUnits),
-			WriteCapacityUnits: aws.Int64(config.WriteCapacityUnits),
-		},
-	})
+	ctx, done := observe(ctx, "CreateTable", config.TableName)
+	_, err = db.svc.CreateTable(ctx, config.createTableInput())
+	err = done(err)
 
 	if err != nil {
 		return err
@@ -176,4 +187,118 @@ func (db *Database) CreateEventsTableIfNotExist(config TableConfig) error {
 
 	log.Printf("Table %s created successfully", config.TableName)
 	return nil
-}
\ No newline at end of file
+}
+
+// createTableInput builds the CreateTable request for a table definition, defaulting each GSI to an ALL
+// projection with 10 read and 10 write capacity units, and the stream, encryption and tags it sets
+func (c TableConfig) createTableInput() *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:            aws.String(c.TableName),
+		AttributeDefinitions: c.attributeDefinitions(),
+		KeySchema:            keySchema(c.KeySchema),
+	}
+	if c.payPerRequest() {
+		input.BillingMode = types.BillingModePayPerRequest
+	} else {
+		input.ProvisionedThroughput = throughput(c.ReadCapacityUnits, c.WriteCapacityUnits)
+	}
+	for _, index := range c.GlobalSecondaryIndexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, c.globalSecondaryIndex(index))
+	}
+	input.StreamSpecification = c.streamSpecification()
+	input.SSESpecification = c.sseSpecification()
+	for key, value := range c.Tags {
+		input.Tags = append(input.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return input
+}
+
+// streamSpecification returns the table's stream settings, or nil when the stream is not enabled
+func (c TableConfig) streamSpecification() *types.StreamSpecification {
+	if c.StreamSpecification == nil || !c.StreamSpecification.StreamEnabled {
+		return nil
+	}
+	return &types.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: types.StreamViewType(c.StreamSpecification.StreamViewType),
+	}
+}
+
+// sseSpecification returns the table's encryption settings, or nil for a key owned by DynamoDB
+func (c TableConfig) sseSpecification() *types.SSESpecification {
+	if c.SSESpecification == nil || !c.SSESpecification.Enabled {
+		return nil
+	}
+	sse := &types.SSESpecification{Enabled: aws.Bool(true), SSEType: types.SSETypeKms}
+	if c.SSESpecification.KMSMasterKeyID != "" {
+		sse.KMSMasterKeyId = aws.String(c.SSESpecification.KMSMasterKeyID)
+	}
+	return sse
+}
+
+// payPerRequest reports whether the table is billed on demand rather than for provisioned capacity
+func (c TableConfig) payPerRequest() bool {
+	return types.BillingMode(c.BillingMode) == types.BillingModePayPerRequest
+}
+
+func (c TableConfig) attributeDefinitions() []types.AttributeDefinition {
+	definitions := make([]types.AttributeDefinition, 0, len(c.AttributeDefinitions))
+	for _, attribute := range c.AttributeDefinitions {
+		definitions = append(definitions, types.AttributeDefinition{
+			AttributeName: aws.String(attribute.AttributeName),
+			AttributeType: types.ScalarAttributeType(attribute.AttributeType),
+		})
+	}
+	return definitions
+}
+
+// globalSecondaryIndex builds an index of the table, with provisioned capacity unless the table is billed on demand
+func (c TableConfig) globalSecondaryIndex(index GlobalSecondaryIndex) types.GlobalSecondaryIndex {
+	gsi := types.GlobalSecondaryIndex{
+		IndexName:  aws.String(index.IndexName),
+		KeySchema:  keySchema(index.KeySchema),
+		Projection: &types.Projection{ProjectionType: index.projectionType(), NonKeyAttributes: index.NonKeyAttributes},
+	}
+	if !c.payPerRequest() {
+		gsi.ProvisionedThroughput = throughput(index.capacity())
+	}
+	return gsi
+}
+
+// projectionType returns the index projection, ALL when none is set
+func (i GlobalSecondaryIndex) projectionType() types.ProjectionType {
+	if i.ProjectionType == "" {
+		return types.ProjectionTypeAll
+	}
+	return types.ProjectionType(i.ProjectionType)
+}
+
+// capacity returns the index read and write capacity units, each 10 when unset
+func (i GlobalSecondaryIndex) capacity() (read, write int64) {
+	read, write = i.ReadCapacityUnits, i.WriteCapacityUnits
+	if read == 0 {
+		read = 10
+	}
+	if write == 0 {
+		write = 10
+	}
+	return read, write
+}
+
+func throughput(read, write int64) *types.ProvisionedThroughput {
+	return &types.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(read),
+		WriteCapacityUnits: aws.Int64(write),
+	}
+}
+
+func keySchema(elements []KeySchemaElement) []types.KeySchemaElement {
+	schema := make([]types.KeySchemaElement, 0, len(elements))
+	for _, element := range elements {
+		schema = append(schema, types.KeySchemaElement{
+			AttributeName: aws.String(element.AttributeName),
+			KeyType:       types.KeyType(element.KeyType),
+		})
+	}
+	return schema
+}
@@ -0,0 +1,309 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit scopes reported in a Decision
+const (
+	ScopeGlobal   = "global"
+	ScopeMerchant = "merchant"
+)
+
+// OtherMerchants is the bucket and stats key shared by merchants that are neither known nor authenticated,
+// so senders cannot create buckets at will by making up merchant IDs
+const OtherMerchants = "other"
+
+// idleSweepInterval is how often buckets that have refilled to their burst are dropped. A full bucket is
+// the same as a new one, so dropping it loses nothing.
+const idleSweepInterval = time.Minute
+
+// Limit is a token bucket refilled at Rate tokens per second up to Burst tokens.
+// A zero Rate leaves the scope unlimited.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Config holds the global limit, the default per-merchant limit and per-merchant overrides
+type Config struct {
+	Global Limit `json:"global"`
+	// Merchant applies to each merchant without an override
+	Merchant  Limit            `json:"merchant"`
+	Merchants map[string]Limit `json:"merchants,omitempty"`
+	// Known lists merchants given their own bucket without an override; merchants with an override are known too
+	Known []string `json:"known,omitempty"`
+}
+
+// Decision is the result of Allow, with the values reported in the X-RateLimit-* headers.
+// When both scopes are limited it describes the one closest to its limit.
+type Decision struct {
+	Allowed bool
+	// Limited is false when no limit applies to the request
+	Limited   bool
+	Scope     string
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the request would be allowed; zero when allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Stats counts the decisions made for a merchant so tests can check how a sender reacted to throttling
+type Stats struct {
+	Allowed  int64 `json:"allowed"`
+	Rejected int64 `json:"rejected"`
+	// EarlyRetries counts requests that arrived before the Retry-After of a previous rejection had passed
+	EarlyRetries   int64      `json:"earlyRetries"`
+	LastRejectedAt *time.Time `json:"lastRejectedAt,omitempty"`
+	retryAt        time.Time
+}
+
+// bucket is a token bucket; tokens are refilled lazily when the bucket is used
+type bucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+func newBucket(limit Limit, now time.Time) *bucket {
+	return &bucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	b.updated = now
+}
+
+// wait is how long until the bucket holds n tokens
+func (b *bucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// Limiter enforces the global and per-merchant token buckets.
+// Known and authenticated merchants get a bucket of their own on first use; every other merchant shares
+// the OtherMerchants bucket. Buckets are dropped once idle long enough to be full again.
+type Limiter struct {
+	mu        sync.Mutex
+	config    Config
+	known     map[string]bool
+	global    *bucket
+	merchants map[string]*bucket
+	stats     map[string]*Stats
+	swept     time.Time
+	now       func() time.Time
+}
+
+// New returns a limiter enforcing the config
+func New(config Config) *Limiter {
+	l := &Limiter{stats: make(map[string]*Stats), now: time.Now}
+	l.SetConfig(config)
+	return l
+}
+
+// SetConfig replaces the limits; every bucket starts full again
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+	l.global = nil
+	if config.Global.Rate > 0 {
+		l.global = newBucket(config.Global, l.now())
+	}
+	l.merchants = make(map[string]*bucket)
+	l.known = make(map[string]bool, len(config.Known)+len(config.Merchants))
+	for _, merchant := range config.Known {
+		l.known[merchant] = true
+	}
+	for merchant := range config.Merchants {
+		l.known[merchant] = true
+	}
+}
+
+// Config returns the limits in force
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Allow takes a token for a request of the merchant from the merchant and global buckets.
+// A request is only charged when both buckets have a token, so a rejection costs nothing.
+// An empty merchant is only subject to the global limit. authenticated is true when the request's
+// API key is limited to merchants including this one, which gives the merchant its own bucket.
+func (l *Limiter) Allow(merchant string, authenticated bool) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	if merchant != "" && !authenticated && !l.known[merchant] {
+		merchant = OtherMerchants
+	}
+
+	type scoped struct {
+		name   string
+		bucket *bucket
+	}
+	var buckets []scoped
+	if b := l.merchantBucket(merchant, now); b != nil {
+		buckets = append(buckets, scoped{ScopeMerchant, b})
+	}
+	if l.global != nil {
+		buckets = append(buckets, scoped{ScopeGlobal, l.global})
+	}
+	if len(buckets) == 0 {
+		return Decision{Allowed: true}
+	}
+
+	decision := Decision{Allowed: true, Limited: true}
+	var reported *bucket
+	for _, s := range buckets {
+		s.bucket.refill(now)
+		if wait := s.bucket.wait(1); wait > decision.RetryAfter {
+			decision.Allowed = false
+			decision.RetryAfter, decision.Scope, reported = wait, s.name, s.bucket
+		}
+	}
+	if decision.Allowed {
+		// Report the scope with the fewest tokens left
+		for _, s := range buckets {
+			s.bucket.tokens--
+			if reported == nil || s.bucket.tokens < reported.tokens {
+				decision.Scope, reported = s.name, s.bucket
+			}
+		}
+	}
+	decision.Limit = reported.limit.Burst
+	decision.Remaining = int(math.Max(0, math.Floor(reported.tokens)))
+	decision.Reset = reported.wait(float64(reported.limit.Burst))
+	l.record(merchant, decision, now)
+	return decision
+}
+
+// sweep drops the merchant buckets that have refilled to their burst, at most once per idleSweepInterval
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < idleSweepInterval {
+		return
+	}
+	l.swept = now
+	for merchant, b := range l.merchants {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.merchants, merchant)
+		}
+	}
+}
+
+// merchantBucket returns the bucket of a merchant, or nil when the merchant is not limited
+func (l *Limiter) merchantBucket(merchant string, now time.Time) *bucket {
+	if merchant == "" {
+		return nil
+	}
+	if b, ok := l.merchants[merchant]; ok {
+		return b
+	}
+	limit, ok := l.config.Merchants[merchant]
+	if !ok {
+		limit = l.config.Merchant
+	}
+	if limit.Rate <= 0 {
+		return nil
+	}
+	b := newBucket(limit, now)
+	l.merchants[merchant] = b
+	return b
+}
+
+func (l *Limiter) record(merchant string, decision Decision, now time.Time) {
+	stats, ok := l.stats[merchant]
+	if !ok {
+		stats = &Stats{}
+		l.stats[merchant] = stats
+	}
+	if now.Before(stats.retryAt) {
+		stats.EarlyRetries++
+	}
+	if decision.Allowed {
+		stats.Allowed++
+		return
+	}
+	stats.Rejected++
+	rejectedAt := now
+	stats.LastRejectedAt = &rejectedAt
+	stats.retryAt = now.Add(RetryAfterSeconds(decision.RetryAfter))
+}
+
+// Stats returns the decisions counted per merchant since the last reset, with merchants that are neither
+// known nor authenticated counted under OtherMerchants
+func (l *Limiter) Stats() map[string]Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(map[string]Stats, len(l.stats))
+	for merchant, s := range l.stats {
+		stats[merchant] = *s
+	}
+	return stats
+}
+
+// ResetStats clears the decision counts
+func (l *Limiter) ResetStats() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats = make(map[string]*Stats)
+}
+
+// RetryAfterSeconds rounds a wait up to the whole seconds sent in Retry-After
+func RetryAfterSeconds(wait time.Duration) time.Duration {
+	return time.Duration(math.Ceil(wait.Seconds())) * time.Second
+}
+
+// ParseLimit parses a limit written as "rate" or "rate:burst", such as "10:20" for 10 requests
+// per second with bursts of 20. The burst defaults to the rate rounded up.
+func ParseLimit(value string) (Limit, error) {
+	rateText, burstText, hasBurst := strings.Cut(strings.TrimSpace(value), ":")
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected rate or rate:burst", value)
+	}
+	limit := Limit{Rate: rate, Burst: int(math.Ceil(rate))}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burstText); err != nil {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: expected rate or rate:burst", value)
+		}
+	}
+	return limit, limit.Validate()
+}
+
+// Validate checks that a limited scope can hold at least one token
+func (l Limit) Validate() error {
+	if l.Rate < 0 || (l.Rate > 0 && l.Burst < 1) {
+		return fmt.Errorf("rate limit %g:%d needs a non-negative rate and a burst of at least 1", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+// Validate checks every limit of the config
+func (c Config) Validate() error {
+	if err := c.Global.Validate(); err != nil {
+		return fmt.Errorf("global: %w", err)
+	}
+	if err := c.Merchant.Validate(); err != nil {
+		return fmt.Errorf("merchant: %w", err)
+	}
+	for merchant, limit := range c.Merchants {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("merchant %s: %w", merchant, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLimiterBuckets checks that only known and authenticated merchants get their own bucket, that other
+// merchants share one and that idle buckets are dropped
+func TestLimiterBuckets(t *testing.T) {
+	now := time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)
+	l := New(Config{
+		Merchant:  Limit{Rate: 1, Burst: 1},
+		Merchants: map[string]Limit{"BIGW": {Rate: 1, Burst: 2}},
+		Known:     []string{"KMART"},
+	})
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.Allow("BIGW", false).Allowed)
+	assert.True(t, l.Allow("BIGW", false).Allowed)
+	assert.False(t, l.Allow("BIGW", false).Allowed)
+	assert.True(t, l.Allow("KMART", false).Allowed)
+	assert.True(t, l.Allow("SIGNED", true).Allowed)
+
+	// Made-up merchants share the other bucket and stats
+	assert.True(t, l.Allow("RANDOM-1", false).Allowed)
+	decision := l.Allow("RANDOM-2", false)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, ScopeMerchant, decision.Scope)
+	assert.Len(t, l.merchants, 4)
+	stats := l.Stats()
+	assert.Equal(t, Stats{Allowed: 1, Rejected: 1, LastRejectedAt: &now, retryAt: now.Add(time.Second)}, stats[OtherMerchants])
+	assert.NotContains(t, stats, "RANDOM-1")
+
+	// Once refilled, idle buckets are dropped on the next sweep and start full again
+	now = now.Add(idleSweepInterval)
+	assert.True(t, l.Allow("", false).Allowed)
+	assert.Empty(t, l.merchants)
+	assert.True(t, l.Allow("RANDOM-3", false).Allowed)
+	assert.Len(t, l.merchants, 1)
+
+	// An empty merchant is only subject to the global limit
+	assert.False(t, l.Allow("", false).Limited)
+}
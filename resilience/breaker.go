@@ -0,0 +1,123 @@
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states reported by BreakerState
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is matched by the error returned while the breaker rejects calls
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+// CircuitOpenError is returned without calling the database while the breaker is open
+type CircuitOpenError struct {
+	Operation string
+	// RetryAfter is how long until the breaker lets a probe call through
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s rejected: %v, retry in %s", e.Operation, ErrCircuitOpen, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Is lets errors.Is match ErrCircuitOpen
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerState describes the breaker for health checks
+type BreakerState struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	FailureThreshold    int        `json:"failureThreshold"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	// RetryAfterSeconds is how long an open breaker keeps rejecting calls
+	RetryAfterSeconds float64 `json:"retryAfterSeconds,omitempty"`
+}
+
+// Breaker opens after Failures consecutive failed calls and rejects calls for Cooldown. It then lets one
+// probe call through: success closes it again and failure reopens it for another Cooldown.
+type Breaker struct {
+	mu       sync.Mutex
+	failures int
+	cooldown time.Duration
+
+	state       string
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+	now         func() time.Time
+}
+
+// NewBreaker returns a closed breaker; a threshold below one disables it
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{failures: failures, cooldown: cooldown, state: StateClosed, now: time.Now}
+}
+
+// Allow reports whether a call may be made, returning a CircuitOpenError when it may not
+func (b *Breaker) Allow(operation string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		if wait := b.cooldown - b.now().Sub(b.openedAt); wait > 0 {
+			return &CircuitOpenError{Operation: operation, RetryAfter: wait}
+		}
+		b.state, b.probing = StateHalfOpen, true
+		return nil
+	case StateHalfOpen:
+		// Only one probe is in flight at a time
+		if b.probing {
+			return &CircuitOpenError{Operation: operation, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record updates the breaker with the outcome of an allowed call. failed is true when the
+// database could not serve the call, as opposed to rejecting it.
+func (b *Breaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.state, b.consecutive = StateClosed, 0
+		return
+	}
+	b.consecutive++
+	if b.failures > 0 && (b.state == StateHalfOpen || b.consecutive >= b.failures) {
+		b.state, b.openedAt = StateOpen, b.now()
+	}
+}
+
+// Release ends an allowed call without an outcome, such as one its caller gave up on, so a probe that
+// said nothing about the database lets the next call probe instead
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// State returns the breaker state for health checks
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := BreakerState{State: b.state, ConsecutiveFailures: b.consecutive, FailureThreshold: b.failures}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		state.OpenedAt = &openedAt
+	}
+	if wait := b.cooldown - b.now().Sub(b.openedAt); b.state == StateOpen && wait > 0 {
+		state.RetryAfterSeconds = wait.Seconds()
+	}
+	return state
+}
@@ -0,0 +1,178 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"webhook_test_server/metrics"
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+)
+
+// Config controls retries and the circuit breaker
+type Config struct {
+	// MaxAttempts is the number of times a call is made, including the first; values below one make it once
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// BreakerFailures is the number of consecutive failed calls that open the breaker; zero disables it
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// Database wraps a database so its data operations are retried with capped exponential backoff and full
+// jitter, and rejected by a circuit breaker while the database keeps failing. Health checks, connecting,
+// creating tables and closing are passed through, so health checks report the database's own state.
+type Database struct {
+	persistent.DatabaseInterface
+	config  Config
+	breaker *Breaker
+}
+
+// Wrap returns db with retries and a circuit breaker
+func Wrap(db persistent.DatabaseInterface, config Config) *Database {
+	return &Database{DatabaseInterface: db, config: config, breaker: NewBreaker(config.BreakerFailures, config.BreakerCooldown)}
+}
+
+// Breaker returns the circuit breaker guarding the database
+func (d *Database) Breaker() *Breaker {
+	return d.breaker
+}
+
+// Retryable reports whether a failed operation may succeed later: the database failed transiently or
+// the breaker rejected the call
+func Retryable(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || persistent.IsRetryableError(err)
+}
+
+// do makes a call through the breaker, retrying retryable errors until the attempts run out or the context is done
+func (d *Database) do(ctx context.Context, operation string, call func() error) error {
+	return d.attempt(ctx, operation, d.config.MaxAttempts, call)
+}
+
+// attempt makes a call through the breaker at most maxAttempts times
+func (d *Database) attempt(ctx context.Context, operation string, maxAttempts int, call func() error) error {
+	if err := d.breaker.Allow(operation); err != nil {
+		return err
+	}
+	backoff := d.config.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = call()
+		if err == nil || !persistent.IsRetryableError(err) || attempt >= maxAttempts || ctx.Err() != nil {
+			break
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Printf("Retrying %s after %s (attempt %d of %d): %v", operation, wait, attempt+1, maxAttempts, err)
+		metrics.DynamoDBRetry(operation)
+		if sleepErr := sleep(ctx, wait); sleepErr != nil {
+			break
+		}
+		backoff = min(backoff*2, d.config.MaxBackoff)
+	}
+
+	// A caller that went away or ran out of time says nothing about the database
+	if err != nil && ctx.Err() != nil {
+		d.breaker.Release()
+		return err
+	}
+	d.breaker.Record(persistent.IsRetryableError(err))
+	return err
+}
+
+// sleep waits for d or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Database) StoreData(ctx context.Context, tableName, pKey string, data interface{}) error {
+	return d.do(ctx, "StoreData", func() error {
+		return d.DatabaseInterface.StoreData(ctx, tableName, pKey, data)
+	})
+}
+
+func (d *Database) StoreEventData(ctx context.Context, tableName, eventType, eventId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	return d.do(ctx, "StoreEventData", func() error {
+		return d.DatabaseInterface.StoreEventData(ctx, tableName, eventType, eventId, lastUpdated, merchantId, eventData, opts)
+	})
+}
+
+func (d *Database) StoreOrderEventData(ctx context.Context, tableName, eventType, externalOrderId, lastUpdated, merchantId string, eventData interface{}, opts model.EventOptions) error {
+	return d.do(ctx, "StoreOrderEventData", func() error {
+		return d.DatabaseInterface.StoreOrderEventData(ctx, tableName, eventType, externalOrderId, lastUpdated, merchantId, eventData, opts)
+	})
+}
+
+func (d *Database) StoreEvent(ctx context.Context, tableName string, record persistent.EventRecord, opts model.EventOptions) error {
+	return d.do(ctx, "StoreEvent", func() error {
+		return d.DatabaseInterface.StoreEvent(ctx, tableName, record, opts)
+	})
+}
+
+func (d *Database) QueryEvents(ctx context.Context, tableName string, query model.EventQuery) (page model.EventPage, err error) {
+	err = d.do(ctx, "QueryEvents", func() (err error) {
+		page, err = d.DatabaseInterface.QueryEvents(ctx, tableName, query)
+		return err
+	})
+	return page, err
+}
+
+// CreateBin is not retried: a retry after a write that was applied but reported as failed would find
+// the bin taken and answer ErrBinExists
+func (d *Database) CreateBin(ctx context.Context, tableName string, bin model.Bin) error {
+	return d.attempt(ctx, "CreateBin", 1, func() error {
+		return d.DatabaseInterface.CreateBin(ctx, tableName, bin)
+	})
+}
+
+func (d *Database) GetBin(ctx context.Context, tableName, id string) (bin *model.Bin, err error) {
+	err = d.do(ctx, "GetBin", func() (err error) {
+		bin, err = d.DatabaseInterface.GetBin(ctx, tableName, id)
+		return err
+	})
+	return bin, err
+}
+
+func (d *Database) DeleteBin(ctx context.Context, tableName, id string) error {
+	return d.do(ctx, "DeleteBin", func() error {
+		return d.DatabaseInterface.DeleteBin(ctx, tableName, id)
+	})
+}
+
+func (d *Database) StoreAPIKey(ctx context.Context, tableName string, key model.APIKey) error {
+	return d.do(ctx, "StoreAPIKey", func() error {
+		return d.DatabaseInterface.StoreAPIKey(ctx, tableName, key)
+	})
+}
+
+func (d *Database) GetAPIKey(ctx context.Context, tableName, id string) (key *model.APIKey, err error) {
+	err = d.do(ctx, "GetAPIKey", func() (err error) {
+		key, err = d.DatabaseInterface.GetAPIKey(ctx, tableName, id)
+		return err
+	})
+	return key, err
+}
+
+func (d *Database) ListAPIKeys(ctx context.Context, tableName string) (keys []model.APIKey, err error) {
+	err = d.do(ctx, "ListAPIKeys", func() (err error) {
+		keys, err = d.DatabaseInterface.ListAPIKeys(ctx, tableName)
+		return err
+	})
+	return keys, err
+}
+
+func (d *Database) DeleteAPIKey(ctx context.Context, tableName, id string) error {
+	return d.do(ctx, "DeleteAPIKey", func() error {
+		return d.DatabaseInterface.DeleteAPIKey(ctx, tableName, id)
+	})
+}
@@ -0,0 +1,68 @@
+package resilience_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"webhook_test_server/model"
+	"webhook_test_server/persistent"
+	"webhook_test_server/persistent/persistenttest"
+	"webhook_test_server/resilience"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var throttled = &types.ProvisionedThroughputExceededException{Message: aws.String("throttled")}
+
+// TestRetries checks that retryable errors are retried and that CreateBin is made only once
+func TestRetries(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("StoreEvent", "Events", mock.Anything, model.EventOptions{}).Return(throttled).Once()
+	db.On("StoreEvent", "Events", mock.Anything, model.EventOptions{}).Return(nil).Once()
+	db.On("CreateBin", "Events", mock.Anything).Return(throttled)
+	resilient := resilience.Wrap(db, resilience.Config{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, BreakerFailures: 5, BreakerCooldown: time.Second})
+
+	assert.NoError(t, resilient.StoreEvent(context.Background(), "Events", persistent.EventRecord{}, model.EventOptions{}))
+	db.AssertNumberOfCalls(t, "StoreEvent", 2)
+
+	assert.ErrorIs(t, resilient.CreateBin(context.Background(), "Events", model.Bin{ID: "bin"}), throttled)
+	db.AssertNumberOfCalls(t, "CreateBin", 1)
+	assert.Equal(t, 1, resilient.Breaker().State().ConsecutiveFailures)
+}
+
+// TestBreakerIgnoresCallers checks that calls the caller canceled or let time out are not counted against
+// the database, and that such a probe does not close a half-open breaker
+func TestBreakerIgnoresCallers(t *testing.T) {
+	db := new(persistenttest.MockDB)
+	db.On("StoreEvent", "Events", mock.Anything, model.EventOptions{}).Return(throttled)
+	db.On("QueryEvents", "Events", mock.Anything).Return(model.EventPage{}, context.DeadlineExceeded)
+	db.On("CreateBin", "Events", mock.Anything).Return(throttled)
+	resilient := resilience.Wrap(db, resilience.Config{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour, BreakerFailures: 1, BreakerCooldown: 10 * time.Millisecond})
+	breaker := resilient.Breaker()
+
+	// A caller's deadline passing is not a database failure
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err := resilient.QueryEvents(ctx, "Events", model.EventQuery{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, resilience.StateClosed, breaker.State().State)
+	assert.Equal(t, 0, breaker.State().ConsecutiveFailures)
+
+	assert.Error(t, resilient.CreateBin(context.Background(), "Events", model.Bin{ID: "bin"}))
+	assert.Equal(t, resilience.StateOpen, breaker.State().State)
+	time.Sleep(20 * time.Millisecond)
+
+	// The probe is canceled while it waits to retry: the breaker stays half-open and lets the next call probe
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	assert.ErrorIs(t, resilient.StoreEvent(ctx, "Events", persistent.EventRecord{}, model.EventOptions{}), throttled)
+	assert.Equal(t, resilience.StateHalfOpen, breaker.State().State)
+	assert.NoError(t, breaker.Allow("StoreEvent"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"webhook_test_server/handler"
+)
+
+// NewServer builds the HTTP server with the configured timeouts and header limits
+func NewServer(cfg ServerConfig, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// Serve runs the server until SIGINT or SIGTERM, then shuts it down gracefully:
+// /ready reports not-ready, new connections are refused, and in-flight webhooks
+// and queued events are given the shutdown timeout to complete.
+func Serve(server *http.Server, webhookHandler *handler.WebhookHandler, cfg ServerConfig) error {
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP reloads the routing config without a restart, until shutdown begins
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(reload)
+		for {
+			select {
+			case <-signalCtx.Done():
+				return
+			case <-reload:
+				if err := webhookHandler.ReloadRoutes(); err != nil {
+					log.Printf("Failed to reload routing config, keeping the current routes: %v", err)
+				}
+			}
+		}
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		// The TLS certificates are part of server.TLSConfig
+		if server.TLSConfig != nil {
+			log.Printf("Server starting with TLS on port: %s", server.Addr)
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		log.Printf("Server starting on port: %s", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-signalCtx.Done():
+		stop()
+		log.Println("Shutdown signal received, draining in-flight requests")
+	}
+
+	// Report not-ready first so load balancers stop routing new webhooks here
+	webhookHandler.StartDraining()
+	if delay := cfg.ShutdownReadinessDelay; delay > 0 {
+		log.Printf("Waiting %s for readiness change to propagate", delay)
+		time.Sleep(delay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown did not complete, closing remaining connections: %v", err)
+		server.Close()
+	}
+	if err := webhookHandler.Drain(shutdownCtx); err != nil {
+		log.Printf("Ingest queue did not drain, unfinished events remain in the WAL: %v", err)
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
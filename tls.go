@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NewTLSConfig builds the server TLS config, or returns nil unless TLS is enabled.
+// Without a certificate and key a self-signed development certificate is generated
+// in the development certificate directory on first run and reused until it is about to expire.
+func NewTLSConfig(settings TLSSettings) (*tls.Config, error) {
+	if !settings.Enabled {
+		return nil, nil
+	}
+
+	minVersion, err := parseTLSVersion(settings.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile, keyFile := settings.CertFile, settings.KeyFile
+	switch {
+	case certFile == "" && keyFile == "":
+		if certFile, keyFile, err = ensureDevCertificate(settings.DevCertDir); err != nil {
+			return nil, fmt.Errorf("failed to generate development certificate: %w", err)
+		}
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{MinVersion: minVersion, Certificates: []tls.Certificate{cert}}
+
+	// Client certificates are verified against the client CA bundle to test mTLS senders
+	if caFile := settings.ClientCAFile; caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %s", caFile)
+		}
+		switch mode := settings.ClientAuth; mode {
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH %q, expected optional or require", mode)
+		}
+	}
+	return config, nil
+}
+
+// parseTLSVersion maps a version such as "1.2" onto its crypto/tls constant
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS_MIN_VERSION %q, expected 1.2 or 1.3", version)
+}
+
+// devCertRenewBefore is how long before it expires the development certificate is replaced
+const devCertRenewBefore = 7 * 24 * time.Hour
+
+// ensureDevCertificate returns the development certificate and key in dir, generating a self-signed pair
+// if they are missing, unreadable or close to expiry
+func ensureDevCertificate(dir string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	notAfter, err := certificateExpiry(certFile, keyFile)
+	if err == nil && time.Until(notAfter) > devCertRenewBefore {
+		return certFile, keyFile, nil
+	}
+	if err == nil {
+		log.Printf("Development certificate in %s expires at %s, generating a new one", dir, notAfter.Format(time.RFC3339))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Development certificate in %s is unusable, generating a new one: %v", dir, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := writeDevCertificate(certFile, keyFile, time.Now().AddDate(1, 0, 0)); err != nil {
+		return "", "", err
+	}
+	log.Printf("Generated a self-signed development certificate in %s; do not use it in production", dir)
+	return certFile, keyFile, nil
+}
+
+// certificateExpiry returns the NotAfter of a certificate and key pair
+func certificateExpiry(certFile, keyFile string) (time.Time, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
+// writeDevCertificate writes a self-signed certificate for localhost valid until notAfter, and its key
+func writeDevCertificate(certFile, keyFile string, notAfter time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost", Organization: []string{"Webhook Test Server (development)"}},
+		NotBefore:    notAfter.AddDate(-1, 0, 0).Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}